@@ -1,81 +1,1363 @@
 package mizumanju
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
+	"github.com/marcie001/mizumanju/imgmap"
+	"github.com/marcie001/mizumanju/totp"
 )
 
+// totpChallenge は 2 段階認証が必要なときの /api/login のレスポンスを表す構造体。
+type totpChallenge struct {
+	TotpRequired bool `json:"totpRequired"`
+}
+
+// totpEnrollment は 2 段階認証の秘密鍵を登録したときのレスポンスを表す構造体。
+// URI は認証アプリに読み込ませる otpauth URI。
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
 // handleLogin は /api/login へのリクエストを処理する関数。
 // 認証を行い、その結果を返す。認証 OK の場合、セッションに認証情報を格納する。
 func login(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
 	log.Println("/login")
 	param, ok := p.(*loginParams)
 	if !ok {
-		err = fmt.Errorf("Expected *loginParams, but actual is %T", p)
+		err = fmt.Errorf("Expected *loginParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	user, err := Authenticate(r, param.Username, param.Password)
+	if err != nil {
+		return
+	}
+	challenge, msg, err := completeLogin(w, r, &user)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if challenge {
+		return json.Marshal(NewResponse(nil, &totpChallenge{TotpRequired: true}))
+	}
+	b, err = json.Marshal(NewResponse(msg, &user))
+	if err != nil {
+		return
+	}
+	return
+}
+
+// completeLogin は本人であることを確認したユーザをログインさせる関数。
+// 2 段階認証を有効にしているユーザは、/api/login/totp でコードを確認するまでログインさせず、challenge に true を返す。
+// msg はユーザに表示するメッセージ。
+func completeLogin(w http.ResponseWriter, r *http.Request, user *User) (challenge bool, msg interface{}, err error) {
+	ts, err := FindTotpStatus(r, user.Id)
+	if err != nil {
+		return
+	}
+	if ts.Enabled {
+		auth, _ := store.Get(r, sessionAuth)
+		delete(auth.Values, "user")
+		auth.Values["pendingUser"] = user
+		auth.Values["pendingExpires"] = time.Now().Add(totpChallengeTTL).Unix()
+		auth.Save(r, w)
+		return true, nil, nil
+	}
+
+	if user.Role == admin {
+		settings, err := FindSecuritySettings(r)
+		if err != nil {
+			return false, nil, err
+		}
+		if settings.RequireAdminTotp {
+			// 管理者の機能は makeAuthedAction で拒否する
+			msg = "Two-factor authentication is required for administrators. Enable it to use administrator functions."
+		}
+	}
+	saveLogin(w, r, user)
+	return
+}
+
+// loginTotp は /api/login/totp へのリクエストを処理する関数。
+// /api/login でパスワードを確認したユーザの 2 段階認証のコードを確認し、ログインさせる。
+func loginTotp(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*totpParams)
+	if !ok {
+		err = fmt.Errorf("Expected *totpParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	auth, _ := store.Get(r, sessionAuth)
+	user, ok := auth.Values["pendingUser"].(*User)
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	if exp, _ := auth.Values["pendingExpires"].(int64); time.Now().Unix() > exp {
+		log.Printf("TOTP challenge expired. ID: %d", user.Id)
+		return nil, ErrUnauthorized
+	}
+
+	switch err = VerifyTotp(r, user.Id, param.Code); err {
+	case nil:
+	case ErrTotpInvalid:
+		log.Printf("Invalid TOTP code. ID: %d", user.Id)
+		return nil, ErrUnauthorized
+	case ErrTotpLocked:
+		b, err = json.Marshal(NewResponse(err.Error(), nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	default:
+		log.Println(err)
+		return
+	}
+	saveLogin(w, r, user)
+	b, err = json.Marshal(NewResponse(nil, user))
+	if err != nil {
+		return
+	}
+	return
+}
+
+// saveLogin はセッションにログインしたユーザを保存する関数。
+func saveLogin(w http.ResponseWriter, r *http.Request, user *User) {
+	auth, _ := store.Get(r, sessionAuth)
+	delete(auth.Values, "pendingUser")
+	delete(auth.Values, "pendingExpires")
+	auth.Values["user"] = user
+	auth.Values["expires"] = time.Now().Add(time.Duration(auth.Options.MaxAge) * time.Second).Unix()
+	auth.Save(r, w)
+}
+
+// handleGetUsers は /api/displaySettings へのリクエストを処理する関数。
+// セッションの認証情報のユーザの表示設定を返す。
+func getMyDisplaySettings(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	users, err := FindDisplaySettings(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &users))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// handleGetMe は /api/users/me へのリクエストを処理する関数。
+// セッションの認証情報のユーザ情報を返す。
+func getMe(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	u, err := FindUserById(r, user.Id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &u))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// handleSaveDisplay は /api/saveDisplay へのリクエストを処理する関数。
+// ユーザの表示設定を保存する。
+func postMyDisplaySettings(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	params, ok := p.(*[]User)
+	if !ok {
+		err = fmt.Errorf("Expected *[]User, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	err = UpsertDisplaySettings(r, user.Id, *params)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// handleSaveImage は /api/saveImage へのリクエストを処理する関数。
+// ユーザ画像を保存する。
+func putMyImage(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*imageParams)
+	if !ok {
+		err = fmt.Errorf("Expected *saveImageParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	err = SaveImage(r, user.Id, param.decoded)
+	if err != nil {
+		return
+	}
+
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		return
+	}
+	return b, nil
+}
+
+// handleServeImage は /api/users/{id:[0-9]+}/image へのリクエストを処理する関数。
+// ユーザ画像を配信する。クエリパラメタ size (thumb, medium, full) または w (幅) で縮小した画像を配信する。
+// Last-Modified ヘッダに最後の画像の撮影時刻を、X-Mizumanju-Stale ヘッダに画像が無いことを表す画像かどうかを返す。
+func getUserImage(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	width, err := imageWidth(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = CheckVisible(r, user.Id, int32(id)); err != nil {
+		return nil, err
+	}
+
+	img, err := GetImage(r, int32(id), width)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set(staleHeader, strconv.FormatBool(img.Stale))
+	// 画像は随時更新されるので、毎回サーバに確認させる
+	w.Header().Set("Cache-Control", "no-cache")
+	return serveImage(w, r, img)
+}
+
+// getUserImages は /api/users/{id:[0-9]+}/images へのリクエストを処理する関数。
+// クエリパラメタ since, until (UNIX 時間) の間に保存されたユーザ画像の一覧を返す。
+func getUserImages(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+	since, err := queryInt64(r, "since", 0)
+	if err != nil {
+		return
+	}
+	until, err := queryInt64(r, "until", math.MaxInt64)
+	if err != nil {
+		return
+	}
+
+	if err = CheckVisible(r, user.Id, int32(id)); err != nil {
+		return
+	}
+
+	frames, err := FindImageHistory(r, int32(id), since, until)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &frames))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getUserHistoryImage は /api/users/{id:[0-9]+}/images/{ts:[0-9]+} へのリクエストを処理する関数。
+// タイムスタンプが ts のユーザ画像を配信する。
+func getUserHistoryImage(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+	ts, err := strconv.ParseInt(vars["ts"], 10, 64)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if err = CheckVisible(r, user.Id, int32(id)); err != nil {
+		return nil, err
+	}
+
+	img, err := GetHistoryImage(r, int32(id), ts)
+	if err != nil {
+		return nil, err
+	}
+	return serveImage(w, r, img)
+}
+
+// serveImage は img の Content-Type, ETag, Last-Modified ヘッダを設定し、レスポンスボディとして img のデータを返す関数。
+// リクエストの If-None-Match または If-Modified-Since ヘッダの条件に合うときは ErrNotModified を返す。
+func serveImage(w http.ResponseWriter, r *http.Request, img *imgmap.Img) ([]byte, error) {
+	sum := sha1.Sum(img.Data)
+	etag := fmt.Sprintf(`"%x"`, sum)
+	var modified time.Time
+	if img.Timestamp > 0 {
+		modified = time.Unix(img.Timestamp, 0)
+	}
+
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	// 画像が無いことを表す画像は最後の画像と時刻が同じなので、時刻では判定しない
+	since := modified
+	if img.Stale {
+		since = time.Time{}
+	}
+	if notModified(r, etag, since) {
+		return nil, ErrNotModified
+	}
+	w.Header().Set("Content-Type", img.ContentType)
+	return img.Data, nil
+}
+
+// notModified はリクエストの条件付きヘッダから、クライアントが持つ画像が etag, modified の画像と同じか判定する関数。
+// If-None-Match ヘッダがあるときは If-Modified-Since ヘッダは無視する。
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.After(t)
+	}
+	return false
+}
+
+// getUserTimelapse は /api/users/{id:[0-9]+}/timelapse.gif へのリクエストを処理する関数。
+// クエリパラメタ from, to (UNIX 時間) の間に保存されたユーザ画像を fps フレーム/秒のアニメーション GIF にして配信する。
+// from の既定値は今日の 0 時、to の既定値は現在時刻、fps の既定値は 10。
+func getUserTimelapse(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+	now := time.Now()
+	from, err := queryInt64(r, "from", time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix())
+	if err != nil {
+		return nil, err
+	}
+	to, err := queryInt64(r, "to", now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	fps, err := queryInt64(r, "fps", 10)
+	if err != nil {
+		return nil, err
+	}
+	if fps < 1 || fps > 50 {
+		return nil, ErrBadRequest
+	}
+
+	if err = CheckVisible(r, user.Id, int32(id)); err != nil {
+		return nil, err
+	}
+
+	img, err := GetTimelapse(r, int32(id), from, to, int(fps))
+	if err == nil {
+		w.Header().Set("Content-Type", "image/gif")
+	}
+	return img, err
+}
+
+// imageWidth はクエリパラメタ size または w から画像の幅を返す関数。
+// どちらも無いときは縮小しないことを表す 0 を返す。
+func imageWidth(r *http.Request) (int, error) {
+	if size := r.URL.Query().Get("size"); size != "" {
+		width, ok := imageSizes[size]
+		if !ok {
+			log.Printf("Unknown size: %s", size)
+			return 0, ErrBadRequest
+		}
+		return width, nil
+	}
+	cnf, ok := context.Get(r, imgkey).(*ImageConf)
+	if !ok {
+		return 0, errors.New("ImageConf instance not found.")
+	}
+	width, err := queryInt64(r, "w", 0)
+	if err != nil {
+		return 0, err
+	}
+	if width != 0 && (width < minImageWidth || width > int64(cnf.MaxWidth)) {
+		log.Printf("Invalid width: %d", width)
+		return 0, ErrBadRequest
+	}
+	return int(width), nil
+}
+
+// queryInt64 はクエリパラメタ name を int64 として返す関数。
+// パラメタが無いときは def を返す。数値でないときは ErrBadRequest を返す。
+func queryInt64(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Println(err)
+		return 0, ErrBadRequest
+	}
+	return i, nil
+}
+
+// getMyWall は /api/users/me/wall.jpg へのリクエストを処理する関数。
+// セッションの認証情報のユーザの表示設定に従って、非表示でないユーザの最新の画像を並べた画像を配信する。
+func getMyWall(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	users, err := FindDisplaySettings(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	cnf, ok := context.Get(r, imgkey).(*ImageConf)
+	if !ok {
+		return nil, errors.New("ImageConf instance not found.")
+	}
+	tiles := make([]imgmap.Tile, 0, len(users))
+	for _, u := range users {
+		if u.Hide {
+			continue
+		}
+		tiles = append(tiles, imgmap.Tile{Key: u.Id, Label: u.Name, TTL: cnf.imageTTL(u.ImageTTL)})
+	}
+
+	img, err := GetWall(r, tiles)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	return img, nil
+}
+
+// putMyStatus は /api/users/me/status へのリクエストを処理する関数。
+// ユーザステータスを保存する。
+func putMyStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*statusParams)
+	if !ok {
+		err = fmt.Errorf("Expected *statusParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	err = UpdateUserStatus(r, user.Id, UserStatus{
+		Status:    param.Status,
+		Preset:    param.Preset,
+		Emoji:     param.Emoji,
+		ExpiresAt: param.ExpiresAt,
+	})
+	if err != nil {
+		return
+	}
+
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		return
+	}
+	return b, nil
+}
+
+// getUserStatus は /api/users/{id:[0-9]+}/status へのリクエストを処理する関数。
+// ユーザステータスを配信する。同じチームに所属していないユーザのステータスは返さない。
+func getUserStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if err = CheckVisible(r, user.Id, int32(id)); err != nil {
+		return nil, err
+	}
+
+	u, err := FindUserStatusByUserId(r, int32(id))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &u))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getUserStatusHistory は /api/users/{id:[0-9]+}/status/history へのリクエストを処理する関数。
+// クエリパラメタ from, to (UNIX 時間) の間のユーザステータスの変更を返す。
+func getUserStatusHistory(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+	from, err := queryInt64(r, "from", 0)
+	if err != nil {
+		return
+	}
+	to, err := queryInt64(r, "to", time.Now().Unix())
+	if err != nil {
+		return
+	}
+
+	if err = CheckVisible(r, user.Id, int32(id)); err != nil {
+		return
+	}
+
+	ts, err := FindStatusHistory(r, int32(id), time.Unix(from, 0), time.Unix(to, 0))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &ts))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getStatusTimeline は /api/status/timeline へのリクエストを処理する関数。
+// クエリパラメタ date (YYYY-MM-DD、省略時は今日) の 1 日の、同じチームの全ユーザのユーザステータスの変更を返す。
+// 各ユーザの最初の要素は、その日の開始時点のステータスを表すため前日以前のものであることがある。
+func getStatusTimeline(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if d := r.URL.Query().Get("date"); d != "" {
+		from, err = time.ParseInLocation("2006-01-02", d, time.Local)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrBadRequest
+		}
+	}
+
+	ts, err := FindStatusTimeline(r, user.Id, from, from.AddDate(0, 0, 1))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &ts))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getMyWorkingHours は /api/users/me/workingHours へのリクエストを処理する関数。
+// セッションの認証情報のユーザの勤務時間を返す。
+func getMyWorkingHours(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	wh, err := FindWorkingHours(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &wh))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// putMyWorkingHours は /api/users/me/workingHours への PUT リクエストを処理する関数。
+// セッションの認証情報のユーザの勤務時間を更新する。
+func putMyWorkingHours(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*WorkingHours)
+	if !ok {
+		err = fmt.Errorf("Expected *WorkingHours, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	if err = UpdateWorkingHours(r, user.Id, *param); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getMyScheduledStatuses は /api/users/me/scheduledStatuses へのリクエストを処理する関数。
+// セッションの認証情報のユーザの予約したユーザステータスのうち、未適用または終了していないものを返す。
+func getMyScheduledStatuses(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	ss, err := FindScheduledStatuses(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &ss))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// postMyScheduledStatus は /api/users/me/scheduledStatuses への POST リクエストを処理する関数。
+// セッションの認証情報のユーザのユーザステータスを予約する。
+func postMyScheduledStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*scheduledStatusParams)
+	if !ok {
+		err = fmt.Errorf("Expected *scheduledStatusParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	s, err := InsertScheduledStatus(r, ScheduledStatus{
+		UserId:   user.Id,
+		Status:   param.Status,
+		Preset:   param.Preset,
+		Emoji:    param.Emoji,
+		StartsAt: param.StartsAt,
+		EndsAt:   param.EndsAt,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &s))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// deleteMyScheduledStatus は /api/users/me/scheduledStatuses/{id:[0-9]+} への DELETE リクエストを処理する関数。
+// セッションの認証情報のユーザの予約したユーザステータスを削除する。
+func deleteMyScheduledStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if err = DelScheduledStatus(r, user.Id, id); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getMyCalendar は /api/users/me/calendar へのリクエストを処理する関数。
+// セッションの認証情報のユーザのカレンダーの URL とこれから行われる予定を返す。
+func getMyCalendar(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	c, err := FindCalendar(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	cal, err := parseCalendar(c.data)
+	if err != nil {
+		return nil, err
+	}
+	c.Upcoming = upcomingEvents(cal, time.Now())
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &c))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// putMyCalendar は /api/users/me/calendar への PUT リクエストを処理する関数。
+// セッションの認証情報のユーザのカレンダーを登録する。登録したカレンダーの予定の間はステータスを自動で設定する。
+func putMyCalendar(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*calendarParams)
+	if !ok {
+		err = fmt.Errorf("Expected *calendarParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	if err = UpsertCalendar(r, user.Id, param.URL, param.data); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// deleteMyCalendar は /api/users/me/calendar への DELETE リクエストを処理する関数。
+// セッションの認証情報のユーザのカレンダーを削除する。
+func deleteMyCalendar(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	if err = DelCalendar(r, user.Id); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// putMyDnd は /api/users/me/dnd への PUT リクエストを処理する関数。
+// セッションの認証情報のユーザの DND を更新する。DND をやめたときは、DND の間のノックが届く。
+func putMyDnd(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*dndParams)
+	if !ok {
+		err = fmt.Errorf("Expected *dndParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	if err = UpdateDnd(r, user.Id, param.Dnd); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// postKnock は /api/users/{id:[0-9]+}/knock への POST リクエストを処理する関数。
+// ユーザに話しかけたいというリクエストを送る。相手が DND のときは DND をやめるまで届かない。
+func postKnock(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*knockParams)
+	if !ok {
+		err = fmt.Errorf("Expected *knockParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+	if int32(id) == user.Id {
+		return nil, ErrBadRequest
+	}
+
+	if err = CheckVisible(r, user.Id, int32(id)); err != nil {
+		return
+	}
+
+	k, err := InsertKnock(r, user.Id, int32(id), param.Message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &k))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getMyKnocks は /api/users/me/knocks へのリクエストを処理する関数。
+// セッションの認証情報のユーザに届いたノックを返す。
+func getMyKnocks(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	knocks, err := FindReceivedKnocks(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &knocks))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// getMySentKnocks は /api/users/me/knocks/sent へのリクエストを処理する関数。
+// セッションの認証情報のユーザが送ったノックを返す。受け入れられたノックには相手のボイスチャット ID を含める。
+func getMySentKnocks(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	knocks, err := FindSentKnocks(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &knocks))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// putKnock は /api/knocks/{id:[0-9]+} への PUT リクエストを処理する関数。
+// セッションの認証情報のユーザに届いたノックを受け入れる、または後回しにする。
+func putKnock(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*knockAnswerParams)
+	if !ok {
+		err = fmt.Errorf("Expected *knockAnswerParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if err = AnswerKnock(r, user.Id, id, param.State); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getTeams は /api/teams へのリクエストを処理する関数。
+// 管理者には全てのチームを、それ以外のユーザには所属しているチームを返す。
+func getTeams(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	var (
+		teams []Team
+		err   error
+	)
+	if user.Role == admin {
+		teams, err = FindTeams(r)
+	} else {
+		teams, err = FindTeamsByUserId(r, user.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &teams))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// postTeam は /api/teams への POST リクエストを処理する関数。
+// チームを登録する。
+func postTeam(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*Team)
+	if !ok {
+		err = fmt.Errorf("Expected *Team, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	t, err := InsertTeam(r, *param)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &t))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// putTeam は /api/teams/{id:[0-9]+} への PUT リクエストを処理する関数。
+// チームを更新する。
+func putTeam(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*Team)
+	if !ok {
+		err = fmt.Errorf("Expected *Team, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	t, err := FindTeam(r, param.Id)
+	if err != nil {
+		return
+	}
+	t.Name = param.Name
+	if err = UpdateTeam(r, t); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &t))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// deleteTeam は /api/teams/{id:[0-9]+} への DELETE リクエストを処理する関数。
+// チームを削除する。所属していたユーザは削除しない。
+func deleteTeam(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if err = DelTeam(r, int32(id)); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getTeamMembers は /api/teams/{id:[0-9]+}/members へのリクエストを処理する関数。
+// チームに所属しているユーザを返す。管理者以外は所属しているチームのみ取得できる。
+func getTeamMembers(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if user.Role != admin {
+		if err = CheckTeamMember(r, int32(id), user.Id); err != nil {
+			return
+		}
+	} else if _, err = FindTeam(r, int32(id)); err != nil {
+		return
+	}
+
+	users, err := FindTeamMembers(r, int32(id))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &users))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// putTeamMember は /api/teams/{id:[0-9]+}/members/{userId:[0-9]+} への PUT リクエストを処理する関数。
+// ユーザをチームに所属させる。
+func putTeamMember(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	return changeTeamMemberAction(r, InsertTeamMember)
+}
+
+// deleteTeamMember は /api/teams/{id:[0-9]+}/members/{userId:[0-9]+} への DELETE リクエストを処理する関数。
+// ユーザをチームから外す。
+func deleteTeamMember(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	return changeTeamMemberAction(r, DelTeamMember)
+}
+
+// changeTeamMemberAction はパスのチームとユーザに change を適用する関数。
+// チームが無いときは ErrNotFound を返す。
+func changeTeamMemberAction(r *http.Request, change func(*http.Request, int32, int32) error) (b []byte, err error) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+	userId, err := strconv.ParseInt(vars["userId"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if _, err = FindTeam(r, int32(id)); err != nil {
+		return
+	}
+	if err = change(r, int32(id), int32(userId)); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// getMyTokens は /api/users/me/tokens へのリクエストを処理する関数。
+// セッションの認証情報のユーザが発行した API トークンを返す。トークン自体は返さない。
+func getMyTokens(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	tokens, err := FindAPITokens(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &tokens))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// postMyToken は /api/users/me/tokens への POST リクエストを処理する関数。
+// セッションの認証情報のユーザの API トークンを発行する。トークンはこのレスポンスでのみ返す。
+func postMyToken(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
+	}
+
+	param, ok := p.(*tokenParams)
+	if !ok {
+		err = fmt.Errorf("Expected *tokenParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	t, err := InsertAPIToken(r, user.Id, APIToken{Name: param.Name, Scopes: param.Scopes, ExpiresAt: param.ExpiresAt})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &t))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// deleteMyToken は /api/users/me/tokens/{id:[0-9]+} への DELETE リクエストを処理する関数。
+// セッションの認証情報のユーザが発行した API トークンを無効にする。
+func deleteMyToken(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		err = errors.New("Server Error")
 		log.Println(err)
 		return
 	}
 
-	user, err := Authenticate(r, param.Username, param.Password)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+
+	if err = DelAPIToken(r, user.Id, id); err != nil {
+		log.Println(err)
 		return
 	}
-	auth, _ := store.Get(r, sessionAuth)
-	auth.Values["user"] = user
-	auth.Save(r, w)
-	b, err = json.Marshal(NewResponse(nil, &user))
+	b, err = json.Marshal(NewResponse("OK", nil))
 	if err != nil {
+		log.Println(err)
 		return
 	}
 	return
 }
 
-// handleGetUsers は /api/displaySettings へのリクエストを処理する関数。
-// セッションの認証情報のユーザの表示設定を返す。
-func getMyDisplaySettings(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+// getMyTotp は /api/users/me/totp へのリクエストを処理する関数。
+// セッションの認証情報のユーザの 2 段階認証の状態を返す。
+func getMyTotp(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
 	user, ok := context.Get(r, userkey).(*User)
 	if !ok {
-		return nil, errors.New("Server Error")
+		err = errors.New("Server Error")
+		log.Println(err)
+		return
 	}
 
-	users, err := FindDisplaySettings(r, user.Id)
+	ts, err := findMyTotpStatus(r, user)
 	if err != nil {
-		return nil, err
+		log.Println(err)
+		return
 	}
-
-	var js []byte
-	js, err = json.Marshal(NewResponse(nil, &users))
+	b, err = json.Marshal(NewResponse(nil, &ts))
 	if err != nil {
-		return nil, err
+		log.Println(err)
+		return
 	}
-	return js, nil
+	return
 }
 
-// handleGetMe は /api/users/me へのリクエストを処理する関数。
-// セッションの認証情報のユーザ情報を返す。
-func getMe(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+// findMyTotpStatus は user の 2 段階認証の状態を、管理者に必須であるかを含めて取得する関数。
+func findMyTotpStatus(r *http.Request, user *User) (ts TotpStatus, err error) {
+	if ts, err = FindTotpStatus(r, user.Id); err != nil {
+		return
+	}
+	if user.Role == admin {
+		var settings SecuritySettings
+		if settings, err = FindSecuritySettings(r); err != nil {
+			return
+		}
+		ts.Required = settings.RequireAdminTotp
+	}
+	return
+}
+
+// postMyTotp は /api/users/me/totp への POST リクエストを処理する関数。
+// セッションの認証情報のユーザの 2 段階認証の秘密鍵を生成し、otpauth URI を返す。
+// /api/users/me/totp/confirm でコードを確認するまで 2 段階認証は有効にならない。
+func postMyTotp(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
 	user, ok := context.Get(r, userkey).(*User)
 	if !ok {
 		err = errors.New("Server Error")
 		log.Println(err)
 		return
 	}
+	scnf, ok := context.Get(r, systemkey).(*SystemConf)
+	if !ok {
+		err = errors.New("SystemConf instance not found.")
+		log.Println(err)
+		return
+	}
 
-	u, err := FindUserById(r, user.Id)
+	ts, err := FindTotpStatus(r, user.Id)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	b, err = json.Marshal(NewResponse(nil, &u))
+	if ts.Enabled {
+		b, err = json.Marshal(NewResponse("Two-factor authentication is already enabled.", nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+
+	secret, err := EnrollTotp(r, user.Id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &totpEnrollment{Secret: secret, URI: totp.URI(scnf.Name, user.AuthId, secret)}))
 	if err != nil {
 		log.Println(err)
 		return
@@ -83,9 +1365,9 @@ func getMe(w http.ResponseWriter, r *http.Request, p params) (b []byte, err erro
 	return
 }
 
-// handleSaveDisplay は /api/saveDisplay へのリクエストを処理する関数。
-// ユーザの表示設定を保存する。
-func postMyDisplaySettings(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+// postMyTotpConfirm は /api/users/me/totp/confirm への POST リクエストを処理する関数。
+// 認証アプリのコードを確認して 2 段階認証を有効にし、リカバリコードを返す。
+func postMyTotpConfirm(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
 	user, ok := context.Get(r, userkey).(*User)
 	if !ok {
 		err = errors.New("Server Error")
@@ -93,19 +1375,29 @@ func postMyDisplaySettings(w http.ResponseWriter, r *http.Request, p params) (b
 		return
 	}
 
-	params, ok := p.(*[]User)
+	param, ok := p.(*totpParams)
 	if !ok {
-		err = fmt.Errorf("Expected *[]User, but actual is %T", p)
+		err = fmt.Errorf("Expected *totpParams, but actual is %T", p)
 		log.Println(err)
 		return
 	}
 
-	err = UpsertDisplaySettings(r, user.Id, *params)
-	if err != nil {
+	codes, err := ConfirmTotp(r, user.Id, param.Code)
+	if err == ErrTotpInvalid {
+		b, err = json.Marshal(NewResponse(map[string][]string{"code": {ErrTotpInvalid.Error()}}, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	} else if err != nil {
 		log.Println(err)
 		return
 	}
-	b, err = json.Marshal(NewResponse("OK", nil))
+
+	// 管理者の機能を使えるようにする
+	saveLogin(w, r, user)
+	b, err = json.Marshal(NewResponse(nil, &codes))
 	if err != nil {
 		log.Println(err)
 		return
@@ -113,9 +1405,10 @@ func postMyDisplaySettings(w http.ResponseWriter, r *http.Request, p params) (b
 	return
 }
 
-// handleSaveImage は /api/saveImage へのリクエストを処理する関数。
-// ユーザ画像を保存する。
-func putMyImage(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+// deleteMyTotp は /api/users/me/totp への DELETE リクエストを処理する関数。
+// 認証アプリのコードまたはリカバリコードを確認し、2 段階認証を無効にする。
+// 管理者に 2 段階認証が必須のときは、管理者は無効にできない。
+func deleteMyTotp(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
 	user, ok := context.Get(r, userkey).(*User)
 	if !ok {
 		err = errors.New("Server Error")
@@ -123,89 +1416,278 @@ func putMyImage(w http.ResponseWriter, r *http.Request, p params) (b []byte, err
 		return
 	}
 
-	param, ok := p.(*imageParams)
+	param, ok := p.(*totpParams)
 	if !ok {
-		err = fmt.Errorf("Expected *saveImageParams, but actual is %T", p)
+		err = fmt.Errorf("Expected *totpParams, but actual is %T", p)
 		log.Println(err)
 		return
 	}
 
-	err = SaveImage(r, user.Id, param.Image)
+	ts, err := findMyTotpStatus(r, user)
 	if err != nil {
+		log.Println(err)
+		return
+	}
+	if ts.Required {
+		b, err = json.Marshal(NewResponse("Two-factor authentication is required for administrators.", nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+
+	switch err = VerifyTotp(r, user.Id, param.Code); err {
+	case nil:
+	case ErrTotpInvalid:
+		b, err = json.Marshal(NewResponse(map[string][]string{"code": {ErrTotpInvalid.Error()}}, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	case ErrTotpLocked:
+		b, err = json.Marshal(NewResponse(err.Error(), nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	default:
+		log.Println(err)
 		return
 	}
 
+	if err = DisableTotp(r, user.Id); err != nil {
+		log.Println(err)
+		return
+	}
 	b, err = json.Marshal(NewResponse("OK", nil))
 	if err != nil {
+		log.Println(err)
 		return
 	}
-	return b, nil
+	return
 }
 
-// handleServeImage は /api/users/{id:[0-9]+}/image へのリクエストを処理する関数。
-// ユーザ画像を配信する。
-func getUserImage(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+// getSecuritySettings は /api/settings/security へのリクエストを処理する関数。
+// セキュリティに関するシステムの設定を返す。
+func getSecuritySettings(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	settings, err := FindSecuritySettings(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, &settings))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
 
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 32)
+// putSecuritySettings は /api/settings/security への PUT リクエストを処理する関数。
+// セキュリティに関するシステムの設定を更新する。
+// 管理者に 2 段階認証を必須にしたときは、2 段階認証を有効にしていない管理者は次回のログインから管理者の機能を使えなくなる。
+func putSecuritySettings(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*SecuritySettings)
+	if !ok {
+		err = fmt.Errorf("Expected *SecuritySettings, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	if err = UpdateSecuritySettings(r, *param); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, param))
 	if err != nil {
 		log.Println(err)
-		return nil, ErrBadRequest
+		return
 	}
+	return
+}
 
-	img, err := GetImage(r, int32(id))
-	if err == nil {
-		w.Header().Set("Content-Type", "image/png")
+// getVoiceChatProviders は /api/voiceChatProviders へのリクエストを処理する関数。
+// ボイスチャットのプロバイダの一覧を返す。
+func getVoiceChatProviders(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	providers, err := FindVoiceChatProviders(r)
+	if err != nil {
+		return nil, err
 	}
-	return img, err
+
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &providers))
+	if err != nil {
+		return nil, err
+	}
+	return js, nil
 }
 
-// putMyStatus は /api/users/me/status へのリクエストを処理する関数。
-// ユーザステータスを保存する。
-func putMyStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
-	user, ok := context.Get(r, userkey).(*User)
+// postVoiceChatProvider は /api/voiceChatProviders への POST リクエストを処理する関数。
+// 自前で運用しているボイスチャットなどのプロバイダを登録する。
+func postVoiceChatProvider(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*VoiceChatProvider)
 	if !ok {
-		err = errors.New("Server Error")
+		err = fmt.Errorf("Expected *VoiceChatProvider, but actual is %T", p)
 		log.Println(err)
 		return
 	}
 
-	param, ok := p.(*statusParams)
+	_, err = FindVoiceChatProvider(r, param.Key)
+	switch {
+	case err == nil:
+		b, err = json.Marshal(NewResponse(map[string][]string{"key": {"Key already exists."}}, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	case err != ErrNotFound:
+		log.Println(err)
+		return
+	}
+
+	if err = InsertVoiceChatProvider(r, *param); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, param))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// putVoiceChatProvider は /api/voiceChatProviders/{key} への PUT リクエストを処理する関数。
+// 管理者が登録したプロバイダを更新する。
+func putVoiceChatProvider(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*VoiceChatProvider)
 	if !ok {
-		err = fmt.Errorf("Expected *statusParams, but actual is %T", p)
+		err = fmt.Errorf("Expected *VoiceChatProvider, but actual is %T", p)
 		log.Println(err)
 		return
 	}
 
-	err = UpdateUserStatus(r, user.Id, param.Status)
+	if _, err = FindVoiceChatProvider(r, param.Key); err != nil {
+		return
+	}
+	if err = UpdateVoiceChatProvider(r, *param); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, param))
 	if err != nil {
+		log.Println(err)
 		return
 	}
+	return
+}
 
+// deleteVoiceChatProvider は /api/voiceChatProviders/{key} への DELETE リクエストを処理する関数。
+// 管理者が登録したプロバイダを削除する。組み込みのプロバイダは削除できない。
+func deleteVoiceChatProvider(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	err = DelVoiceChatProvider(r, mux.Vars(r)["key"])
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	b, err = json.Marshal(NewResponse("OK", nil))
 	if err != nil {
+		log.Println(err)
 		return
 	}
-	return b, nil
+	return
 }
 
-// getUserStatus は /api/users/{id:[0-9]+}/status へのリクエストを処理する関数。
-// ユーザステータスを配信する。
-func getUserStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+// getStatusPresets は /api/statusPresets へのリクエストを処理する関数。
+// ステータスプリセットの一覧を返す。
+func getStatusPresets(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	presets, err := FindStatusPresets(r)
+	if err != nil {
+		return nil, err
+	}
 
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	var js []byte
+	js, err = json.Marshal(NewResponse(nil, &presets))
 	if err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// postStatusPreset は /api/statusPresets への POST リクエストを処理する関数。
+// ステータスプリセットを登録する。
+func postStatusPreset(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*StatusPreset)
+	if !ok {
+		err = fmt.Errorf("Expected *StatusPreset, but actual is %T", p)
 		log.Println(err)
-		return nil, ErrBadRequest
+		return
 	}
 
-	u, err := FindUserStatusByUserId(r, int32(id))
+	_, err = FindStatusPreset(r, param.Key)
+	switch {
+	case err == nil:
+		b, err = json.Marshal(NewResponse(map[string][]string{"key": {"Key already exists."}}, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	case err != ErrNotFound:
+		log.Println(err)
+		return
+	}
+
+	if err = InsertStatusPreset(r, *param); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, param))
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	b, err = json.Marshal(NewResponse(nil, &u))
+	return
+}
+
+// putStatusPreset は /api/statusPresets/{key} への PUT リクエストを処理する関数。
+// ステータスプリセットを更新する。
+func putStatusPreset(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	param, ok := p.(*StatusPreset)
+	if !ok {
+		err = fmt.Errorf("Expected *StatusPreset, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	if _, err = FindStatusPreset(r, param.Key); err != nil {
+		return
+	}
+	if err = UpdateStatusPreset(r, *param); err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse(nil, param))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// deleteStatusPreset は /api/statusPresets/{key} への DELETE リクエストを処理する関数。
+// ステータスプリセットを削除する。
+func deleteStatusPreset(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	err = DelStatusPreset(r, mux.Vars(r)["key"])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	b, err = json.Marshal(NewResponse("OK", nil))
 	if err != nil {
 		log.Println(err)
 		return
@@ -287,6 +1769,16 @@ func postUser(w http.ResponseWriter, r *http.Request, p params) (b []byte, err e
 		if u.Role == editor {
 			param.Role = editor
 		}
+		// プライバシー設定は本人のみ変更可能
+		if param.Id != u.Id {
+			var cur User
+			cur, err = FindUserById(r, param.Id)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			param.Privacy = cur.Privacy
+		}
 		user, err = UpdateUser(r, *param)
 		if err != nil {
 			log.Println(err)
@@ -319,8 +1811,16 @@ func recovery(w http.ResponseWriter, r *http.Request, p params) (b []byte, err e
 	}
 
 	vars := mux.Vars(r)
-	err = UpdatePasswordByRecoveryKey(r, vars["key"], param.Password)
-	if err != nil {
+	switch err = UpdatePasswordByRecoveryKey(r, vars["key"], param.Password); err {
+	case nil:
+	case ErrDirectoryUser:
+		b, err = json.Marshal(NewResponse(err.Error(), nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	default:
 		return
 	}
 
@@ -341,8 +1841,16 @@ func requestRecovery(w http.ResponseWriter, r *http.Request, p params) (b []byte
 		return
 	}
 
-	err = CreateRecovery(r, param.Email)
-	if err != nil {
+	switch err = CreateRecovery(r, param.Email); err {
+	case nil:
+	case ErrDirectoryUser:
+		b, err = json.Marshal(NewResponse(err.Error(), nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	default:
 		return
 	}
 
@@ -368,8 +1876,16 @@ func putMyPassword(w http.ResponseWriter, r *http.Request, p params) (b []byte,
 		return
 	}
 
-	err = UpdatePasswordByAuthId(r, u.AuthId, param.CurrentPassword, param.NewPassword)
-	if err != nil {
+	switch err = UpdatePasswordByAuthId(r, u.AuthId, param.CurrentPassword, param.NewPassword); err {
+	case nil:
+	case ErrDirectoryUser:
+		b, err = json.Marshal(NewResponse(err.Error(), nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	default:
 		return
 	}
 
@@ -0,0 +1,315 @@
+package mizumanju
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/marcie001/mizumanju/ical"
+)
+
+const (
+	// カレンダーの予定の間に設定するステータスのプリセット
+	calendarPreset = "meeting"
+	// カレンダーの予定の間に設定するステータス
+	calendarStatus = "In a meeting"
+	// カレンダーを同期する間隔
+	calendarSyncInterval = time.Minute
+	// カレンダーを読み込むときの待ち時間
+	calendarFetchTimeout = 30 * time.Second
+	// カレンダーを読み込むときにたどるリダイレクトの最大数
+	calendarMaxRedirects = 5
+	// GET /api/users/me/calendar で返す予定の期間
+	calendarUpcoming = 24 * time.Hour
+)
+
+// カレンダーを読み込む HTTP クライアント
+var calendarClient *http.Client
+
+// ErrCalendarFetch はカレンダーを読み込めなかったことを表すエラー。
+// 読み込めなかった理由やレスポンスの内容をユーザに返さないよう、詳細はログに出力する
+var ErrCalendarFetch = errors.New("Could not load calendar.")
+
+// newCalendarClient はカレンダーを読み込む HTTP クライアントを生成する関数。
+// サーバから内部のネットワークにリクエストさせないよう、cnf.AllowPrivate が true でなければ公開されていないアドレスには接続しない。
+// リダイレクト先もその都度確認する。
+// cnf.AllowFile が true のときは file:// の URL も読み込める。
+func newCalendarClient(cnf *CalendarConf) *http.Client {
+	dialer := &net.Dialer{Timeout: calendarFetchTimeout}
+	if !cnf.AllowPrivate {
+		dialer.Control = checkCalendarAddr
+	}
+	t := &http.Transport{DialContext: dialer.DialContext}
+	if cnf.AllowFile {
+		t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	}
+	return &http.Client{
+		Transport: t,
+		Timeout:   calendarFetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= calendarMaxRedirects {
+				return errors.New("Too many redirects.")
+			}
+			// file:// へのリダイレクトは許さない
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("Unsupported redirect URL scheme: %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// checkCalendarAddr は接続先のアドレスが公開されているアドレスか確認する関数。
+// 名前解決した後のアドレスを確認するため、DNS の応答を変えて内部のアドレスに接続させることもできない。
+func checkCalendarAddr(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("Calendar address is not public: %s", host)
+	}
+	return nil
+}
+
+// publicIP は ip がインターネット上の公開されているアドレスのとき true を返す関数。
+// ループバック、プライベート、リンクローカル (169.254.169.254 など)、CGNAT のアドレスは含めない。
+func publicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// nonPublicNets は IsGlobalUnicast と IsPrivate で判定できない公開されていないアドレスの範囲
+var nonPublicNets = func() []*net.IPNet {
+	cidrs := []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"}
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(c)
+	}
+	return nets
+}()
+
+// checkCalendarURL は u が読み込めるカレンダーの URL か確認する関数。
+func checkCalendarURL(cnf *CalendarConf, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		return nil
+	case "file":
+		if cnf.AllowFile {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported URL scheme: %s", parsed.Scheme)
+}
+
+// fetchCalendar は u からカレンダーを読み込む関数。
+func fetchCalendar(cnf *CalendarConf, u string) ([]byte, error) {
+	if err := checkCalendarURL(cnf, u); err != nil {
+		return nil, err
+	}
+	res, err := calendarClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch calendar: %s", res.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(cnf.MaxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > cnf.MaxBytes {
+		return nil, errors.New("Calendar is too large.")
+	}
+	return b, nil
+}
+
+// parseCalendar はカレンダーのデータを読み込む関数。
+func parseCalendar(data []byte) (*ical.Calendar, error) {
+	return ical.Parse(bytes.NewReader(data))
+}
+
+// busy は予定がある時間として扱う予定のとき true を返す関数。
+// 終日の予定と空き時間として扱う予定は含めない。
+func busy(o ical.Occurrence) bool {
+	return !o.Event.AllDay && !o.Event.Transparent
+}
+
+// upcomingEvents は cal の now から calendarUpcoming の間の予定を返す関数。
+func upcomingEvents(cal *ical.Calendar, now time.Time) []CalendarEvent {
+	events := make([]CalendarEvent, 0, 8)
+	for _, o := range cal.Between(now, now.Add(calendarUpcoming)) {
+		if busy(o) {
+			events = append(events, CalendarEvent{Summary: o.Event.Summary, Start: o.Start, End: o.End})
+		}
+	}
+	return events
+}
+
+// SweepCalendars は interval ごとにカレンダーを同期する関数。
+// 戻らないので goroutine で実行する。
+func SweepCalendars(db *sql.DB, cnf *CalendarConf, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := SyncCalendars(db, cnf, now); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// SyncCalendars は全ユーザのカレンダーを同期する関数。
+// 1 人のカレンダーを同期できなくても、他のユーザのカレンダーは同期する。
+func SyncCalendars(db *sql.DB, cnf *CalendarConf, now time.Time) error {
+	rows, err := db.Query(sqlFindCalendarsToSync)
+	if err != nil {
+		return err
+	}
+	cals := make([]UserCalendar, 0, 16)
+	for rows.Next() {
+		var c UserCalendar
+		if err = rows.Scan(&c.UserId, &c.URL, &c.data, &c.Fetched, &c.applied); err != nil {
+			rows.Close()
+			return err
+		}
+		cals = append(cals, c)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	for i := range cals {
+		if err := syncCalendar(db, cnf, &cals[i], now); err != nil {
+			log.Printf("Failed to sync calendar. ID: %d, %v", cals[i].UserId, err)
+		}
+	}
+	return nil
+}
+
+// syncCalendar はカレンダーを同期する関数。
+// URL のカレンダーは cnf.Refresh ごとに読み込み直す。
+// 予定が行われているときは、その予定が終わるまでのユーザステータスを設定する。
+// ただし、ユーザが他のステータスを設定しているときと、同じ予定で一度設定したときは設定しない。
+func syncCalendar(db *sql.DB, cnf *CalendarConf, c *UserCalendar, now time.Time) error {
+	if c.URL != "" && (c.Fetched == nil || now.Sub(*c.Fetched) >= cnf.Refresh) {
+		data, err := fetchCalendar(cnf, c.URL)
+		if err != nil {
+			// 失敗しても読み込み直す間隔を空け、前回のデータで同期する
+			log.Printf("Failed to fetch calendar. ID: %d, %v", c.UserId, err)
+			_, err = db.Exec(sqlUpdateCalendarData, c.data, now, c.UserId)
+		} else {
+			c.data = data
+			_, err = db.Exec(sqlUpdateCalendarData, c.data, now, c.UserId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	cal, err := parseCalendar(c.data)
+	if err != nil {
+		return err
+	}
+	var current *ical.Occurrence
+	for _, o := range cal.Between(now, now) {
+		if busy(o) {
+			current = &o
+			break
+		}
+	}
+	if current == nil {
+		// 予定が終わったときは有効期限でステータスが戻る
+		return nil
+	}
+	key := current.Event.UID + "@" + strconv.FormatInt(current.Start.Unix(), 10)
+	if key == c.applied {
+		return nil
+	}
+
+	var (
+		status, preset string
+		expires        *time.Time
+	)
+	err = db.QueryRow(sqlFindCurrentStatus, c.UserId).Scan(&status, &preset, &expires)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case expires != nil && !expires.After(now):
+	case status != "" && preset != calendarPreset:
+		// ユーザが設定したステータスを上書きしない
+		return nil
+	}
+
+	s := UserStatus{
+		Status:    calendarStatus,
+		Preset:    calendarPreset,
+		ExpiresAt: &current.End,
+	}
+	if current.Event.Summary != "" {
+		s.Status += ": " + current.Event.Summary
+	}
+	if st := []rune(s.Status); len(st) > maxStatusLength {
+		// 長い予定の名前は user_status.status に収まるよう切り詰める
+		s.Status = string(st[:maxStatusLength])
+	}
+	if p, err := findStatusPreset(db, calendarPreset); err == nil {
+		s.Emoji = p.Emoji
+	} else if err != ErrNotFound {
+		return err
+	}
+	if err = updateUserStatus(db, c.UserId, s, now); err != nil {
+		return err
+	}
+	_, err = db.Exec(sqlUpdateCalendarApplied, key, c.UserId)
+	return err
+}
+
+// readCalendar は URL またはアップロードしたデータのカレンダーを読み込んで確認する関数。
+// 読み込んだデータを返す。URL のカレンダーを読み込めなかったときは、理由によらず ErrCalendarFetch を返す。
+func readCalendar(cnf *CalendarConf, u string, ics string) ([]byte, error) {
+	var data []byte
+	if u != "" {
+		var err error
+		if data, err = fetchCalendar(cnf, u); err != nil {
+			log.Printf("Failed to fetch calendar. URL: %s, %v", u, err)
+			return nil, ErrCalendarFetch
+		}
+		if _, err = parseCalendar(data); err != nil {
+			log.Printf("Failed to parse calendar. URL: %s, %v", u, err)
+			return nil, ErrCalendarFetch
+		}
+		return data, nil
+	}
+	data = []byte(ics)
+	if len(data) > cnf.MaxBytes {
+		return nil, errors.New("Calendar is too large.")
+	}
+	if _, err := parseCalendar(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,110 @@
+package mizumanju
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testCalendar = "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Standup\r\nDTSTART:20261016T090000Z\r\nDTEND:20261016T091500Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// withCalendarClient は cnf のクライアントでカレンダーを読み込むようにし、元に戻す関数を返す。
+func withCalendarClient(cnf *CalendarConf) func() {
+	orig := calendarClient
+	calendarClient = newCalendarClient(cnf)
+	return func() { calendarClient = orig }
+}
+
+func TestReadCalendarURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cal.ics":
+			fmt.Fprint(w, testCalendar)
+		case "/secret":
+			fmt.Fprint(w, "root:x:0:0:root:/root:/bin/bash\n")
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	t.Run("private address is rejected", func(t *testing.T) {
+		cnf := &CalendarConf{MaxBytes: 1024}
+		defer withCalendarClient(cnf)()
+		if _, err := readCalendar(cnf, srv.URL+"/cal.ics", ""); err != ErrCalendarFetch {
+			t.Fatalf("err = %v, want ErrCalendarFetch", err)
+		}
+	})
+
+	cnf := &CalendarConf{MaxBytes: 1024, AllowPrivate: true}
+	defer withCalendarClient(cnf)()
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"/cal.ics", false},
+		{"/secret", true},
+		{"/missing", true},
+		{"/file", true},
+	}
+	for _, tt := range tests {
+		data, err := readCalendar(cnf, srv.URL+tt.path, "")
+		if tt.wantErr {
+			// 理由とレスポンスの内容を返さない
+			if err != ErrCalendarFetch {
+				t.Errorf("%s: err = %v, want ErrCalendarFetch", tt.path, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.path, err)
+		} else if string(data) != testCalendar {
+			t.Errorf("%s: data = %q", tt.path, data)
+		}
+	}
+}
+
+func TestReadCalendarIcs(t *testing.T) {
+	cnf := &CalendarConf{MaxBytes: 1024}
+	if _, err := readCalendar(cnf, "", testCalendar); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := readCalendar(cnf, "", "BEGIN:VCALENDAR\r\nsecret line\r\n")
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("err = %v, want an error without the line", err)
+	}
+	if _, err := readCalendar(cnf, "", strings.Repeat("X", 2048)); err == nil {
+		t.Fatal("expected an error for a too large calendar")
+	}
+}
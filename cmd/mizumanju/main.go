@@ -8,6 +8,8 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/marcie001/mizumanju"
@@ -28,6 +30,50 @@ func main() {
 	n := flag.String("n", "mizumanju", "System name.")
 	u := flag.String("u", "http://example.com/", "Base URL.")
 	m := flag.String("m", "foo@example.com", "Mail adress of system.")
+	t := flag.Int("t", 1, "Team ID to add users created by administrators to when no team is given. 1 is the Everyone team created by the migration. 0 means no team.")
+	is := flag.String("is", "memory", "Image store. memory, disk or mysql. Use disk or mysql to share images between servers.")
+	id := flag.String("id", "/var/lib/mizumanju/images", "Image directory for the disk image store.")
+	ic := flag.Int("ic", 360, "Max number of past images kept per user. 0 means unlimited.")
+	ia := flag.Duration("ia", 24*time.Hour, "Max age of past images. 0 means unlimited.")
+	ifm := flag.String("if", "png", "Image format to store uploaded images. png or jpeg.")
+	ib := flag.Int("ib", 2*1024*1024, "Max bytes of an uploaded image.")
+	iw := flag.Int("iw", 4096, "Max width of an uploaded image.")
+	ih := flag.Int("ih", 4096, "Max height of an uploaded image.")
+	wf := flag.String("wf", "", "TrueType/OpenType font file to draw names on the wall image. Only ASCII characters are drawn if empty.")
+	ws := flag.Float64("ws", 14, "Font size to draw names on the wall image.")
+	mt := flag.Float64("mt", 0.02, "Motion threshold. A difference (0 to 1) between consecutive images at or above this value is treated as motion.")
+	mi := flag.Duration("mi", 5*time.Minute, "Presence becomes idle after no motion for this duration.")
+	ma := flag.Duration("ma", 15*time.Minute, "Presence becomes away after no motion or no image for this duration.")
+	it := flag.Duration("it", 30*time.Second, "Default image TTL. Users can override it with their upload interval.")
+	cf := flag.Bool("cf", false, "Allow file:// calendar URLs. Server files become readable, so use this for testing only.")
+	cp := flag.Bool("cp", false, "Allow calendar URLs on loopback, private and link-local addresses. Users can make the server send requests to the internal network, so enable this only if all users are trusted.")
+	cr := flag.Duration("cr", 15*time.Minute, "Interval to refetch calendar URLs.")
+	cb := flag.Int("cb", 1024*1024, "Max bytes of a calendar.")
+	oi := flag.String("oi", "", "OpenID Connect issuer URL. OpenID Connect login is disabled if empty.")
+	oc := flag.String("oc", "", "OpenID Connect client ID.")
+	os := flag.String("os", "", "OpenID Connect client secret.")
+	or := flag.String("or", "", "OpenID Connect redirect URL. Defaults to api/auth/oidc/callback under the base URL.")
+	om := flag.String("om", "sub", "ID token claim to map onto users. sub or email.")
+	ol := flag.Bool("ol", false, "With the sub claim, link a user with the same verified email on first OpenID Connect login. Administrators are never linked.")
+	op := flag.Bool("op", false, "Create a user on first OpenID Connect login if no user matches.")
+	od := flag.String("od", "editor", "Role of users created on OpenID Connect login. admin or editor.")
+	ot := flag.Int("ot", 0, "Team ID to add users created on OpenID Connect login to. 0 means no team.")
+	lu := flag.String("lu", "", "LDAP server URL. ldap:// or ldaps://. LDAP authentication is disabled if empty.")
+	lt := flag.Bool("lt", false, "Use StartTLS for the LDAP server.")
+	lb := flag.String("lb", "", "DN to bind as to search and sync users.")
+	lw := flag.String("lw", "", "Password of the bind DN.")
+	ld := flag.String("ld", "", "User DN template, e.g. uid={username},ou=people,dc=example,dc=com. Users are searched with the user filter if empty.")
+	lr := flag.String("lr", "", "Base DN to search and sync users.")
+	lf := flag.String("lf", "(uid={username})", "Filter to search users. {username} is replaced with the login ID, or * when syncing. Use (sAMAccountName={username}) for Active Directory.")
+	la := flag.String("la", "uid", "LDAP attribute of the login ID.")
+	ln := flag.String("ln", "cn", "LDAP attribute of the user name.")
+	lm := flag.String("lm", "mail", "LDAP attribute of the mail address.")
+	lg := flag.String("lg", "memberOf", "LDAP attribute of the group DNs the user belongs to.")
+	lga := flag.String("lga", "", "Semicolon separated group DNs mapped to the admin role.")
+	lge := flag.String("lge", "", "Semicolon separated group DNs mapped to the editor role. If both group options are empty, every LDAP user is an editor.")
+	ls := flag.Duration("ls", 0, "Interval to sync users with the LDAP server. 0 means no sync.")
+	lte := flag.Int("lte", 0, "Team ID to add users created from LDAP to. 0 means no team.")
+	lo := flag.Bool("lo", false, "Adopt local users with the same login ID as LDAP users. Their roles follow the LDAP groups and their local passwords stop working.")
 	pp := flag.Bool("pp", false, "Start debug server. See http://golang.org/pkg/net/http/pprof/")
 	flag.Parse()
 
@@ -37,5 +83,71 @@ func main() {
 		}()
 	}
 
-	mizumanju.Start(*h, int32(*p), *d, *sh, *sp, *ss, *su, *sw, *n, *u, *m)
+	imgConf := &mizumanju.ImageConf{
+		Store:           *is,
+		Dir:             *id,
+		RetentionCount:  *ic,
+		RetentionAge:    *ia,
+		Format:          *ifm,
+		MaxBytes:        *ib,
+		MaxWidth:        *iw,
+		MaxHeight:       *ih,
+		FontFile:        *wf,
+		FontSize:        *ws,
+		MotionThreshold: *mt,
+		IdleAfter:       *mi,
+		AwayAfter:       *ma,
+		TTL:             *it,
+	}
+
+	calConf := &mizumanju.CalendarConf{
+		AllowFile:    *cf,
+		AllowPrivate: *cp,
+		Refresh:      *cr,
+		MaxBytes:     *cb,
+	}
+
+	oidcConf := &mizumanju.OIDCConf{
+		Issuer:       *oi,
+		ClientID:     *oc,
+		ClientSecret: *os,
+		RedirectURL:  *or,
+		Claim:        *om,
+		LinkEmail:    *ol,
+		Provision:    *op,
+		DefaultRole:  *od,
+		DefaultTeam:  int32(*ot),
+	}
+
+	ldapConf := &mizumanju.LDAPConf{
+		URL:          *lu,
+		StartTLS:     *lt,
+		BindDN:       *lb,
+		BindPassword: *lw,
+		UserDN:       *ld,
+		BaseDN:       *lr,
+		UserFilter:   *lf,
+		AuthIdAttr:   *la,
+		NameAttr:     *ln,
+		EmailAttr:    *lm,
+		GroupAttr:    *lg,
+		AdminGroups:  splitDNs(*lga),
+		EditorGroups: splitDNs(*lge),
+		SyncInterval: *ls,
+		DefaultTeam:  int32(*lte),
+		AdoptLocal:   *lo,
+	}
+
+	mizumanju.Start(*h, int32(*p), *d, *sh, *sp, *ss, *su, *sw, *n, *u, *m, int32(*t), imgConf, calConf, oidcConf, ldapConf)
+}
+
+// splitDNs はセミコロン区切りの DN を分割する関数。DN はカンマを含むため、カンマでは区切らない。
+func splitDNs(s string) []string {
+	dns := make([]string, 0, 2)
+	for _, dn := range strings.Split(s, ";") {
+		if dn = strings.TrimSpace(dn); dn != "" {
+			dns = append(dns, dn)
+		}
+	}
+	return dns
 }
@@ -3,21 +3,29 @@ package mizumanju
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/sha512"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
-	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/mail"
 	"net/url"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/context"
+	"github.com/marcie001/mizumanju/hub"
 	"github.com/marcie001/mizumanju/imgmap"
+	"github.com/marcie001/mizumanju/totp"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/opentype"
 )
 
 var (
@@ -25,28 +33,207 @@ var (
 	ErrNotFound error = errors.New("Data not found")
 	// ErrUnauthorized は認証されていないことを表すエラー
 	ErrUnauthorized error = errors.New("Unauthorized")
+	// ErrTotpInvalid はワンタイムパスワードまたはリカバリコードが正しくないことを表すエラー
+	ErrTotpInvalid error = errors.New("Code is invalid.")
+	// ErrTotpLocked はワンタイムパスワードを続けて間違えたため、しばらく受け付けないことを表すエラー
+	ErrTotpLocked error = errors.New("Too many failed attempts. Try again later.")
+	// ErrDirectoryUser はディレクトリで管理するユーザのため、パスワードを変更できないことを表すエラー
+	ErrDirectoryUser error = errors.New("Your password is managed by the directory. Change it there.")
 )
 
+// User はユーザを表す構造体。
+// VoiceChatProvider はボイスチャットのプロバイダのキー。VoiceChatURL はそのユーザに発信する URL。
+// TeamIds は作成するときに所属させるチームの ID。更新するときは使わない。
 type User struct {
-	Id          int32     `json:"id"`
-	Name        string    `json:"name"`
-	VoiceChatID string    `json:"voiceChatId"`
-	Hide        bool      `json:"hide"`
-	Image       string    `json:"image"`
-	Role        string    `json:"role"`
-	AuthId      string    `json:"authId"`
-	DeleteFlag  bool      `json:"deleteFlag"`
-	Email       string    `json:"email"`
-	OrderNo     int32     `json:"orderNo"`
-	Created     time.Time `json:"created"`
+	Id                int32     `json:"id"`
+	Name              string    `json:"name"`
+	VoiceChatID       string    `json:"voiceChatId"`
+	VoiceChatProvider string    `json:"voiceChatProvider"`
+	VoiceChatURL      string    `json:"voiceChatUrl,omitempty"`
+	Hide              bool      `json:"hide"`
+	Image             string    `json:"image"`
+	Role              string    `json:"role"`
+	AuthId            string    `json:"authId"`
+	DeleteFlag        bool      `json:"deleteFlag"`
+	Email             string    `json:"email"`
+	OrderNo           int32     `json:"orderNo"`
+	Created           time.Time `json:"created"`
+	Privacy           string    `json:"privacy"`
+	ImageTTL          int32     `json:"imageTtl"`
+	TeamIds           []int32   `json:"teamIds,omitempty"`
+	// imageTTLSet は JSON から読み込んだときに imageTtl があったことを表す
+	imageTTLSet bool
 }
 
+// UnmarshalJSON は JSON からユーザ情報を読み込む関数。
+// 更新するときに省略した imageTtl を 0 と区別できるよう、imageTtl があったかどうかを記録する。
+func (u *User) UnmarshalJSON(b []byte) error {
+	type user User
+	if err := json.Unmarshal(b, (*user)(u)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	ttl, ok := fields["imageTtl"]
+	u.imageTTLSet = ok && string(ttl) != "null"
+	return nil
+}
+
+// Frame は過去のユーザ画像を表す構造体
+type Frame struct {
+	Timestamp int64  `json:"timestamp"`
+	Image     string `json:"image"`
+}
+
+// UserStatus はユーザステータスを表す構造体。
+// Status はユーザが設定したメッセージ、Preset はプリセットのキー、ExpiresAt は既定のステータスに戻る日時。
+// Dnd は話しかけないでほしいことを表し、ステータスを変更しても有効期限が過ぎても変わらない。
+// Presence は画像の変化から推定した在席状況。
 type UserStatus struct {
+	UserId     int32      `json:"userId"`
+	Status     string     `json:"status"`
+	Preset     string     `json:"preset"`
+	Emoji      string     `json:"emoji"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	Dnd        bool       `json:"dnd"`
+	Updated    time.Time  `json:"updated"`
+	Presence   string     `json:"presence"`
+	LastMotion *time.Time `json:"lastMotion"`
+}
+
+// StatusTransition はユーザステータスの変更を表す構造体
+type StatusTransition struct {
 	UserId  int32     `json:"userId"`
 	Status  string    `json:"status"`
+	Preset  string    `json:"preset"`
+	Emoji   string    `json:"emoji"`
 	Updated time.Time `json:"updated"`
 }
 
+// APIToken はユーザが発行した API トークンを表す構造体。
+// トークンはハッシュして保存するため、Token は発行したときにのみ返す。Prefix はトークンを見分けるための先頭部分。
+// Scopes は scopeRead, scopeImageWrite, scopeStatusWrite の組み合わせ。ExpiresAt が nil のときは無期限。
+type APIToken struct {
+	Id        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	LastUsed  *time.Time `json:"lastUsed"`
+	Created   time.Time  `json:"created"`
+	Token     string     `json:"token,omitempty"`
+}
+
+// TotpStatus はユーザの 2 段階認証の状態を表す構造体。
+// Required は管理者に 2 段階認証が必須で、ユーザが管理者であることを表す。
+type TotpStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+	Required          bool `json:"required"`
+}
+
+// SecuritySettings はセキュリティに関するシステムの設定を表す構造体。
+// RequireAdminTotp が true のとき、管理者は 2 段階認証を有効にするまで管理者の機能を使えない。
+type SecuritySettings struct {
+	RequireAdminTotp bool `json:"requireAdminTotp"`
+}
+
+// Team はチームを表す構造体。ユーザは同じチームに所属しているユーザのみ閲覧できる。
+type Team struct {
+	Id      int32     `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// VoiceChatProvider はボイスチャットのプロバイダを表す構造体。
+// URLTemplate の {id} をボイスチャット ID に置き換えると発信する URL になる。
+// Pattern はボイスチャット ID の形式の正規表現で、空のときは空白を含まない任意の文字列。
+// Builtin は組み込みのプロバイダであることを表し、組み込みのプロバイダは変更、削除できない。
+type VoiceChatProvider struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	URLTemplate string `json:"urlTemplate"`
+	Pattern     string `json:"pattern"`
+	Builtin     bool   `json:"builtin"`
+}
+
+// StatusPreset はユーザステータスのプリセットを表す構造体。
+// Emoji, Message はステータスの既定値。Duration (秒) が 0 より大きいときは、その時間が過ぎると既定のステータスに戻る。
+type StatusPreset struct {
+	Key      string `json:"key"`
+	Label    string `json:"label"`
+	Emoji    string `json:"emoji"`
+	Message  string `json:"message"`
+	Duration int32  `json:"duration"`
+	OrderNo  int32  `json:"orderNo"`
+}
+
+// WorkingHours はユーザの勤務時間を表す構造体。
+// TimeZone は IANA タイムゾーン名で、空のときはサーバのタイムゾーン。Hours が空のときは常に勤務時間とみなす。
+type WorkingHours struct {
+	TimeZone string        `json:"timeZone"`
+	Hours    []WorkingHour `json:"hours"`
+}
+
+// WorkingHour は曜日ごとの勤務時間帯を表す構造体。
+// Weekday は 0 (日曜) から 6 (土曜)。Start, End は HH:MM 形式で、End は 24:00 まで指定できる。
+type WorkingHour struct {
+	Weekday int    `json:"weekday"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+}
+
+// ScheduledStatus は予約したユーザステータスを表す構造体。
+// StartsAt になると設定し、EndsAt (nil のときは無期限) に既定のステータスに戻る。
+type ScheduledStatus struct {
+	Id       int64      `json:"id"`
+	UserId   int32      `json:"userId"`
+	Status   string     `json:"status"`
+	Preset   string     `json:"preset"`
+	Emoji    string     `json:"emoji"`
+	StartsAt time.Time  `json:"startsAt"`
+	EndsAt   *time.Time `json:"endsAt"`
+	Applied  bool       `json:"applied"`
+}
+
+// Knock は話しかけたいというリクエストを表す構造体。
+// State は queued (相手が DND のため届いていない), pending, accepted, deferred のいずれか。
+// VoiceChatID は届いたノックでは送ったユーザの、送ったノックでは相手が受け入れたときの相手のボイスチャット ID。
+type Knock struct {
+	Id          int64      `json:"id"`
+	FromUserId  int32      `json:"fromUserId"`
+	FromName    string     `json:"fromName"`
+	ToUserId    int32      `json:"toUserId"`
+	ToName      string     `json:"toName"`
+	Message     string     `json:"message"`
+	State       string     `json:"state"`
+	VoiceChatID string     `json:"voiceChatId,omitempty"`
+	Created     time.Time  `json:"created"`
+	Delivered   *time.Time `json:"delivered"`
+	Responded   *time.Time `json:"responded"`
+}
+
+// UserCalendar はユーザのカレンダーを表す構造体。
+// URL はアップロードしたカレンダーのときは空。Upcoming はこれから行われる予定。
+type UserCalendar struct {
+	UserId   int32           `json:"userId"`
+	URL      string          `json:"url"`
+	Fetched  *time.Time      `json:"fetched"`
+	Upcoming []CalendarEvent `json:"upcoming"`
+	// data はカレンダーのデータ、applied は最後にユーザステータスを設定した予定のキー
+	data    []byte
+	applied string
+}
+
+// CalendarEvent はカレンダーの予定の 1 回分を表す構造体
+type CalendarEvent struct {
+	Summary string    `json:"summary"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
 // context に登録するキー
 type key int32
 
@@ -59,36 +246,212 @@ const (
 	tmplkey key = 3
 	// context に登録する SystemConf のキー
 	systemkey key = 4
-	// 認証時 SQL
-	sqlFindByAuthId string = "SELECT id, auth_id, name, voice_chat_id, role, password, email, created FROM users WHERE auth_id = ? AND delete_flag = false"
+	// context に登録する ImageConf のキー
+	imgkey key = 5
+	// context に登録する CalendarConf のキー
+	calkey key = 6
+	// 認証時 SQL。ディレクトリで管理するユーザはパスワードで認証しない
+	sqlFindByAuthId string = "SELECT id, auth_id, name, voice_chat_id, role, password, email, created FROM users WHERE auth_id = ? AND delete_flag = false AND ldap_dn IS NULL"
 	// Email でユーザを検索
-	sqlFindByEmail string = "SELECT id, name, voice_chat_id, role, password, email, created FROM users WHERE email = ? AND delete_flag = false"
+	sqlFindByEmail string = "SELECT id, name, voice_chat_id, role, password, email, created, ldap_dn IS NOT NULL FROM users WHERE email = ? AND delete_flag = false"
+	// OpenID Connect の ID プロバイダと sub でログインするユーザを検索
+	sqlFindByOIDCSubject string = "SELECT id, auth_id, name, voice_chat_id, role, created FROM users WHERE oidc_issuer = ? AND oidc_subject = ? AND delete_flag = false"
+	// Email でログインするユーザを検索
+	sqlFindByEmailForLogin string = "SELECT id, auth_id, name, voice_chat_id, role, created FROM users WHERE email = ? AND delete_flag = false ORDER BY id LIMIT 1"
+	// ユーザを OpenID Connect の ID プロバイダと sub に対応付ける。対応付け済みのユーザは変更しない
+	sqlLinkOIDCSubject string = "UPDATE users SET oidc_issuer = ?, oidc_subject = ? WHERE id = ? AND oidc_subject IS NULL"
+	// ログイン ID を使っているユーザの数を取得
+	sqlCountAuthId string = "SELECT COUNT(*) FROM users WHERE auth_id = ?"
+	// OpenID Connect でログインしたユーザの登録 SQL
+	sqlInsertOIDCUser string = "INSERT INTO users (auth_id, name, voice_chat_id, voice_chat_provider, role, password, email, created, privacy, image_ttl, oidc_issuer, oidc_subject) VALUES (?, ?, '', ?, ?, '', ?, ?, ?, 0, ?, ?)"
+	// ログインするユーザを ID で検索
+	sqlFindLoginUserById string = "SELECT id, auth_id, name, voice_chat_id, role, created FROM users WHERE id = ?"
+	// ディレクトリのユーザと同じログイン ID のユーザを検索。削除されたユーザも含む
+	sqlFindLDAPUser string = "SELECT id, delete_flag, ldap_dn IS NOT NULL FROM users WHERE auth_id = ?"
+	// ディレクトリのユーザの登録 SQL
+	sqlInsertLDAPUser string = "INSERT INTO users (auth_id, name, voice_chat_id, voice_chat_provider, role, password, email, created, privacy, image_ttl, ldap_dn) VALUES (?, ?, '', ?, ?, '', ?, ?, ?, 0, ?)"
+	// ディレクトリのユーザの更新 SQL。削除されていたときは元に戻す
+	sqlUpdateLDAPUser string = "UPDATE users SET name = ?, role = ?, email = ?, ldap_dn = ?, delete_flag = false WHERE id = ?"
+	// ディレクトリで管理するユーザかどうか取得
+	sqlIsLDAPUser string = "SELECT ldap_dn IS NOT NULL FROM users WHERE id = ?"
+	// ディレクトリで管理するユーザ取得 SQL
+	sqlFindLDAPUsers string = "SELECT id, auth_id FROM users WHERE ldap_dn IS NOT NULL AND delete_flag = false"
 	// ユーザ取得
-	sqlFindById string = "SELECT id, name, voice_chat_id, role, auth_id, email, created FROM users WHERE id = ? AND delete_flag = false"
+	sqlFindById string = "SELECT id, name, voice_chat_id, voice_chat_provider, role, auth_id, email, created, privacy, image_ttl FROM users WHERE id = ? AND delete_flag = false"
 	// ユーザステータス取得
-	sqlFindUserStatusByUserId string = "SELECT user_id, status, updated FROM user_status WHERE user_id = ?"
-	// 表示設定取得 SQL
-	sqlFindDisplay string = "SELECT u.id, u.name, u.voice_chat_id, CASE WHEN uds.hide IS NULL THEN false ELSE uds.hide END, CASE WHEN uds.order_no IS NULL THEN -1 ELSE uds.order_no END FROM users u LEFT OUTER JOIN user_display_settings uds ON u.id = uds.target_user_id AND uds.user_id = ? WHERE u.id <> ? AND u.delete_flag = false ORDER BY uds.order_no, u.id DESC"
+	sqlFindUserStatusByUserId string = "SELECT u.id, COALESCE(us.status, ''), COALESCE(us.preset, ''), COALESCE(us.emoji, ''), us.expires, COALESCE(us.dnd, false), us.updated, up.presence, up.motion_at, up.updated FROM users u LEFT OUTER JOIN user_status us ON u.id = us.user_id LEFT OUTER JOIN user_presence up ON u.id = up.user_id WHERE u.id = ? AND u.delete_flag = false"
+	// 最後に動きがあった時刻取得
+	sqlFindMotionAt string = "SELECT motion_at FROM user_presence WHERE user_id = ?"
+	// 在席状況登録/更新 SQL
+	sqlUpsertPresence string = "INSERT INTO user_presence (user_id, presence, motion_at, updated) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE presence = ?, motion_at = ?, updated = ?"
+	// 閲覧するユーザ (1 番目のパラメタ) と u のユーザが同じチームに所属していることを表す SQL の条件
+	sqlSharesTeam string = "EXISTS (SELECT 1 FROM team_members tm1 INNER JOIN team_members tm2 ON tm1.team_id = tm2.team_id WHERE tm1.user_id = ? AND tm2.user_id = u.id)"
+	// 表示設定取得 SQL。同じチームに所属しているユーザのみ取得する
+	sqlFindDisplay string = "SELECT u.id, u.name, u.voice_chat_id, u.voice_chat_provider, u.image_ttl, CASE WHEN uds.hide IS NULL THEN false ELSE uds.hide END, CASE WHEN uds.order_no IS NULL THEN -1 ELSE uds.order_no END FROM users u LEFT OUTER JOIN user_display_settings uds ON u.id = uds.target_user_id AND uds.user_id = ? WHERE u.id <> ? AND u.delete_flag = false AND " + sqlSharesTeam + " ORDER BY uds.order_no, u.id DESC"
+	// 画像の有効期間取得 SQL
+	sqlFindImageTTL string = "SELECT image_ttl FROM users WHERE id = ?"
+	// 閲覧可能なユーザ取得 SQL。自分自身と、削除されていない同じチームのユーザを閲覧できる
+	sqlFindVisible string = "SELECT u.id FROM users u WHERE u.id = ? AND u.delete_flag = false AND (u.id = ? OR " + sqlSharesTeam + ")"
 	// 表示設定登録/更新 SQL
 	sqlUpsertDisplay string = "INSERT INTO user_display_settings (order_no, hide, user_id, target_user_id) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE order_no = ?, hide = ?"
 	// ユーザ登録 SQL
-	sqlInsertUser string = "INSERT INTO users (auth_id, name, voice_chat_id, role, password, email, created) VALUES (?, ?, ?, ?, '', ?, ?)"
+	sqlInsertUser string = "INSERT INTO users (auth_id, name, voice_chat_id, voice_chat_provider, role, password, email, created, privacy, image_ttl) VALUES (?, ?, ?, ?, ?, '', ?, ?, ?, ?)"
 	// ユーザ登録 SQL パスワードリカバリ
 	sqlInsertUserPasswdRecovery string = "INSERT INTO user_password_recovery (id, user_id, created) VALUES (?, ?, ?)"
 	// パスワードリカバリ情報の取得
-	sqlFindUserPasswdRecovery string = "SELECT upr.user_id, upr.created, u.created FROM user_password_recovery upr INNER JOIN users u ON upr.user_id = u.id WHERE upr.id = ?"
+	sqlFindUserPasswdRecovery string = "SELECT upr.user_id, upr.created FROM user_password_recovery upr INNER JOIN users u ON upr.user_id = u.id WHERE upr.id = ?"
 	// パスワードリカバリ情報の削除
 	sqlDeleteUserPasswdRecovery string = "DELETE FROM user_password_recovery WHERE id = ?"
 	// ユーザ更新 SQL
-	sqlUpdateUser string = "UPDATE users SET name = ?, voice_chat_id = ?, role = ?, email = ?, delete_flag = ? WHERE id = ?"
+	sqlUpdateUser string = "UPDATE users SET name = ?, voice_chat_id = ?, voice_chat_provider = ?, role = ?, email = ?, delete_flag = ?, privacy = ?, image_ttl = ? WHERE id = ?"
 	// ユーザステータス更新 SQL
-	sqlUpdateUserStatus string = "INSERT INTO user_status (user_id, status, updated) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE status = ?, updated =?"
+	sqlUpdateUserStatus string = "INSERT INTO user_status (user_id, status, preset, emoji, expires, updated) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE status = ?, preset = ?, emoji = ?, expires = ?, updated = ?"
+	// 期限切れユーザステータス取得 SQL
+	sqlFindExpiredStatuses string = "SELECT user_id, expires FROM user_status WHERE expires <= ? FOR UPDATE"
+	// ユーザステータスを既定に戻す SQL
+	sqlClearUserStatus string = "UPDATE user_status SET status = '', preset = '', emoji = '', expires = NULL, updated = ? WHERE user_id = ?"
+	// ユーザステータス履歴登録 SQL
+	sqlInsertStatusHistory string = "INSERT INTO user_status_history (user_id, status, preset, emoji, updated) VALUES (?, ?, ?, ?, ?)"
+	// ユーザステータス履歴取得 SQL
+	sqlFindStatusHistory string = "SELECT user_id, status, preset, emoji, updated FROM user_status_history WHERE user_id = ? AND updated BETWEEN ? AND ? ORDER BY updated, id"
+	// 全ユーザのステータス履歴取得 SQL。期間の開始時点のステータスがわかるよう、各ユーザの期間開始前の最後の履歴も取得する
+	sqlFindStatusTimeline string = "SELECT h.user_id, h.status, h.preset, h.emoji, h.updated FROM user_status_history h INNER JOIN users u ON h.user_id = u.id WHERE u.delete_flag = false AND (u.id = ? OR " + sqlSharesTeam + ") AND (h.updated >= ? AND h.updated < ? OR h.id = (SELECT p.id FROM user_status_history p WHERE p.user_id = h.user_id AND p.updated < ? ORDER BY p.updated DESC, p.id DESC LIMIT 1)) ORDER BY h.user_id, h.updated, h.id"
+	// API トークン一覧取得 SQL
+	sqlFindAPITokens string = "SELECT id, name, prefix, scopes, expires, last_used, created FROM api_tokens WHERE user_id = ? ORDER BY created DESC, id DESC"
+	// API トークン登録 SQL
+	sqlInsertAPIToken string = "INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes, expires, created) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	// API トークン削除 SQL
+	sqlDeleteAPIToken string = "DELETE FROM api_tokens WHERE id = ? AND user_id = ?"
+	// API トークンでユーザを検索する SQL。期限切れのトークンと削除されたユーザは除く
+	sqlFindUserByAPIToken string = "SELECT t.id, t.scopes, t.expires, u.id, u.auth_id, u.name, u.voice_chat_id, u.role, u.email, u.created FROM api_tokens t INNER JOIN users u ON t.user_id = u.id WHERE t.token_hash = ? AND (t.expires IS NULL OR t.expires > ?) AND u.delete_flag = false"
+	// API トークンの最終使用日時更新 SQL。頻繁に書き込まないよう、前回から間隔が空いたときのみ更新する
+	sqlUpdateAPITokenLastUsed string = "UPDATE api_tokens SET last_used = ? WHERE id = ? AND (last_used IS NULL OR last_used < ?)"
+	// 有効な API トークンの数を取得。期限切れのトークンと削除したトークンは数えない
+	sqlCountValidAPIToken string = "SELECT COUNT(*) FROM api_tokens t INNER JOIN users u ON t.user_id = u.id WHERE t.id = ? AND (t.expires IS NULL OR t.expires > ?) AND u.delete_flag = false"
+	// 2 段階認証の秘密鍵登録/更新 SQL。有効にするまでは何度でも登録し直せる
+	sqlUpsertTotp string = "INSERT INTO user_totp (user_id, secret, confirmed, last_step, failures, failed, created) VALUES (?, ?, NULL, 0, 0, NULL, ?) ON DUPLICATE KEY UPDATE secret = ?, confirmed = NULL, last_step = 0, failures = 0, failed = NULL, created = ?"
+	// 2 段階認証の状態取得 SQL
+	sqlFindTotp string = "SELECT secret, confirmed, last_step, failures, failed FROM user_totp WHERE user_id = ? FOR UPDATE"
+	// 2 段階認証を有効にする SQL
+	sqlConfirmTotp string = "UPDATE user_totp SET confirmed = ?, last_step = ? WHERE user_id = ?"
+	// 2 段階認証の成功を記録する SQL
+	sqlUpdateTotpSuccess string = "UPDATE user_totp SET last_step = ?, failures = 0, failed = NULL WHERE user_id = ?"
+	// 2 段階認証の失敗を記録する SQL
+	sqlUpdateTotpFailure string = "UPDATE user_totp SET failures = failures + 1, failed = ? WHERE user_id = ?"
+	// 2 段階認証削除 SQL
+	sqlDeleteTotp string = "DELETE FROM user_totp WHERE user_id = ?"
+	// 有効な 2 段階認証が設定されているか確認する SQL
+	sqlFindTotpEnabled string = "SELECT COUNT(*) FROM user_totp WHERE user_id = ? AND confirmed IS NOT NULL"
+	// 未使用のリカバリコードの数取得 SQL
+	sqlCountRecoveryCodes string = "SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ? AND used IS NULL"
+	// リカバリコード登録 SQL
+	sqlInsertRecoveryCode string = "INSERT INTO user_recovery_codes (user_id, code_hash, created) VALUES (?, ?, ?)"
+	// リカバリコードを使用済みにする SQL
+	sqlUseRecoveryCode string = "UPDATE user_recovery_codes SET used = ? WHERE user_id = ? AND code_hash = ? AND used IS NULL"
+	// リカバリコード削除 SQL
+	sqlDeleteRecoveryCodes string = "DELETE FROM user_recovery_codes WHERE user_id = ?"
+	// 設定取得 SQL
+	sqlFindSetting string = "SELECT value FROM settings WHERE name = ?"
+	// 設定登録/更新 SQL
+	sqlUpsertSetting string = "INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = ?"
+	// チーム全件取得 SQL
+	sqlFindTeams string = "SELECT id, name, created FROM teams ORDER BY name, id"
+	// ユーザが所属しているチーム取得 SQL
+	sqlFindTeamsByUserId string = "SELECT t.id, t.name, t.created FROM teams t INNER JOIN team_members tm ON t.id = tm.team_id WHERE tm.user_id = ? ORDER BY t.name, t.id"
+	// チーム取得 SQL
+	sqlFindTeam string = "SELECT id, name, created FROM teams WHERE id = ?"
+	// チーム登録 SQL
+	sqlInsertTeam string = "INSERT INTO teams (name, created) VALUES (?, ?)"
+	// チーム更新 SQL
+	sqlUpdateTeam string = "UPDATE teams SET name = ? WHERE id = ?"
+	// チーム削除 SQL
+	sqlDeleteTeam string = "DELETE FROM teams WHERE id = ?"
+	// チームの全メンバー削除 SQL
+	sqlDeleteTeamMembers string = "DELETE FROM team_members WHERE team_id = ?"
+	// チームのメンバー取得 SQL
+	sqlFindTeamMembers string = "SELECT u.id, u.name FROM users u INNER JOIN team_members tm ON u.id = tm.user_id WHERE tm.team_id = ? AND u.delete_flag = false ORDER BY u.id"
+	// チームのメンバーであるか確認する SQL
+	sqlFindTeamMember string = "SELECT user_id FROM team_members WHERE team_id = ? AND user_id = ?"
+	// チームのメンバー登録 SQL。削除されたユーザは登録しない
+	sqlInsertTeamMember string = "INSERT IGNORE INTO team_members (team_id, user_id) SELECT ?, id FROM users WHERE id = ? AND delete_flag = false"
+	// チームのメンバー削除 SQL
+	sqlDeleteTeamMember string = "DELETE FROM team_members WHERE team_id = ? AND user_id = ?"
+	// ボイスチャットのプロバイダ全件取得 SQL
+	sqlFindVoiceChatProviders string = "SELECT provider_key, name, url_template, id_pattern FROM voice_chat_providers ORDER BY provider_key"
+	// ボイスチャットのプロバイダ登録 SQL
+	sqlInsertVoiceChatProvider string = "INSERT INTO voice_chat_providers (provider_key, name, url_template, id_pattern) VALUES (?, ?, ?, ?)"
+	// ボイスチャットのプロバイダ更新 SQL
+	sqlUpdateVoiceChatProvider string = "UPDATE voice_chat_providers SET name = ?, url_template = ?, id_pattern = ? WHERE provider_key = ?"
+	// ボイスチャットのプロバイダ削除 SQL
+	sqlDeleteVoiceChatProvider string = "DELETE FROM voice_chat_providers WHERE provider_key = ?"
+	// ステータスプリセット全件取得 SQL
+	sqlFindStatusPresets string = "SELECT preset_key, label, emoji, message, duration, order_no FROM status_presets ORDER BY order_no, preset_key"
+	// ステータスプリセット取得 SQL
+	sqlFindStatusPreset string = "SELECT preset_key, label, emoji, message, duration, order_no FROM status_presets WHERE preset_key = ?"
+	// ステータスプリセット登録 SQL
+	sqlInsertStatusPreset string = "INSERT INTO status_presets (preset_key, label, emoji, message, duration, order_no) VALUES (?, ?, ?, ?, ?, ?)"
+	// ステータスプリセット更新 SQL
+	sqlUpdateStatusPreset string = "UPDATE status_presets SET label = ?, emoji = ?, message = ?, duration = ?, order_no = ? WHERE preset_key = ?"
+	// ステータスプリセット削除 SQL
+	sqlDeleteStatusPreset string = "DELETE FROM status_presets WHERE preset_key = ?"
+	// タイムゾーン取得 SQL
+	sqlFindTimeZone string = "SELECT time_zone FROM users WHERE id = ? AND delete_flag = false"
+	// タイムゾーン更新 SQL
+	sqlUpdateTimeZone string = "UPDATE users SET time_zone = ? WHERE id = ?"
+	// 勤務時間取得 SQL
+	sqlFindWorkingHours string = "SELECT weekday, start_minute, end_minute FROM user_working_hours WHERE user_id = ? ORDER BY weekday, start_minute"
+	// 勤務時間削除 SQL
+	sqlDeleteWorkingHours string = "DELETE FROM user_working_hours WHERE user_id = ?"
+	// 勤務時間登録 SQL
+	sqlInsertWorkingHour string = "INSERT INTO user_working_hours (user_id, weekday, start_minute, end_minute) VALUES (?, ?, ?, ?)"
+	// 予約ステータス取得 SQL。未適用のものと終了していないものを取得する
+	sqlFindScheduledStatuses string = "SELECT id, user_id, status, preset, emoji, starts, ends, applied FROM scheduled_statuses WHERE user_id = ? AND (applied = false OR ends > ?) ORDER BY starts, id"
+	// 適用する予約ステータス取得 SQL
+	sqlFindDueScheduledStatuses string = "SELECT id, user_id, status, preset, emoji, starts, ends, applied FROM scheduled_statuses WHERE applied = false AND starts <= ? ORDER BY starts, id"
+	// 予約ステータス登録 SQL
+	sqlInsertScheduledStatus string = "INSERT INTO scheduled_statuses (user_id, status, preset, emoji, starts, ends) VALUES (?, ?, ?, ?, ?, ?)"
+	// 予約ステータス適用済み更新 SQL。適用済みのときは更新しない
+	sqlUpdateScheduledStatusApplied string = "UPDATE scheduled_statuses SET applied = true WHERE id = ? AND applied = false"
+	// 予約ステータス削除 SQL
+	sqlDeleteScheduledStatus string = "DELETE FROM scheduled_statuses WHERE id = ? AND user_id = ?"
+	// カレンダー取得 SQL
+	sqlFindCalendar string = "SELECT user_id, url, data, fetched, applied FROM user_calendars WHERE user_id = ?"
+	// 同期するカレンダー取得 SQL
+	sqlFindCalendarsToSync string = "SELECT uc.user_id, uc.url, uc.data, uc.fetched, uc.applied FROM user_calendars uc INNER JOIN users u ON uc.user_id = u.id WHERE u.delete_flag = false"
+	// カレンダー登録/更新 SQL。予定を適用した記録は消す
+	sqlUpsertCalendar string = "INSERT INTO user_calendars (user_id, url, data, fetched, applied) VALUES (?, ?, ?, ?, '') ON DUPLICATE KEY UPDATE url = ?, data = ?, fetched = ?, applied = ''"
+	// カレンダーのデータ更新 SQL
+	sqlUpdateCalendarData string = "UPDATE user_calendars SET data = ?, fetched = ? WHERE user_id = ?"
+	// カレンダーの予定適用記録更新 SQL
+	sqlUpdateCalendarApplied string = "UPDATE user_calendars SET applied = ? WHERE user_id = ?"
+	// カレンダー削除 SQL
+	sqlDeleteCalendar string = "DELETE FROM user_calendars WHERE user_id = ?"
+	// 現在のユーザステータス取得 SQL
+	sqlFindCurrentStatus string = "SELECT status, preset, expires FROM user_status WHERE user_id = ?"
+	// DND 取得 SQL
+	sqlFindDnd string = "SELECT dnd FROM user_status WHERE user_id = ?"
+	// DND 登録/更新 SQL
+	sqlUpsertDnd string = "INSERT INTO user_status (user_id, status, updated, dnd) VALUES (?, '', ?, ?) ON DUPLICATE KEY UPDATE dnd = ?"
+	// ノック登録 SQL
+	sqlInsertKnock string = "INSERT INTO knocks (from_user_id, to_user_id, message, state, created, delivered) VALUES (?, ?, ?, ?, ?, ?)"
+	// 届いていないノック取得 SQL
+	sqlFindQueuedKnocks string = "SELECT id, from_user_id FROM knocks WHERE to_user_id = ? AND state = 'queued' FOR UPDATE"
+	// 届いていないノックを届ける SQL
+	sqlDeliverKnocks string = "UPDATE knocks SET state = 'pending', delivered = ? WHERE to_user_id = ? AND state = 'queued'"
+	// 届いたノック取得 SQL
+	sqlFindReceivedKnocks string = "SELECT k.id, k.from_user_id, f.name, k.to_user_id, t.name, k.message, k.state, f.voice_chat_id, k.created, k.delivered, k.responded FROM knocks k INNER JOIN users f ON k.from_user_id = f.id INNER JOIN users t ON k.to_user_id = t.id WHERE k.to_user_id = ? AND k.state <> 'queued' ORDER BY k.created DESC, k.id DESC LIMIT ?"
+	// 送ったノック取得 SQL。受け入れられたときだけ相手のボイスチャット ID を取得する
+	sqlFindSentKnocks string = "SELECT k.id, k.from_user_id, f.name, k.to_user_id, t.name, k.message, k.state, CASE WHEN k.state = 'accepted' THEN t.voice_chat_id ELSE '' END, k.created, k.delivered, k.responded FROM knocks k INNER JOIN users f ON k.from_user_id = f.id INNER JOIN users t ON k.to_user_id = t.id WHERE k.from_user_id = ? ORDER BY k.created DESC, k.id DESC LIMIT ?"
+	// 応答するノック取得 SQL
+	sqlFindKnockToAnswer string = "SELECT from_user_id FROM knocks WHERE id = ? AND to_user_id = ? AND state IN ('pending', 'deferred') FOR UPDATE"
+	// ノック応答 SQL
+	sqlAnswerKnock string = "UPDATE knocks SET state = ?, responded = ? WHERE id = ?"
 	// ユーザ削除 SQL
 	sqlDeleteUser string = "UPDATE users SET delete_flag = true, password = '', email = '' WHERE id = ?"
 	// パスワード変更 SQL
 	sqlUpdatePasswd string = "UPDATE users SET password = ? WHERE id = ? AND delete_flag = false"
 	// 全ユーザ取得
-	sqlFindAllUsers string = "SELECT id, auth_id, name, voice_chat_id, role, email, delete_flag FROM users ORDER BY id"
+	sqlFindAllUsers string = "SELECT id, auth_id, name, voice_chat_id, voice_chat_provider, role, email, delete_flag, privacy, image_ttl FROM users ORDER BY id"
 )
 
 // SetDB は DB インスタンスを context に保存する関数。
@@ -101,13 +464,50 @@ func SetSystemConf(r *http.Request, cnf *SystemConf) {
 	context.Set(r, systemkey, cnf)
 }
 
-// Authenticate はデータベースに問い合わせ認証を行う関数。
-// 認証成功時、該当ユーザの情報を返す。
+// SetCalendarConf はカレンダー設定を context に保存する関数。
+func SetCalendarConf(r *http.Request, cnf *CalendarConf) {
+	context.Set(r, calkey, cnf)
+}
+
+// SetImageConf は画像の設定を context に保存する関数。
+func SetImageConf(r *http.Request, cnf *ImageConf) {
+	context.Set(r, imgkey, cnf)
+}
+
+// Authenticator はログイン ID とパスワードでユーザを認証するインタフェース。
+// 認証に失敗したときは ErrUnauthorized を返す。
+type Authenticator interface {
+	Authenticate(db *sql.DB, authId, password string) (User, error)
+}
+
+// dbAuthenticator はデータベースに登録したパスワードで認証する Authenticator。
+type dbAuthenticator struct{}
+
+// Authenticate は認証を行う関数。
+// authenticators を順に試し、最初に認証できたユーザの情報を返す。
+// どれでも認証できず、エラーになったものがあるときは、そのエラーを返す。
 func Authenticate(r *http.Request, inId, inPasswd string) (User, error) {
 	db, ok := context.Get(r, dbkey).(*sql.DB)
 	if !ok {
 		return User{}, errors.New("DB instance not found.")
 	}
+	var rerr error = ErrUnauthorized
+	for _, a := range authenticators {
+		u, err := a.Authenticate(db, inId, inPasswd)
+		switch {
+		case err == nil:
+			return u, nil
+		case err != ErrUnauthorized:
+			log.Println(err)
+			rerr = err
+		}
+	}
+	return User{}, rerr
+}
+
+// Authenticate はデータベースに問い合わせ認証を行う関数。
+// 認証成功時、該当ユーザの情報を返す。以前の形式でハッシュしたパスワードは、このとき argon2id でハッシュし直す。
+func (dbAuthenticator) Authenticate(db *sql.DB, inId, inPasswd string) (User, error) {
 	var (
 		id                                        int32
 		authId, name, vcid, role, password, email string
@@ -122,13 +522,21 @@ func Authenticate(r *http.Request, inId, inPasswd string) (User, error) {
 		return User{}, err
 	default:
 		// パスワードチェック
-		chk, err := checkPassword(inPasswd, password, created)
+		chk, rehash, err := checkPassword(inPasswd, password, created)
 		if err != nil {
 			return User{}, err
 		}
 		if !chk {
 			return User{}, ErrUnauthorized
 		}
+		if rehash {
+			// 失敗してもログインはできるため、次回に再度ハッシュし直す
+			if hashed, err := hashPassword(inPasswd); err != nil {
+				log.Println(err)
+			} else if _, err := db.Exec(sqlUpdatePasswd, hashed, id); err != nil {
+				log.Println(err)
+			}
+		}
 		return User{
 			Id:          id,
 			AuthId:      authId,
@@ -141,26 +549,26 @@ func Authenticate(r *http.Request, inId, inPasswd string) (User, error) {
 	}
 }
 
-// checkPassword はパスワードが正しいかチェックする関数。
-func checkPassword(userinput, password string, created time.Time) (bool, error) {
-	hashed, err := hashPassword(userinput, created)
-	if err != nil {
-		return false, err
+// FindDisplaySettings は userId のユーザ表示設定を取得する関数。
+// 同じチームに所属しているユーザのみ返す。
+func FindDisplaySettings(r *http.Request, userId int32) ([]User, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return nil, errors.New("DB instance not found.")
 	}
-	return password == hashed, nil
+	return findDisplaySettings(db, userId)
 }
 
-// FindDisplaySettings は userId のユーザ表示設定を取得する関数。
-func FindDisplaySettings(r *http.Request, userId int32) (users []User, err error) {
+// findDisplaySettings は userId のユーザ表示設定を取得する関数。
+func findDisplaySettings(db *sql.DB, userId int32) (users []User, err error) {
 	users = make([]User, 0, 32)
 
-	db, ok := context.Get(r, dbkey).(*sql.DB)
-	if !ok {
-		err = errors.New("DB instance not found.")
+	providers, err := findVoiceChatProviders(db)
+	if err != nil {
 		return
 	}
 	var rows *sql.Rows
-	rows, err = db.Query(sqlFindDisplay, userId, userId)
+	rows, err = db.Query(sqlFindDisplay, userId, userId, userId)
 	if err != nil {
 		return
 	}
@@ -171,26 +579,49 @@ func FindDisplaySettings(r *http.Request, userId int32) (users []User, err error
 	}()
 	for rows.Next() {
 		var (
-			id, order  int32
-			name, vcid string
-			hide       bool
+			id, order, ttl     int32
+			name, vcid, vcprov string
+			hide               bool
 		)
-		err = rows.Scan(&id, &name, &vcid, &hide, &order)
+		err = rows.Scan(&id, &name, &vcid, &vcprov, &ttl, &hide, &order)
 		if err != nil {
 			return
 		}
 		users = append(users, User{
-			Id:          id,
-			Name:        name,
-			VoiceChatID: vcid,
-			Hide:        hide,
-			Image:       fmt.Sprint("/api/users/", id, "/image"),
-			OrderNo:     order,
+			Id:                id,
+			Name:              name,
+			VoiceChatID:       vcid,
+			VoiceChatProvider: vcprov,
+			VoiceChatURL:      providers.url(vcprov, vcid),
+			Hide:              hide,
+			Image:             fmt.Sprint("/api/users/", id, "/image"),
+			OrderNo:           order,
+			ImageTTL:          ttl,
 		})
 	}
 	return
 }
 
+// CheckVisible は userId のユーザが targetUserId のユーザの画像などを閲覧できるか確認する関数。
+// 自分自身と、同じチームに所属しているユーザを閲覧できる。閲覧できないときは ErrNotFound を返す。
+func CheckVisible(r *http.Request, userId int32, targetUserId int32) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+
+	var id int32
+	err := db.QueryRow(sqlFindVisible, targetUserId, userId, userId).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		log.Printf("Invisible. ID: %d, Target ID: %d", userId, targetUserId)
+		return ErrNotFound
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
 // UpsertDisplaySettings は複数表示設定を更新または挿入する関数
 func UpsertDisplaySettings(r *http.Request, userId int32, users []User) (err error) {
 	db, ok := context.Get(r, dbkey).(*sql.DB)
@@ -249,12 +680,18 @@ func FindUserById(r *http.Request, id int32) (u User, err error) {
 		log.Println(err)
 		return
 	}
+	providers, err := findVoiceChatProviders(db)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	u.VoiceChatURL = providers.url(u.VoiceChatProvider, u.VoiceChatID)
 	return
 }
 
 // findUserById は id でユーザ情報を取得する関数
 func findUserById(r *http.Request, tx *sql.Tx, id int32) (u User, err error) {
-	err = tx.QueryRow(sqlFindById, id).Scan(&u.Id, &u.Name, &u.VoiceChatID, &u.Role, &u.AuthId, &u.Email, &u.Created)
+	err = tx.QueryRow(sqlFindById, id).Scan(&u.Id, &u.Name, &u.VoiceChatID, &u.VoiceChatProvider, &u.Role, &u.AuthId, &u.Email, &u.Created, &u.Privacy, &u.ImageTTL)
 	return
 }
 
@@ -267,13 +704,82 @@ func FindUserStatusByUserId(r *http.Request, userId int32) (u UserStatus, err er
 		return
 	}
 
-	err = db.QueryRow(sqlFindUserStatusByUserId, userId).Scan(&u.UserId, &u.Status, &u.Updated)
+	cnf, ok := context.Get(r, imgkey).(*ImageConf)
+	if !ok {
+		err = errors.New("ImageConf instance not found.")
+		return
+	}
+
+	var (
+		updated, presenceUpdated *time.Time
+		presence                 *string
+	)
+	err = db.QueryRow(sqlFindUserStatusByUserId, userId).Scan(&u.UserId, &u.Status, &u.Preset, &u.Emoji, &u.ExpiresAt, &u.Dnd, &updated, &presence, &u.LastMotion, &presenceUpdated)
 	if err != nil {
 		return
 	}
+	if updated != nil {
+		u.Updated = *updated
+	}
+	// 期限切れのステータスは掃除される前でも既定のステータスとして扱う
+	if u.ExpiresAt != nil && !u.ExpiresAt.After(time.Now()) {
+		u.Updated = *u.ExpiresAt
+		u.Status, u.Preset, u.Emoji, u.ExpiresAt = "", "", "", nil
+	}
+	// 画像が届かなくなったときは不在とする
+	u.Presence = presenceAway
+	if presence != nil && presenceUpdated != nil && time.Since(*presenceUpdated) < cnf.AwayAfter {
+		u.Presence = *presence
+	}
 	return
 }
 
+// updatePresence は前回の画像 prev と今回の画像 img の差分から在席状況を推定して保存する関数。
+// 差分が閾値以上のときは動きがあったとみなす。
+func updatePresence(r *http.Request, userId int32, prev *imgmap.Img, img image.Image) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	cnf, ok := context.Get(r, imgkey).(*ImageConf)
+	if !ok {
+		return errors.New("ImageConf instance not found.")
+	}
+
+	now := time.Now()
+	moved := true
+	if prev != nil {
+		if p, _, err := image.Decode(bytes.NewReader(prev.Data)); err == nil {
+			moved = imgmap.Diff(p, img) >= cnf.MotionThreshold
+		}
+	}
+	var motionAt *time.Time
+	if moved {
+		motionAt = &now
+	} else {
+		err := db.QueryRow(sqlFindMotionAt, userId).Scan(&motionAt)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	presence := classifyPresence(cnf, motionAt, now)
+	_, err := db.Exec(sqlUpsertPresence, userId, presence, motionAt, now, presence, motionAt, now)
+	return err
+}
+
+// classifyPresence は最後に動きがあった時刻 motionAt から在席状況を判定する関数。
+func classifyPresence(cnf *ImageConf, motionAt *time.Time, now time.Time) string {
+	switch {
+	case motionAt == nil:
+		return presenceAway
+	case now.Sub(*motionAt) < cnf.IdleAfter:
+		return presenceActive
+	case now.Sub(*motionAt) < cnf.AwayAfter:
+		return presenceIdle
+	}
+	return presenceAway
+}
+
 // UpsertDisplaySetting は表示設定を更新または挿入する関数
 func UpsertDisplaySetting(r *http.Request, tx *sql.Tx, userId int32, targetUserId int32, orderNo int32, hide bool) (err error) {
 	_, err = findUserById(r, tx, userId)
@@ -293,45 +799,196 @@ func UpsertDisplaySetting(r *http.Request, tx *sql.Tx, userId int32, targetUserI
 	return
 }
 
-// イメージマップのインスタンス
-var images = imgmap.New()
+// イメージマップのインスタンス。Start で ImageConf に従って生成する。
+var images *imgmap.ImgMap
+
+// ユーザ画像の更新、ユーザステータスの変更などのイベントを配信するハブ
+var events = hub.New()
+
+// newImageStore は conf に従って画像の保存先を生成する関数。
+func newImageStore(conf *ImageConf, db *sql.DB) (imgmap.Store, error) {
+	switch conf.Store {
+	case "", imageStoreMemory:
+		return imgmap.NewMemStore(), nil
+	case imageStoreDisk:
+		return imgmap.NewDiskStore(conf.Dir)
+	case imageStoreMySQL:
+		return imgmap.NewDBStore(db), nil
+	}
+	return nil, fmt.Errorf("Unknown image store: %s", conf.Store)
+}
+
+// SaveImage はユーザ画像にユーザのプライバシー設定を適用し、
+// 設定された形式にエンコードしてイメージマップに保存する関数。
+// 在席状況の更新に失敗したときはログに出力し、エラーを返さない。
+func SaveImage(r *http.Request, userId int32, img image.Image) error {
+	cnf, ok := context.Get(r, imgkey).(*ImageConf)
+	if !ok {
+		return errors.New("ImageConf instance not found.")
+	}
 
-// SaveImage はユーザ画像をメモリ上に保存する関数。
-func SaveImage(r *http.Request, userId int32, image string) error {
-	b, err := base64.StdEncoding.DecodeString(image)
+	u, err := FindUserById(r, userId)
+	if err != nil {
+		return err
+	}
+	img = applyPrivacy(img, u.Privacy)
+	prev, err := images.Latest(userId)
 	if err != nil {
 		return err
 	}
 
-	images.Set(userId, b)
+	ct := "image/png"
+	if cnf.Format == imageFormatJPEG {
+		ct = "image/jpeg"
+	}
+	buf := new(bytes.Buffer)
+	if err := imgmap.Encode(buf, img, ct); err != nil {
+		return err
+	}
 
+	if err := images.Set(userId, buf.Bytes(), ct); err != nil {
+		return err
+	}
+	// 画像は保存済みのため、在席状況を更新できなくてもアップロードは成功とする
+	if err := updatePresence(r, userId, prev, img); err != nil {
+		log.Println(err)
+	}
 	return nil
 }
 
-// GetImage はユーザ画像をメモリ上から取得する関数。
-func GetImage(r *http.Request, userId int32) ([]byte, error) {
-	return images.Get(userId)
+// applyPrivacy はプライバシー設定 privacy に従って img を加工する関数。
+func applyPrivacy(img image.Image, privacy string) image.Image {
+	switch privacy {
+	case privacyBlur:
+		return imgmap.Blur(img)
+	case privacyPixelate:
+		return imgmap.Pixelate(img)
+	case privacySilhouette:
+		return imgmap.Silhouette(img)
+	}
+	return img
 }
 
-// hashPassword はパスワードをハッシュする関数。
-func hashPassword(password string, created time.Time) (string, error) {
-	buf := new(bytes.Buffer)
-	ms := created.UnixNano()
-	err := binary.Write(buf, binary.LittleEndian, ms)
+// GetImage はユーザ画像をイメージマップから取得する関数。
+// width が 0 より大きいときは、幅 width 以下に縮小した画像を取得する。
+// ユーザの画像の有効期間が過ぎているときは、画像が無いことを表す画像を取得する。
+func GetImage(r *http.Request, userId int32, width int) (*imgmap.Img, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return nil, errors.New("DB instance not found.")
+	}
+	cnf, ok := context.Get(r, imgkey).(*ImageConf)
+	if !ok {
+		return nil, errors.New("ImageConf instance not found.")
+	}
+
+	var ttl int32
+	err := db.QueryRow(sqlFindImageTTL, userId).Scan(&ttl)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	b := []byte(password)
-	var h [64]byte
-	for i := 0; i < 50; i++ {
-		if i == 0 {
-			b = append(b, buf.Bytes()...)
-		} else {
-			b = append(h[:], buf.Bytes()...)
+	img, err := images.GetWidth(userId, cnf.imageTTL(ttl), width)
+	if err != nil || !img.Stale {
+		return img, err
+	}
+
+	// 画像が無いのが勤務時間外だからであれば、そのことを表す画像にする
+	wh, err := findWorkingHours(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	if wh.contains(time.Now()) {
+		return img, nil
+	}
+	off, err := imgmap.OffHours()
+	if err != nil {
+		return nil, err
+	}
+	off.Timestamp = img.Timestamp
+	return off, nil
+}
+
+// FindImageHistory は since 以上 until 以下に保存されたユーザ画像の一覧を取得する関数。
+func FindImageHistory(r *http.Request, userId int32, since, until int64) ([]Frame, error) {
+	ts, err := images.History(userId, since, until)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]Frame, len(ts))
+	for i, t := range ts {
+		frames[i] = Frame{
+			Timestamp: t,
+			Image:     fmt.Sprint("/api/users/", userId, "/images/", t),
 		}
-		h = sha512.Sum512(b)
 	}
-	return fmt.Sprintf("%x", h), nil
+	return frames, nil
+}
+
+// GetHistoryImage はタイムスタンプが timestamp のユーザ画像を取得する関数。
+func GetHistoryImage(r *http.Request, userId int32, timestamp int64) (*imgmap.Img, error) {
+	i, err := images.At(userId, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if i == nil {
+		return nil, ErrNotFound
+	}
+	return i, nil
+}
+
+// GetTimelapse は from 以上 to 以下に保存されたユーザ画像をつなげたアニメーション GIF を生成する関数。
+func GetTimelapse(r *http.Request, userId int32, from, to int64, fps int) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := images.Timelapse(buf, userId, from, to, fps, timelapseWidth)
+	if err == imgmap.ErrNoFrames {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GetWall は tiles の最新のユーザ画像を並べた JPEG を生成する関数。
+// 画像の有効期間は Tile.TTL に従う。
+func GetWall(r *http.Request, tiles []imgmap.Tile) ([]byte, error) {
+	face, err := newWallFace(imgConf)
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+	buf := new(bytes.Buffer)
+	if err := images.Wall(buf, tiles, face); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 壁に名前を描くフォント。Start で ImageConf に従って読み込む。nil のときは basicfont.Face7x13 で描く
+var wallFont *opentype.Font
+
+// loadWallFont は conf のフォントファイルを読み込む関数。フォントファイルが指定されていないときは nil を返す。
+func loadWallFont(conf *ImageConf) (*opentype.Font, error) {
+	if conf.FontFile == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(conf.FontFile)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.Parse(b)
+}
+
+// newWallFace は conf に従って壁に名前を描くフォントフェイスを生成する関数。
+// opentype のフォントフェイスは同時に使えないため、壁を描くたびに生成する。
+func newWallFace(conf *ImageConf) (font.Face, error) {
+	if wallFont == nil {
+		return basicfont.Face7x13, nil
+	}
+	return opentype.NewFace(wallFont, &opentype.FaceOptions{
+		Size:    conf.FontSize,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
 }
 
 // FindAllUsers は全ユーザをデータベースから取得する関数
@@ -356,28 +1013,32 @@ func FindAllUsers(r *http.Request) (users []User, err error) {
 	}()
 	for rows.Next() {
 		var (
-			id                              int32
-			authId, name, vcid, role, email string
-			delFlg                          bool
+			id, ttl                                          int32
+			authId, name, vcid, vcprov, role, email, privacy string
+			delFlg                                           bool
 		)
-		err = rows.Scan(&id, &authId, &name, &vcid, &role, &email, &delFlg)
+		err = rows.Scan(&id, &authId, &name, &vcid, &vcprov, &role, &email, &delFlg, &privacy, &ttl)
 		if err != nil {
 			return
 		}
 		users = append(users, User{
-			Id:          id,
-			AuthId:      authId,
-			Name:        name,
-			VoiceChatID: vcid,
-			Role:        role,
-			DeleteFlag:  delFlg,
-			Email:       email,
+			Id:                id,
+			AuthId:            authId,
+			Name:              name,
+			VoiceChatID:       vcid,
+			VoiceChatProvider: vcprov,
+			Role:              role,
+			DeleteFlag:        delFlg,
+			Email:             email,
+			Privacy:           privacy,
+			ImageTTL:          ttl,
 		})
 	}
 	return
 }
 
-// InsertUser はユーザ情報をデータベースに挿入し、メールで通知する関数
+// InsertUser はユーザ情報をデータベースに挿入し、メールで通知する関数。
+// 追加したことをイベントとして配信する。
 func InsertUser(r *http.Request, user User) (u User, err error) {
 	db, ok := context.Get(r, dbkey).(*sql.DB)
 	if !ok {
@@ -394,11 +1055,14 @@ func InsertUser(r *http.Request, user User) (u User, err error) {
 	defer func() {
 		if err != nil {
 			tx.Rollback()
-		} else {
-			err = tx.Commit()
+		} else if err = tx.Commit(); err == nil {
+			events.Publish(hub.Event{Type: hub.UserAdded, UserId: user.Id, Timestamp: time.Now().Unix()})
+			if len(user.TeamIds) > 0 {
+				events.Publish(hub.Event{Type: hub.TeamChanged, UserId: user.Id, Timestamp: time.Now().Unix()})
+			}
 		}
 	}()
-	rslt, err := tx.Exec(sqlInsertUser, user.AuthId, user.Name, user.VoiceChatID, user.Role, user.Email, time.Now())
+	rslt, err := tx.Exec(sqlInsertUser, user.AuthId, user.Name, user.VoiceChatID, user.VoiceChatProvider, user.Role, user.Email, time.Now(), user.Privacy, user.ImageTTL)
 	if err != nil {
 		log.Println(err)
 		return
@@ -409,6 +1073,12 @@ func InsertUser(r *http.Request, user User) (u User, err error) {
 		return
 	}
 	user.Id = int32(id)
+	for _, teamId := range user.TeamIds {
+		if _, err = tx.Exec(sqlInsertTeamMember, teamId, user.Id); err != nil {
+			log.Println(err)
+			return
+		}
+	}
 
 	key, err := createRecoveryKey(r, tx, user.Id)
 	if err != nil {
@@ -461,12 +1131,18 @@ func CreateRecovery(r *http.Request, email string) (err error) {
 		id                         int32
 		name, vcid, role, password string
 		created                    time.Time
+		managed                    bool
 	)
-	err = db.QueryRow(sqlFindByEmail, email).Scan(&id, &name, &vcid, &role, &password, &email, &created)
+	err = db.QueryRow(sqlFindByEmail, email).Scan(&id, &name, &vcid, &role, &password, &email, &created, &managed)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if managed {
+		// ディレクトリのパスワードは変更できないため、リカバリキーを発行しない
+		log.Printf("Recovery requested for LDAP user. ID: %d", id)
+		return ErrDirectoryUser
+	}
 
 	key, err := createRecoveryKey(r, tx, id)
 	if err != nil {
@@ -502,7 +1178,7 @@ func UpdateUser(r *http.Request, user User) (User, error) {
 			err = tx.Commit()
 		}
 	}()
-	rslt, err := tx.Exec(sqlUpdateUser, user.Name, user.VoiceChatID, user.Role, user.Email, user.DeleteFlag, user.Id)
+	rslt, err := tx.Exec(sqlUpdateUser, user.Name, user.VoiceChatID, user.VoiceChatProvider, user.Role, user.Email, user.DeleteFlag, user.Privacy, user.ImageTTL, user.Id)
 	if err != nil {
 		return user, err
 	}
@@ -514,14 +1190,17 @@ func UpdateUser(r *http.Request, user User) (User, error) {
 	return user, nil
 }
 
-// UpdateUserStatus はユーザステータスを更新する関数
-func UpdateUserStatus(r *http.Request, userId int32, status string) error {
+// UpdateUserStatus はユーザステータスを更新し、変更をイベントとして配信する関数
+func UpdateUserStatus(r *http.Request, userId int32, status UserStatus) error {
 	db, ok := context.Get(r, dbkey).(*sql.DB)
 	if !ok {
-		err := errors.New("DB instance not found.")
-		return err
+		return errors.New("DB instance not found.")
 	}
+	return updateUserStatus(db, userId, status, time.Now())
+}
 
+// updateUserStatus は now にユーザステータスを更新し、履歴に記録して、変更をイベントとして配信する関数
+func updateUserStatus(db *sql.DB, userId int32, status UserStatus, now time.Time) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -529,133 +1208,1371 @@ func UpdateUserStatus(r *http.Request, userId int32, status string) error {
 	defer func() {
 		if err != nil {
 			tx.Rollback()
-		} else {
-			err = tx.Commit()
+		} else if err = tx.Commit(); err == nil {
+			events.Publish(hub.Event{Type: hub.Status, UserId: userId, Timestamp: now.Unix()})
 		}
 	}()
-	now := time.Now()
-	rslt, err := tx.Exec(sqlUpdateUserStatus, userId, status, now, status, now)
+	return writeUserStatus(tx, userId, status, now)
+}
+
+// writeUserStatus は tx でユーザステータスを更新し、履歴に記録する関数。
+func writeUserStatus(tx *sql.Tx, userId int32, status UserStatus, now time.Time) error {
+	rslt, err := tx.Exec(sqlUpdateUserStatus, userId, status.Status, status.Preset, status.Emoji, status.ExpiresAt, now,
+		status.Status, status.Preset, status.Emoji, status.ExpiresAt, now)
 	if err != nil {
 		return err
 	}
 	if _, err := rslt.RowsAffected(); err != nil {
 		return err
 	}
+	if _, err = tx.Exec(sqlInsertStatusHistory, userId, status.Status, status.Preset, status.Emoji, now); err != nil {
+		return err
+	}
 	return nil
 }
 
-// UpdatePasswordByRecoveryKey はパスワードを変更する関数
-func UpdatePasswordByRecoveryKey(r *http.Request, key string, passwd string) (err error) {
-	db, ok := context.Get(r, dbkey).(*sql.DB)
-	if !ok {
-		err = errors.New("DB instance not found.")
-		return
-	}
-
+// ExpireUserStatuses は now までに有効期限が過ぎたユーザステータスを既定のステータスに戻す関数。
+// 有効期限の日時で履歴に記録し、変更をイベントとして配信する。
+func ExpireUserStatuses(db *sql.DB, now time.Time) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return
 	}
+	expired := make(map[int32]time.Time)
 	defer func() {
 		if err != nil {
 			tx.Rollback()
-		} else {
-			err = tx.Commit()
+		} else if err = tx.Commit(); err == nil {
+			for userId := range expired {
+				events.Publish(hub.Event{Type: hub.Status, UserId: userId, Timestamp: now.Unix()})
+			}
 		}
 	}()
 
-	var (
-		t, c time.Time
-		uid  int32
-	)
-	err = tx.QueryRow(sqlFindUserPasswdRecovery, key).Scan(&uid, &t, &c)
+	rows, err := tx.Query(sqlFindExpiredStatuses, now)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	if t.Unix() < time.Now().Unix()-1800 {
-		err = errors.New("Recovery key was expired.")
-		log.Println(err, t.Unix(), time.Now().Unix())
-		return
+	for rows.Next() {
+		var (
+			userId  int32
+			expires time.Time
+		)
+		if err = rows.Scan(&userId, &expires); err != nil {
+			rows.Close()
+			return
+		}
+		expired[userId] = expires
 	}
-
-	err = updatePasswordById(r, tx, uid, passwd, c)
-	if err != nil {
-		log.Println(err)
+	if err = rows.Close(); err != nil {
 		return
 	}
-	_, err = tx.Exec(sqlDeleteUserPasswdRecovery, key)
-	if err != nil {
-		log.Println(err)
-		return
+
+	for userId, expires := range expired {
+		if _, err = tx.Exec(sqlClearUserStatus, expires, userId); err != nil {
+			return
+		}
+		if _, err = tx.Exec(sqlInsertStatusHistory, userId, "", "", "", expires); err != nil {
+			return
+		}
 	}
 	return
 }
 
-// UpdatePasswordByAuthId はパスワードを変更する関数
-func UpdatePasswordByAuthId(r *http.Request, authId string, curPasswd string, newPasswd string) (err error) {
-	u, err := Authenticate(r, authId, curPasswd)
-	if err != nil {
-		log.Println(err)
-		if err == ErrUnauthorized {
-			err = ErrNotFound
+// SweepUserStatuses は interval ごとに予約したユーザステータスを適用し、期限切れのユーザステータスを既定のステータスに戻す関数。
+// 戻らないので goroutine で実行する。
+func SweepUserStatuses(db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := ApplyScheduledStatuses(db, now); err != nil {
+			log.Println(err)
+		}
+		if err := ExpireUserStatuses(db, now); err != nil {
+			log.Println(err)
 		}
-		return
 	}
+}
 
-	db, ok := context.Get(r, dbkey).(*sql.DB)
-	if !ok {
-		err = errors.New("DB instance not found.")
-		return
+// ApplyScheduledStatuses は now までに開始する予約したユーザステータスを開始順に適用する関数。
+// 適用する前に終了したものは適用せずに適用済みにする。
+// 適用できなかったものはログに出力し、次に適用する時に再度適用する。
+func ApplyScheduledStatuses(db *sql.DB, now time.Time) error {
+	rows, err := db.Query(sqlFindDueScheduledStatuses, now)
+	if err != nil {
+		return err
+	}
+	due, err := scanScheduledStatuses(rows)
+	if err != nil {
+		return err
+	}
+	for _, s := range due {
+		if err := applyScheduledStatus(db, s, now); err != nil {
+			log.Printf("Failed to apply scheduled status. ID: %d, %v", s.Id, err)
+		}
 	}
+	return nil
+}
 
+// applyScheduledStatus は予約したユーザステータスを適用済みにし、終了していなければ適用する関数。
+// 複数のサーバで同じものを適用しないよう、適用済みにできたときのみ適用する。
+func applyScheduledStatus(db *sql.DB, s ScheduledStatus, now time.Time) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return
 	}
+	updated := false
 	defer func() {
 		if err != nil {
 			tx.Rollback()
-		} else {
-			err = tx.Commit()
+		} else if err = tx.Commit(); err == nil && updated {
+			events.Publish(hub.Event{Type: hub.Status, UserId: s.UserId, Timestamp: now.Unix()})
 		}
 	}()
 
-	err = updatePasswordById(r, tx, u.Id, newPasswd, u.Created)
+	rslt, err := tx.Exec(sqlUpdateScheduledStatusApplied, s.Id)
 	if err != nil {
-		log.Println(err)
 		return
 	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil || cnt == 0 {
+		// 他のサーバが適用済み
+		return
+	}
+	if s.EndsAt == nil || s.EndsAt.After(now) {
+		err = writeUserStatus(tx, s.UserId, UserStatus{
+			Status:    s.Status,
+			Preset:    s.Preset,
+			Emoji:     s.Emoji,
+			ExpiresAt: s.EndsAt,
+		}, now)
+		updated = err == nil
+	}
 	return
 }
 
-// updatePasswordById はパスワードを変更する関数
-func updatePasswordById(r *http.Request, tx *sql.Tx, id int32, passwd string, created time.Time) (err error) {
-	p, err := hashPassword(passwd, created)
-	if err != nil {
+// FindScheduledStatuses は userId のユーザの未適用または終了していない予約したユーザステータスを取得する関数。
+func FindScheduledStatuses(r *http.Request, userId int32) ([]ScheduledStatus, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return nil, errors.New("DB instance not found.")
+	}
+	rows, err := db.Query(sqlFindScheduledStatuses, userId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return scanScheduledStatuses(rows)
+}
+
+// scanScheduledStatuses は rows から予約したユーザステータスを読み込み、rows を閉じる関数。
+func scanScheduledStatuses(rows *sql.Rows) (ss []ScheduledStatus, err error) {
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	ss = make([]ScheduledStatus, 0, 8)
+	for rows.Next() {
+		var s ScheduledStatus
+		if err = rows.Scan(&s.Id, &s.UserId, &s.Status, &s.Preset, &s.Emoji, &s.StartsAt, &s.EndsAt, &s.Applied); err != nil {
+			return
+		}
+		ss = append(ss, s)
+	}
+	err = rows.Err()
+	return
+}
+
+// InsertScheduledStatus はユーザステータスを予約する関数。
+func InsertScheduledStatus(r *http.Request, s ScheduledStatus) (ScheduledStatus, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return s, errors.New("DB instance not found.")
+	}
+	rslt, err := db.Exec(sqlInsertScheduledStatus, s.UserId, s.Status, s.Preset, s.Emoji, s.StartsAt, s.EndsAt)
+	if err != nil {
+		return s, err
+	}
+	s.Id, err = rslt.LastInsertId()
+	return s, err
+}
+
+// DelScheduledStatus は userId のユーザの予約したユーザステータスを削除する関数。
+// 適用済みのユーザステータスはそのまま残す。
+func DelScheduledStatus(r *http.Request, userId int32, id int64) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	rslt, err := db.Exec(sqlDeleteScheduledStatus, id, userId)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FindWorkingHours は userId のユーザの勤務時間を取得する関数。
+func FindWorkingHours(r *http.Request, userId int32) (WorkingHours, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return WorkingHours{}, errors.New("DB instance not found.")
+	}
+	return findWorkingHours(db, userId)
+}
+
+// findWorkingHours は userId のユーザの勤務時間を取得する関数。
+func findWorkingHours(db *sql.DB, userId int32) (wh WorkingHours, err error) {
+	if err = db.QueryRow(sqlFindTimeZone, userId).Scan(&wh.TimeZone); err != nil {
+		return
+	}
+	rows, err := db.Query(sqlFindWorkingHours, userId)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	wh.Hours = make([]WorkingHour, 0, 7)
+	for rows.Next() {
+		var weekday, start, end int
+		if err = rows.Scan(&weekday, &start, &end); err != nil {
+			return
+		}
+		wh.Hours = append(wh.Hours, WorkingHour{
+			Weekday: weekday,
+			Start:   formatClock(start),
+			End:     formatClock(end),
+		})
+	}
+	err = rows.Err()
+	return
+}
+
+// UpdateWorkingHours は userId のユーザの勤務時間を置き換える関数。
+func UpdateWorkingHours(r *http.Request, userId int32, wh WorkingHours) (err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = tx.Exec(sqlUpdateTimeZone, wh.TimeZone, userId); err != nil {
+		return
+	}
+	if _, err = tx.Exec(sqlDeleteWorkingHours, userId); err != nil {
+		return
+	}
+	for _, h := range wh.Hours {
+		var start, end int
+		if start, err = parseClock(h.Start); err != nil {
+			return
+		}
+		if end, err = parseClock(h.End); err != nil {
+			return
+		}
+		if _, err = tx.Exec(sqlInsertWorkingHour, userId, h.Weekday, start, end); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// contains は t が勤務時間内であるとき true を返す関数。
+// 勤務時間が無いとき、またはタイムゾーンが読み込めないときも true を返す。
+func (wh *WorkingHours) contains(t time.Time) bool {
+	if len(wh.Hours) == 0 {
+		return true
+	}
+	if wh.TimeZone != "" {
+		loc, err := time.LoadLocation(wh.TimeZone)
+		if err != nil {
+			log.Println(err)
+			return true
+		}
+		t = t.In(loc)
+	}
+	m := t.Hour()*60 + t.Minute()
+	for _, h := range wh.Hours {
+		start, serr := parseClock(h.Start)
+		end, eerr := parseClock(h.End)
+		if serr == nil && eerr == nil && h.Weekday == int(t.Weekday()) && start <= m && m < end {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock は HH:MM 形式の時刻を 0 時からの分に変換する関数。24:00 まで変換できる。
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("Invalid time: %s", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("Invalid time: %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// formatClock は 0 時からの分を HH:MM 形式の時刻に変換する関数。
+func formatClock(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// FindTeams はチームを全件取得する関数。
+func FindTeams(r *http.Request) ([]Team, error) {
+	return findTeams(r, sqlFindTeams)
+}
+
+// FindTeamsByUserId は userId のユーザが所属しているチームを取得する関数。
+func FindTeamsByUserId(r *http.Request, userId int32) ([]Team, error) {
+	return findTeams(r, sqlFindTeamsByUserId, userId)
+}
+
+// findTeams は query でチームを取得する関数。
+func findTeams(r *http.Request, query string, args ...interface{}) (teams []Team, err error) {
+	teams = make([]Team, 0, 8)
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	for rows.Next() {
+		var t Team
+		if err = rows.Scan(&t.Id, &t.Name, &t.Created); err != nil {
+			return
+		}
+		teams = append(teams, t)
+	}
+	err = rows.Err()
+	return
+}
+
+// FindTeam は id のチームを取得する関数。無いときは ErrNotFound を返す。
+func FindTeam(r *http.Request, id int32) (t Team, err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+	err = db.QueryRow(sqlFindTeam, id).Scan(&t.Id, &t.Name, &t.Created)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+// InsertTeam はチームを登録する関数。
+func InsertTeam(r *http.Request, t Team) (Team, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return t, errors.New("DB instance not found.")
+	}
+	t.Created = time.Now()
+	rslt, err := db.Exec(sqlInsertTeam, t.Name, t.Created)
+	if err != nil {
+		return t, err
+	}
+	id, err := rslt.LastInsertId()
+	if err != nil {
+		return t, err
+	}
+	t.Id = int32(id)
+	return t, nil
+}
+
+// UpdateTeam はチームを更新する関数。
+func UpdateTeam(r *http.Request, t Team) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	_, err := db.Exec(sqlUpdateTeam, t.Name, t.Id)
+	return err
+}
+
+// DelTeam はチームとそのメンバーを削除する関数。
+// 閲覧できるユーザが変わるため、UserId が 0 の hub.TeamChanged イベントを配信する。
+func DelTeam(r *http.Request, id int32) (err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil {
+			events.Publish(hub.Event{Type: hub.TeamChanged, Timestamp: time.Now().Unix()})
+		}
+	}()
+
+	if _, err = tx.Exec(sqlDeleteTeamMembers, id); err != nil {
+		return
+	}
+	rslt, err := tx.Exec(sqlDeleteTeam, id)
+	if err != nil {
+		return
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return
+	}
+	if cnt == 0 {
+		err = ErrNotFound
+	}
+	return
+}
+
+// FindTeamMembers は id のチームに所属しているユーザを取得する関数。
+func FindTeamMembers(r *http.Request, id int32) (users []User, err error) {
+	users = make([]User, 0, 16)
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+	rows, err := db.Query(sqlFindTeamMembers, id)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	for rows.Next() {
+		var u User
+		if err = rows.Scan(&u.Id, &u.Name); err != nil {
+			return
+		}
+		u.Image = fmt.Sprint("/api/users/", u.Id, "/image")
+		users = append(users, u)
+	}
+	err = rows.Err()
+	return
+}
+
+// CheckTeamMember は userId のユーザが id のチームに所属しているか確認する関数。
+// 所属していないときは ErrNotFound を返す。
+func CheckTeamMember(r *http.Request, id, userId int32) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	var uid int32
+	err := db.QueryRow(sqlFindTeamMember, id, userId).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// InsertTeamMember は userId のユーザを id のチームに所属させる関数。
+// 閲覧できるユーザが変わるため、hub.TeamChanged イベントを配信する。ユーザが無いときは ErrNotFound を返す。
+func InsertTeamMember(r *http.Request, id, userId int32) error {
+	if err := changeTeamMember(r, sqlInsertTeamMember, id, userId); err != nil {
+		return err
+	}
+	return CheckTeamMember(r, id, userId)
+}
+
+// DelTeamMember は userId のユーザを id のチームから外す関数。
+// 閲覧できるユーザが変わるため、hub.TeamChanged イベントを配信する。
+func DelTeamMember(r *http.Request, id, userId int32) error {
+	return changeTeamMember(r, sqlDeleteTeamMember, id, userId)
+}
+
+// changeTeamMember は query でチームのメンバーを変更し、hub.TeamChanged イベントを配信する関数。
+func changeTeamMember(r *http.Request, query string, id, userId int32) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	rslt, err := db.Exec(query, id, userId)
+	if err != nil {
+		return err
+	}
+	if cnt, err := rslt.RowsAffected(); err != nil {
+		return err
+	} else if cnt > 0 {
+		events.Publish(hub.Event{Type: hub.TeamChanged, UserId: userId, Timestamp: time.Now().Unix()})
+	}
+	return nil
+}
+
+// FindVoiceChatProviders はボイスチャットのプロバイダを組み込みのもの、管理者が登録したものの順に取得する関数。
+func FindVoiceChatProviders(r *http.Request) ([]VoiceChatProvider, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return nil, errors.New("DB instance not found.")
+	}
+	custom, err := findCustomVoiceChatProviders(db)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]VoiceChatProvider, 0, len(builtinVoiceChatProviders)+len(custom)), builtinVoiceChatProviders...), custom...), nil
+}
+
+// FindVoiceChatProvider はキーが key のボイスチャットのプロバイダを取得する関数。無いときは ErrNotFound を返す。
+func FindVoiceChatProvider(r *http.Request, key string) (VoiceChatProvider, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return VoiceChatProvider{}, errors.New("DB instance not found.")
+	}
+	providers, err := findVoiceChatProviders(db)
+	if err != nil {
+		return VoiceChatProvider{}, err
+	}
+	p, ok := providers[key]
+	if !ok {
+		return VoiceChatProvider{}, ErrNotFound
+	}
+	return p, nil
+}
+
+// findCustomVoiceChatProviders は管理者が登録したボイスチャットのプロバイダを全件取得する関数。
+func findCustomVoiceChatProviders(db *sql.DB) (providers []VoiceChatProvider, err error) {
+	providers = make([]VoiceChatProvider, 0, 4)
+	rows, err := db.Query(sqlFindVoiceChatProviders)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	for rows.Next() {
+		var p VoiceChatProvider
+		if err = rows.Scan(&p.Key, &p.Name, &p.URLTemplate, &p.Pattern); err != nil {
+			return
+		}
+		providers = append(providers, p)
+	}
+	err = rows.Err()
+	return
+}
+
+// InsertVoiceChatProvider はボイスチャットのプロバイダを登録する関数。
+func InsertVoiceChatProvider(r *http.Request, p VoiceChatProvider) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	_, err := db.Exec(sqlInsertVoiceChatProvider, p.Key, p.Name, p.URLTemplate, p.Pattern)
+	return err
+}
+
+// UpdateVoiceChatProvider はボイスチャットのプロバイダを更新する関数。
+func UpdateVoiceChatProvider(r *http.Request, p VoiceChatProvider) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	_, err := db.Exec(sqlUpdateVoiceChatProvider, p.Name, p.URLTemplate, p.Pattern, p.Key)
+	return err
+}
+
+// DelVoiceChatProvider はボイスチャットのプロバイダを削除する関数。
+// そのプロバイダを設定しているユーザはそのまま残り、発信する URL が無くなる。
+func DelVoiceChatProvider(r *http.Request, key string) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	rslt, err := db.Exec(sqlDeleteVoiceChatProvider, key)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FindStatusPresets はステータスプリセットを全件取得する関数。
+func FindStatusPresets(r *http.Request) (presets []StatusPreset, err error) {
+	presets = make([]StatusPreset, 0, 8)
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+	rows, err := db.Query(sqlFindStatusPresets)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	for rows.Next() {
+		var sp StatusPreset
+		if err = rows.Scan(&sp.Key, &sp.Label, &sp.Emoji, &sp.Message, &sp.Duration, &sp.OrderNo); err != nil {
+			return
+		}
+		presets = append(presets, sp)
+	}
+	err = rows.Err()
+	return
+}
+
+// FindStatusPreset はキーが key のステータスプリセットを取得する関数。無いときは ErrNotFound を返す。
+func FindStatusPreset(r *http.Request, key string) (StatusPreset, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return StatusPreset{}, errors.New("DB instance not found.")
+	}
+	return findStatusPreset(db, key)
+}
+
+// findStatusPreset はキーが key のステータスプリセットを取得する関数。無いときは ErrNotFound を返す。
+func findStatusPreset(db *sql.DB, key string) (sp StatusPreset, err error) {
+	err = db.QueryRow(sqlFindStatusPreset, key).Scan(&sp.Key, &sp.Label, &sp.Emoji, &sp.Message, &sp.Duration, &sp.OrderNo)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+// InsertStatusPreset はステータスプリセットを登録する関数。
+func InsertStatusPreset(r *http.Request, sp StatusPreset) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	_, err := db.Exec(sqlInsertStatusPreset, sp.Key, sp.Label, sp.Emoji, sp.Message, sp.Duration, sp.OrderNo)
+	return err
+}
+
+// UpdateStatusPreset はステータスプリセットを更新する関数。
+func UpdateStatusPreset(r *http.Request, sp StatusPreset) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	_, err := db.Exec(sqlUpdateStatusPreset, sp.Label, sp.Emoji, sp.Message, sp.Duration, sp.OrderNo, sp.Key)
+	return err
+}
+
+// DelStatusPreset はステータスプリセットを削除する関数。
+// 設定済みのユーザステータスはそのまま残す。
+func DelStatusPreset(r *http.Request, key string) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	rslt, err := db.Exec(sqlDeleteStatusPreset, key)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FindStatusHistory は from 以上 to 以下に変更された userId のユーザステータスの履歴を古い順に取得する関数。
+func FindStatusHistory(r *http.Request, userId int32, from, to time.Time) ([]StatusTransition, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return nil, errors.New("DB instance not found.")
+	}
+	rows, err := db.Query(sqlFindStatusHistory, userId, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return scanTransitions(rows)
+}
+
+// FindStatusTimeline は from 以上 to 未満に変更された、userId のユーザが閲覧できる全ユーザのユーザステータスの履歴をユーザごとに古い順に取得する関数。
+// 各ユーザの from 時点のステータスとして、from より前の最後の履歴も含む。
+func FindStatusTimeline(r *http.Request, userId int32, from, to time.Time) ([]StatusTransition, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return nil, errors.New("DB instance not found.")
+	}
+	rows, err := db.Query(sqlFindStatusTimeline, userId, userId, from, to, from)
+	if err != nil {
+		return nil, err
+	}
+	return scanTransitions(rows)
+}
+
+// scanTransitions は rows からユーザステータスの履歴を読み込み、rows を閉じる関数。
+func scanTransitions(rows *sql.Rows) (ts []StatusTransition, err error) {
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	ts = make([]StatusTransition, 0, 32)
+	for rows.Next() {
+		var t StatusTransition
+		if err = rows.Scan(&t.UserId, &t.Status, &t.Preset, &t.Emoji, &t.Updated); err != nil {
+			return
+		}
+		ts = append(ts, t)
+	}
+	err = rows.Err()
+	return
+}
+
+// UpdatePasswordByRecoveryKey はパスワードを変更する関数
+func UpdatePasswordByRecoveryKey(r *http.Request, key string, passwd string) (err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	var (
+		t   time.Time
+		uid int32
+	)
+	err = tx.QueryRow(sqlFindUserPasswdRecovery, key).Scan(&uid, &t)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if t.Unix() < time.Now().Unix()-1800 {
+		err = errors.New("Recovery key was expired.")
+		log.Println(err, t.Unix(), time.Now().Unix())
+		return
+	}
+
+	err = updatePasswordById(r, tx, uid, passwd)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	_, err = tx.Exec(sqlDeleteUserPasswdRecovery, key)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// UpdatePasswordByAuthId はパスワードを変更する関数
+func UpdatePasswordByAuthId(r *http.Request, authId string, curPasswd string, newPasswd string) (err error) {
+	u, err := Authenticate(r, authId, curPasswd)
+	if err != nil {
+		log.Println(err)
+		if err == ErrUnauthorized {
+			err = ErrNotFound
+		}
+		return
+	}
+
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	err = updatePasswordById(r, tx, u.Id, newPasswd)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// updatePasswordById はパスワードを変更する関数。
+// ディレクトリで管理するユーザは users.password で認証しないため、ErrDirectoryUser を返す。
+func updatePasswordById(r *http.Request, tx *sql.Tx, id int32, passwd string) (err error) {
+	var managed bool
+	if err = tx.QueryRow(sqlIsLDAPUser, id).Scan(&managed); err != nil {
+		log.Println(err)
+		return
+	}
+	if managed {
+		log.Printf("Password change requested for LDAP user. ID: %d", id)
+		return ErrDirectoryUser
+	}
+	p, err := hashPassword(passwd)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	rslt, err := tx.Exec(sqlUpdatePasswd, p, id)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var cnt int64
+	if cnt, err = rslt.RowsAffected(); err != nil {
+		log.Println(err)
+		return
+	} else if cnt == 0 {
+		err = errors.New("Your account is deleted.")
+		log.Println(err)
+		return
+	}
+	return
+}
+
+// DelUser はユーザを削除し、削除したことをイベントとして配信する関数
+func DelUser(r *http.Request, userId int32) (err error) {
+
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil {
+			events.Publish(hub.Event{Type: hub.UserDeleted, UserId: userId, Timestamp: time.Now().Unix()})
+		}
+	}()
+
+	_, err = tx.Exec(sqlDeleteUser, userId)
+	if err != nil {
 		log.Println(err)
 		return
 	}
-	rslt, err := tx.Exec(sqlUpdatePasswd, p, id)
+	return
+}
+
+// uuid は UUID version 4 実装
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+type SystemConf struct {
+	Name string
+	URL  *url.URL
+	Mail *mail.Address
+	// DefaultTeam は管理者がチームを指定せずに作成したユーザを所属させるチームの ID。0 のときはどのチームにも所属させない
+	DefaultTeam int32
+}
+
+const (
+	// 画像をメモリに保存する
+	imageStoreMemory = "memory"
+	// 画像をディスクに保存する
+	imageStoreDisk = "disk"
+	// 画像を MySQL に保存する
+	imageStoreMySQL = "mysql"
+	// タイムラプスの画像の幅
+	timelapseWidth = 320
+	// 縮小画像の最小の幅
+	minImageWidth = 16
+	// ユーザごとの画像の有効期間の最大値 (秒)
+	maxImageTTL = 24 * 60 * 60
+	// 画像を PNG で保存する
+	imageFormatPNG = "png"
+	// 画像を JPEG で保存する
+	imageFormatJPEG = "jpeg"
+)
+
+const (
+	// 画像を加工しない
+	privacyNone = "none"
+	// 画像をぼかす
+	privacyBlur = "blur"
+	// 画像にモザイクをかける
+	privacyPixelate = "pixelate"
+	// 画像を輪郭だけにする
+	privacySilhouette = "silhouette"
+)
+
+const (
+	// 動きがある
+	presenceActive = "active"
+	// 画像は届いているが動きがない
+	presenceIdle = "idle"
+	// 長時間動きがない、または画像が届いていない
+	presenceAway = "away"
+
+	// ノックの状態。相手が DND のため届いていない
+	knockQueued = "queued"
+	// ノックの状態。届いて応答を待っている
+	knockPending = "pending"
+	// ノックの状態。受け入れられた
+	knockAccepted = "accepted"
+	// ノックの状態。後回しにされた
+	knockDeferred = "deferred"
+	// 一度に取得するノックの最大数
+	maxKnocks = 50
+	// API トークンの接頭辞
+	apiTokenPrefix = "mzm_"
+	// API トークンのランダムな部分のバイト数
+	apiTokenLength = 32
+	// API トークンの最終使用日時を更新する間隔
+	apiTokenTouchInterval = time.Minute
+	// 2 段階認証を有効にしたときに発行するリカバリコードの数
+	recoveryCodeCount = 10
+	// 2 段階認証を続けて間違えられる回数
+	maxTotpFailures = 5
+	// 2 段階認証を続けて間違えたときに受け付けない時間
+	totpLockout = 5 * time.Minute
+	// 管理者に 2 段階認証を必須にする設定の名前
+	settingRequireAdminTotp = "require_admin_totp"
+)
+
+// imageSizes はユーザ画像のサイズ名と幅の対応。0 は縮小しないことを表す
+var imageSizes = map[string]int{
+	"thumb":  160,
+	"medium": 480,
+	"full":   0,
+}
+
+// ImageConf はユーザ画像の設定
+type ImageConf struct {
+	// Store は画像の保存先。memory, disk, mysql のいずれか
+	Store string
+	// Dir は Store が disk のときの保存先ディレクトリ
+	Dir string
+	// RetentionCount はユーザごとに保持する過去の画像の最大枚数。0 のときは枚数で制限しない
+	RetentionCount int
+	// RetentionAge は過去の画像を保持する期間。0 のときは期間で制限しない
+	RetentionAge time.Duration
+	// Format は保存する画像の形式。png, jpeg のいずれか
+	Format string
+	// MaxBytes はアップロードできる画像の最大バイト数
+	MaxBytes int
+	// MaxWidth, MaxHeight はアップロードできる画像の最大の幅と高さ
+	MaxWidth, MaxHeight int
+	// FontFile は壁に名前を描く TrueType/OpenType フォントのファイル。
+	// 空のときは ASCII 文字のみのフォントを使う
+	FontFile string
+	// FontSize は壁に名前を描くフォントの大きさ (ポイント)
+	FontSize float64
+	// MotionThreshold は前回の画像との差分 (0 から 1) がこの値以上のとき動きがあったとみなす閾値
+	MotionThreshold float64
+	// IdleAfter は最後に動きがあってからこの時間が経つと idle とみなす時間
+	IdleAfter time.Duration
+	// AwayAfter は最後に動きがあってから、または最後に画像が届いてからこの時間が経つと away とみなす時間
+	AwayAfter time.Duration
+	// TTL は画像の有効期間の既定値。ユーザごとの有効期間 (User.ImageTTL) が 0 のときに使う
+	TTL time.Duration
+}
+
+// imageTTL はユーザごとの有効期間 seconds (秒) を考慮した画像の有効期間を返す関数。
+func (cnf *ImageConf) imageTTL(seconds int32) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return cnf.TTL
+}
+
+// CalendarConf はカレンダーの設定
+type CalendarConf struct {
+	// AllowFile が true のときは file:// の URL のカレンダーを読み込める。
+	// サーバ上のファイルを読めるので、テスト用途以外では有効にしない
+	AllowFile bool
+	// AllowPrivate が true のときはループバックやプライベートアドレスの URL のカレンダーも読み込める。
+	// サーバから内部のネットワークにリクエストさせられるので、信頼できるユーザのみのときに有効にする
+	AllowPrivate bool
+	// Refresh は URL のカレンダーを読み込み直す間隔
+	Refresh time.Duration
+	// MaxBytes はカレンダーの最大バイト数
+	MaxBytes int
+}
+
+// OIDCConf は OpenID Connect でログインするための設定
+type OIDCConf struct {
+	// Issuer は ID プロバイダの Issuer URL。空のときは OpenID Connect でログインできない
+	Issuer string
+	// ClientID と ClientSecret は ID プロバイダに登録したクライアントの ID とシークレット
+	ClientID     string
+	ClientSecret string
+	// RedirectURL は ID プロバイダに登録したリダイレクト URL。/api/auth/oidc/callback を指す
+	RedirectURL string
+	// Claim はユーザを対応付けるクレーム。sub または email
+	Claim string
+	// LinkEmail が true のときは、sub で対応付けるユーザがいなければ、確認済みのメールアドレスが同じユーザに対応付ける。
+	// 管理者には対応付けない
+	LinkEmail bool
+	// Provision が true のときは、対応するユーザがいなければ作成する
+	Provision bool
+	// DefaultRole は作成したユーザのロール
+	DefaultRole string
+	// DefaultTeam は作成したユーザを所属させるチームの ID。0 のときはどのチームにも所属させない
+	DefaultTeam int32
+}
+
+// LDAPConf は LDAP サーバで認証するための設定
+type LDAPConf struct {
+	// URL は LDAP サーバの URL。ldap:// または ldaps://。空のときは LDAP で認証しない
+	URL string
+	// StartTLS が true のときは、接続してから StartTLS で暗号化する
+	StartTLS bool
+	// BindDN と BindPassword はユーザを検索するときにバインドする DN とパスワード
+	BindDN       string
+	BindPassword string
+	// UserDN はユーザの DN のテンプレート。{username} をログイン ID に置き換える。空のときは BaseDN 以下を UserFilter で検索する
+	UserDN string
+	// BaseDN はユーザを検索する DN
+	BaseDN string
+	// UserFilter はユーザを検索するフィルタ。{username} をログイン ID に置き換える。同期するときは * に置き換える
+	UserFilter string
+	// AuthIdAttr, NameAttr, EmailAttr はログイン ID、名前、メールアドレスの属性
+	AuthIdAttr string
+	NameAttr   string
+	EmailAttr  string
+	// GroupAttr は所属しているグループの DN の属性
+	GroupAttr string
+	// AdminGroups と EditorGroups は admin と editor のロールにするグループの DN。
+	// どちらも空のときは全員を editor とし、どちらかがあるときはどのグループにも所属していないユーザを認証しない
+	AdminGroups  []string
+	EditorGroups []string
+	// SyncInterval はユーザを同期する間隔。0 のときは同期しない
+	SyncInterval time.Duration
+	// DefaultTeam は作成したユーザを所属させるチームの ID。0 のときはどのチームにも所属させない
+	DefaultTeam int32
+	// AdoptLocal が true のときは、同じログイン ID のローカルのユーザをディレクトリで管理するユーザにする。
+	// そのユーザのロールはディレクトリに合わせ、ローカルのパスワードではログインできなくなる
+	AdoptLocal bool
+}
+
+// FindCalendar は userId のユーザのカレンダーを取得する関数。無いときは ErrNotFound を返す。
+func FindCalendar(r *http.Request, userId int32) (UserCalendar, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return UserCalendar{}, errors.New("DB instance not found.")
+	}
+	var c UserCalendar
+	err := db.QueryRow(sqlFindCalendar, userId).Scan(&c.UserId, &c.URL, &c.data, &c.Fetched, &c.applied)
+	if err == sql.ErrNoRows {
+		return c, ErrNotFound
+	}
+	return c, err
+}
+
+// UpsertCalendar は userId のユーザのカレンダーを登録または置き換える関数。
+// url はアップロードしたときは空、data はカレンダーのデータ。
+func UpsertCalendar(r *http.Request, userId int32, url string, data []byte) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	now := time.Now()
+	_, err := db.Exec(sqlUpsertCalendar, userId, url, data, now, url, data, now)
+	return err
+}
+
+// DelCalendar は userId のユーザのカレンダーを削除する関数。
+// カレンダーから設定したユーザステータスはそのまま残す。
+func DelCalendar(r *http.Request, userId int32) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	rslt, err := db.Exec(sqlDeleteCalendar, userId)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateDnd は userId のユーザの DND を更新し、変更をイベントとして配信する関数。
+// DND をやめたときは、DND の間に届かなかったノックを届ける。
+func UpdateDnd(r *http.Request, userId int32, dnd bool) (err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	// 届けるノックの ID と送ったユーザの ID
+	delivered := make(map[int64]int32)
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil {
+			events.Publish(hub.Event{Type: hub.Status, UserId: userId, Timestamp: now.Unix()})
+			for _, from := range delivered {
+				events.Publish(hub.Event{Type: hub.Knock, UserId: from, To: userId, Timestamp: now.Unix()})
+			}
+		}
+	}()
+
+	if _, err = tx.Exec(sqlUpsertDnd, userId, now, dnd, dnd); err != nil {
+		return
+	}
+	if dnd {
+		return
+	}
+	rows, err := tx.Query(sqlFindQueuedKnocks, userId)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var (
+			id   int64
+			from int32
+		)
+		if err = rows.Scan(&id, &from); err != nil {
+			rows.Close()
+			return
+		}
+		delivered[id] = from
+	}
+	if err = rows.Close(); err != nil {
+		return
+	}
+	_, err = tx.Exec(sqlDeliverKnocks, now, userId)
+	return
+}
+
+// InsertKnock は fromUserId のユーザから toUserId のユーザへのノックを登録する関数。
+// 相手が DND のときは DND をやめるまで届けない。届けたときは相手宛てのイベントとして配信する。
+func InsertKnock(r *http.Request, fromUserId, toUserId int32, message string) (k Knock, err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil && k.State == knockPending {
+			events.Publish(hub.Event{Type: hub.Knock, UserId: fromUserId, To: toUserId, Timestamp: now.Unix()})
+		}
+	}()
+
+	var dnd bool
+	if err = tx.QueryRow(sqlFindDnd, toUserId).Scan(&dnd); err == sql.ErrNoRows {
+		err = nil
+	} else if err != nil {
+		return
+	}
+	k = Knock{
+		FromUserId: fromUserId,
+		ToUserId:   toUserId,
+		Message:    message,
+		State:      knockPending,
+		Created:    now,
+		Delivered:  &now,
+	}
+	if dnd {
+		k.State = knockQueued
+		k.Delivered = nil
+	}
+	rslt, err := tx.Exec(sqlInsertKnock, k.FromUserId, k.ToUserId, k.Message, k.State, k.Created, k.Delivered)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	var cnt int64
-	if cnt, err = rslt.RowsAffected(); err != nil {
-		log.Println(err)
+	k.Id, err = rslt.LastInsertId()
+	return
+}
+
+// FindReceivedKnocks は userId のユーザに届いたノックを新しい順に取得する関数。
+func FindReceivedKnocks(r *http.Request, userId int32) ([]Knock, error) {
+	return findKnocks(r, sqlFindReceivedKnocks, userId)
+}
+
+// FindSentKnocks は userId のユーザが送ったノックを新しい順に取得する関数。
+func FindSentKnocks(r *http.Request, userId int32) ([]Knock, error) {
+	return findKnocks(r, sqlFindSentKnocks, userId)
+}
+
+// findKnocks は query でノックを最大 maxKnocks 件取得する関数。
+func findKnocks(r *http.Request, query string, userId int32) (knocks []Knock, err error) {
+	knocks = make([]Knock, 0, 16)
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
 		return
-	} else if cnt == 0 {
-		err = errors.New("Your account is deleted.")
-		log.Println(err)
+	}
+	rows, err := db.Query(query, userId, maxKnocks)
+	if err != nil {
 		return
 	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	for rows.Next() {
+		var k Knock
+		err = rows.Scan(&k.Id, &k.FromUserId, &k.FromName, &k.ToUserId, &k.ToName, &k.Message, &k.State, &k.VoiceChatID, &k.Created, &k.Delivered, &k.Responded)
+		if err != nil {
+			return
+		}
+		knocks = append(knocks, k)
+	}
+	err = rows.Err()
 	return
 }
 
-// DelUser はユーザを削除する関数
-func DelUser(r *http.Request, userId int32) (err error) {
+// AnswerKnock は userId のユーザに届いたノックに state (accepted または deferred) で応答する関数。
+// 応答したことを送ったユーザ宛てのイベントとして配信する。応答できるノックが無いときは ErrNotFound を返す。
+func AnswerKnock(r *http.Request, userId int32, id int64, state string) (err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	var from int32
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil {
+			events.Publish(hub.Event{Type: hub.KnockAnswered, UserId: userId, To: from, Timestamp: now.Unix()})
+		}
+	}()
+
+	err = tx.QueryRow(sqlFindKnockToAnswer, id, userId).Scan(&from)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+		return
+	} else if err != nil {
+		return
+	}
+	_, err = tx.Exec(sqlAnswerKnock, state, now, id)
+	return
+}
+
+// FindTotpStatus は userId のユーザの 2 段階認証の状態を取得する関数。
+func FindTotpStatus(r *http.Request, userId int32) (ts TotpStatus, err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+	var cnt int
+	if err = db.QueryRow(sqlFindTotpEnabled, userId).Scan(&cnt); err != nil {
+		return
+	}
+	ts.Enabled = cnt > 0
+	if ts.Enabled {
+		err = db.QueryRow(sqlCountRecoveryCodes, userId).Scan(&ts.RecoveryCodesLeft)
+	}
+	return
+}
+
+// EnrollTotp は userId のユーザの 2 段階認証の秘密鍵を生成して登録する関数。
+// ConfirmTotp で確認するまで 2 段階認証は有効にならない。
+func EnrollTotp(r *http.Request, userId int32) (string, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return "", errors.New("DB instance not found.")
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if _, err = db.Exec(sqlUpsertTotp, userId, secret, now, secret, now); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
 
+// ConfirmTotp は認証アプリのコード code を確認して userId のユーザの 2 段階認証を有効にし、リカバリコードを発行する関数。
+// 登録中の秘密鍵が無いときは ErrNotFound を、コードが正しくないときは ErrTotpInvalid を返す。
+// リカバリコードは平文では保存しないため、このときにのみ返す。
+func ConfirmTotp(r *http.Request, userId int32, code string) (codes []string, err error) {
 	db, ok := context.Get(r, dbkey).(*sql.DB)
 	if !ok {
 		err = errors.New("DB instance not found.")
@@ -674,28 +2591,325 @@ func DelUser(r *http.Request, userId int32) (err error) {
 		}
 	}()
 
-	_, err = tx.Exec(sqlDeleteUser, userId)
+	var (
+		secret    string
+		confirmed *time.Time
+		lastStep  int64
+		failures  int
+		failed    *time.Time
+	)
+	err = tx.QueryRow(sqlFindTotp, userId).Scan(&secret, &confirmed, &lastStep, &failures, &failed)
+	if err == sql.ErrNoRows || err == nil && confirmed != nil {
+		err = ErrNotFound
+		return
+	} else if err != nil {
+		return
+	}
+	now := time.Now()
+	step, valid := totp.Validate(secret, code, now)
+	if !valid {
+		err = ErrTotpInvalid
+		return
+	}
+	if _, err = tx.Exec(sqlConfirmTotp, now, step, userId); err != nil {
+		return
+	}
+	codes, err = insertRecoveryCodes(tx, userId, now)
+	return
+}
+
+// insertRecoveryCodes は userId のユーザのリカバリコードを発行し直す関数。
+func insertRecoveryCodes(tx *sql.Tx, userId int32, now time.Time) ([]string, error) {
+	if _, err := tx.Exec(sqlDeleteRecoveryCodes, userId); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec(sqlInsertRecoveryCode, userId, hashRecoveryCode(code), now); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// VerifyTotp は userId のユーザの認証アプリのコードまたはリカバリコード code を確認する関数。
+// リカバリコードは一度しか使えず、認証アプリのコードも同じものは一度しか使えない。
+// 2 段階認証が有効でないときは ErrNotFound を、正しくないときは ErrTotpInvalid を返す。
+// maxTotpFailures 回続けて間違えると、totpLockout の間は ErrTotpLocked を返す。
+func VerifyTotp(r *http.Request, userId int32, code string) (err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		log.Println(err)
 		return
 	}
+	// 間違えた回数を記録するため、コードが正しくないときもコミットする
+	valid := false
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil && !valid {
+			err = ErrTotpInvalid
+		}
+	}()
+
+	var (
+		secret    string
+		confirmed *time.Time
+		lastStep  int64
+		failures  int
+		failed    *time.Time
+	)
+	err = tx.QueryRow(sqlFindTotp, userId).Scan(&secret, &confirmed, &lastStep, &failures, &failed)
+	if err == sql.ErrNoRows || err == nil && confirmed == nil {
+		err = ErrNotFound
+		return
+	} else if err != nil {
+		return
+	}
+	now := time.Now()
+	if failures >= maxTotpFailures && failed != nil && failed.After(now.Add(-totpLockout)) {
+		err = ErrTotpLocked
+		return
+	}
+
+	step, valid := totp.Validate(secret, code, now)
+	if valid && step <= lastStep {
+		// 使用済みのコード
+		valid = false
+	}
+	if !valid && len(code) > totp.Digits {
+		var rslt sql.Result
+		if rslt, err = tx.Exec(sqlUseRecoveryCode, now, userId, hashRecoveryCode(code)); err != nil {
+			return
+		}
+		var cnt int64
+		if cnt, err = rslt.RowsAffected(); err != nil {
+			return
+		}
+		valid, step = cnt > 0, lastStep
+	}
+	if valid {
+		_, err = tx.Exec(sqlUpdateTotpSuccess, step, userId)
+	} else {
+		_, err = tx.Exec(sqlUpdateTotpFailure, now, userId)
+	}
 	return
 }
 
-// uuid は UUID version 4 実装
-func uuid() (string, error) {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
+// DisableTotp は userId のユーザの 2 段階認証を無効にし、リカバリコードを削除する関数。
+func DisableTotp(r *http.Request, userId int32) (err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+
+	if _, err = tx.Exec(sqlDeleteRecoveryCodes, userId); err != nil {
+		return
+	}
+	_, err = tx.Exec(sqlDeleteTotp, userId)
+	return
+}
+
+// generateRecoveryCode は xxxxx-xxxxx 形式のリカバリコードを生成する関数。
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	b[6] = (b[6] & 0x0f) | 0x40
-	b[8] = (b[8] & 0x3f) | 0x80
-	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	// 紛らわしい l, o, 0, 1 を除いた 32 文字
+	const chars = "abcdefghijkmnpqrstuvwxyz23456789"
+	code := make([]byte, 0, 11)
+	for i, c := range b {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		code = append(code, chars[int(c)%len(chars)])
+	}
+	return string(code), nil
 }
 
-type SystemConf struct {
-	Name string
-	URL  *url.URL
-	Mail *mail.Address
+// hashRecoveryCode はリカバリコードを保存する形式にする関数。
+// リカバリコードは十分に長いランダムな文字列のため、ソルト無しの SHA-256 とする。
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(code)))
+}
+
+// FindSecuritySettings はセキュリティに関するシステムの設定を取得する関数。
+func FindSecuritySettings(r *http.Request) (s SecuritySettings, err error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+	var v string
+	err = db.QueryRow(sqlFindSetting, settingRequireAdminTotp).Scan(&v)
+	switch {
+	case err == sql.ErrNoRows:
+		err = nil
+	case err == nil:
+		s.RequireAdminTotp = v == "true"
+	}
+	return
+}
+
+// UpdateSecuritySettings はセキュリティに関するシステムの設定を更新する関数。
+func UpdateSecuritySettings(r *http.Request, s SecuritySettings) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	v := fmt.Sprint(s.RequireAdminTotp)
+	_, err := db.Exec(sqlUpsertSetting, settingRequireAdminTotp, v, v)
+	return err
+}
+
+// FindAPITokens は userId のユーザが発行した API トークンを新しい順に取得する関数。
+func FindAPITokens(r *http.Request, userId int32) (tokens []APIToken, err error) {
+	tokens = make([]APIToken, 0, 4)
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		err = errors.New("DB instance not found.")
+		return
+	}
+	rows, err := db.Query(sqlFindAPITokens, userId)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	for rows.Next() {
+		var (
+			t      APIToken
+			scopes string
+		)
+		if err = rows.Scan(&t.Id, &t.Name, &t.Prefix, &scopes, &t.ExpiresAt, &t.LastUsed, &t.Created); err != nil {
+			return
+		}
+		t.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, t)
+	}
+	err = rows.Err()
+	return
+}
+
+// InsertAPIToken は userId のユーザの API トークンを発行する関数。
+// 返す APIToken の Token にのみ平文のトークンを設定する。
+func InsertAPIToken(r *http.Request, userId int32, t APIToken) (APIToken, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return t, errors.New("DB instance not found.")
+	}
+	b := make([]byte, apiTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return t, err
+	}
+	t.Token = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	t.Prefix = t.Token[:len(apiTokenPrefix)+6]
+	t.Created = time.Now()
+	t.LastUsed = nil
+	rslt, err := db.Exec(sqlInsertAPIToken, userId, t.Name, hashAPIToken(t.Token), t.Prefix, strings.Join(t.Scopes, " "), t.ExpiresAt, t.Created)
+	if err != nil {
+		return t, err
+	}
+	t.Id, err = rslt.LastInsertId()
+	return t, err
+}
+
+// DelAPIToken は userId のユーザが発行した id の API トークンを削除する関数。
+func DelAPIToken(r *http.Request, userId int32, id int64) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	rslt, err := db.Exec(sqlDeleteAPIToken, id, userId)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AuthenticateAPIToken は API トークンで認証する関数。
+// 認証成功時、トークンを発行したユーザの情報とトークンの ID、スコープ、有効期限を返し、トークンの最終使用日時を更新する。
+// トークンが無い、期限切れ、またはユーザが削除されたときは ErrUnauthorized を返す。
+func AuthenticateAPIToken(r *http.Request, token string) (User, APIToken, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return User{}, APIToken{}, errors.New("DB instance not found.")
+	}
+	var (
+		t      APIToken
+		scopes string
+		u      User
+	)
+	now := time.Now()
+	err := db.QueryRow(sqlFindUserByAPIToken, hashAPIToken(token), now).Scan(&t.Id, &scopes, &t.ExpiresAt, &u.Id, &u.AuthId, &u.Name, &u.VoiceChatID, &u.Role, &u.Email, &u.Created)
+	switch {
+	case err == sql.ErrNoRows:
+		log.Println("Invalid API token.")
+		return User{}, APIToken{}, ErrUnauthorized
+	case err != nil:
+		return User{}, APIToken{}, err
+	}
+	u.Image = fmt.Sprint("/api/users/", u.Id, "/image")
+	t.Scopes = strings.Fields(scopes)
+	if _, err = db.Exec(sqlUpdateAPITokenLastUsed, now, t.Id, now.Add(-apiTokenTouchInterval)); err != nil {
+		// 最終使用日時は目安のため、更新できなくても認証する
+		log.Println(err)
+	}
+	return u, t, nil
+}
+
+// CheckAPIToken は id の API トークンがまだ有効か確認する関数。
+// 期限切れ、削除済み、またはユーザが削除されたときは ErrUnauthorized を返す。
+func CheckAPIToken(r *http.Request, id int64) error {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return errors.New("DB instance not found.")
+	}
+	var cnt int
+	if err := db.QueryRow(sqlCountValidAPIToken, id, time.Now()).Scan(&cnt); err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// hashAPIToken は API トークンを保存する形式にする関数。
+// トークンは十分に長いランダムな文字列のため、ソルト無しの SHA-256 とする。
+func hashAPIToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
 }
@@ -0,0 +1,11 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `user_images` DROP PRIMARY KEY, ADD PRIMARY KEY (`user_id`, `captured`);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DELETE i FROM `user_images` i INNER JOIN `user_images` n ON i.`user_id` = n.`user_id` AND i.`captured` < n.`captured`;
+ALTER TABLE `user_images` DROP PRIMARY KEY, ADD PRIMARY KEY (`user_id`);
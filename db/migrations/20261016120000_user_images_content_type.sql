@@ -0,0 +1,10 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `user_images` ADD COLUMN `content_type` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'image/png';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE `user_images` DROP COLUMN `content_type`;
@@ -0,0 +1,10 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `users` ADD COLUMN `privacy` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'none';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE `users` DROP COLUMN `privacy`;
@@ -0,0 +1,16 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE `user_presence` (
+  `user_id` int(11) NOT NULL,
+  `presence` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `motion_at` datetime DEFAULT NULL,
+  `updated` datetime NOT NULL,
+  PRIMARY KEY (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE `user_presence`;
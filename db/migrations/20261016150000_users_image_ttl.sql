@@ -0,0 +1,10 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `users` ADD COLUMN `image_ttl` int(11) NOT NULL DEFAULT '0';
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE `users` DROP COLUMN `image_ttl`;
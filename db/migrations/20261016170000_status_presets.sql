@@ -0,0 +1,37 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE `status_presets` (
+  `preset_key` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `label` varchar(191) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `emoji` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  `message` varchar(191) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  `duration` int(11) NOT NULL DEFAULT 0,
+  `order_no` int(11) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`preset_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+INSERT INTO `status_presets` (`preset_key`, `label`, `emoji`, `message`, `duration`, `order_no`) VALUES
+  ('meeting', 'Meeting', '📅', 'In a meeting', 3600, 1),
+  ('lunch', 'Lunch', '🍱', 'Out for lunch', 3600, 2),
+  ('focus', 'Focus', '🎧', 'Focusing', 7200, 3),
+  ('away', 'Away', '🚶', 'Away', 0, 4);
+
+ALTER TABLE `user_status`
+  ADD COLUMN `preset` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' AFTER `status`,
+  ADD COLUMN `emoji` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' AFTER `preset`,
+  ADD COLUMN `expires` datetime DEFAULT NULL AFTER `emoji`,
+  ADD KEY `user_status_expires` (`expires`);
+
+ALTER TABLE `user_status_history`
+  ADD COLUMN `preset` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' AFTER `status`,
+  ADD COLUMN `emoji` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' AFTER `preset`;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE `user_status_history` DROP COLUMN `emoji`, DROP COLUMN `preset`;
+ALTER TABLE `user_status` DROP KEY `user_status_expires`, DROP COLUMN `expires`, DROP COLUMN `emoji`, DROP COLUMN `preset`;
+DROP TABLE `status_presets`;
+
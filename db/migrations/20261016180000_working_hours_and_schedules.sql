@@ -0,0 +1,35 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `users` ADD COLUMN `time_zone` varchar(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' AFTER `image_ttl`;
+
+CREATE TABLE `user_working_hours` (
+  `user_id` int(11) NOT NULL,
+  `weekday` tinyint(4) NOT NULL,
+  `start_minute` smallint(6) NOT NULL,
+  `end_minute` smallint(6) NOT NULL,
+  PRIMARY KEY (`user_id`, `weekday`, `start_minute`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE `scheduled_statuses` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `status` varchar(191) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `preset` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  `emoji` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  `starts` datetime NOT NULL,
+  `ends` datetime DEFAULT NULL,
+  `applied` tinyint(1) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`id`),
+  KEY `scheduled_statuses_applied_starts` (`applied`, `starts`),
+  KEY `scheduled_statuses_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE `scheduled_statuses`;
+DROP TABLE `user_working_hours`;
+ALTER TABLE `users` DROP COLUMN `time_zone`;
+
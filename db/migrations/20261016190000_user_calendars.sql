@@ -0,0 +1,18 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+CREATE TABLE `user_calendars` (
+  `user_id` int(11) NOT NULL,
+  `url` varchar(1024) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  `data` mediumtext COLLATE utf8mb4_unicode_ci NOT NULL,
+  `fetched` datetime DEFAULT NULL,
+  `applied` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  PRIMARY KEY (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE `user_calendars`;
+
@@ -0,0 +1,26 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `user_status` ADD COLUMN `dnd` tinyint(1) NOT NULL DEFAULT '0' AFTER `expires`;
+
+CREATE TABLE `knocks` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `from_user_id` int(11) NOT NULL,
+  `to_user_id` int(11) NOT NULL,
+  `message` varchar(191) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  `state` varchar(16) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `created` datetime NOT NULL,
+  `delivered` datetime DEFAULT NULL,
+  `responded` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `knocks_to_user_id_state` (`to_user_id`, `state`),
+  KEY `knocks_from_user_id` (`from_user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE `knocks`;
+ALTER TABLE `user_status` DROP COLUMN `dnd`;
+
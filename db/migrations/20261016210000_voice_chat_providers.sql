@@ -0,0 +1,19 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `users` ADD COLUMN `voice_chat_provider` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'skype' AFTER `voice_chat_id`;
+
+CREATE TABLE `voice_chat_providers` (
+  `provider_key` varchar(32) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `name` varchar(191) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `url_template` varchar(512) COLLATE utf8mb4_unicode_ci NOT NULL,
+  `id_pattern` varchar(191) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '',
+  PRIMARY KEY (`provider_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+DROP TABLE `voice_chat_providers`;
+ALTER TABLE `users` DROP COLUMN `voice_chat_provider`;
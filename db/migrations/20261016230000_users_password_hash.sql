@@ -0,0 +1,10 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+ALTER TABLE `users` MODIFY COLUMN `password` varchar(255) COLLATE utf8mb4_unicode_ci NOT NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE `users` MODIFY COLUMN `password` char(128) COLLATE utf8mb4_unicode_ci NOT NULL;
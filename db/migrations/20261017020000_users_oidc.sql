@@ -0,0 +1,17 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- sub は大文字と小文字を区別するため ascii_bin とする
+ALTER TABLE `users`
+  ADD COLUMN `oidc_issuer` varchar(255) CHARACTER SET ascii COLLATE ascii_bin DEFAULT NULL,
+  ADD COLUMN `oidc_subject` varchar(255) CHARACTER SET ascii COLLATE ascii_bin DEFAULT NULL,
+  ADD UNIQUE KEY `users_oidc` (`oidc_issuer`, `oidc_subject`);
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE `users`
+  DROP KEY `users_oidc`,
+  DROP COLUMN `oidc_subject`,
+  DROP COLUMN `oidc_issuer`;
@@ -0,0 +1,13 @@
+
+-- +goose Up
+-- SQL in section 'Up' is executed when this migration is applied
+
+-- ディレクトリで管理するユーザのエントリの DN。NULL のユーザはデータベースのパスワードで認証する
+ALTER TABLE `users`
+  ADD COLUMN `ldap_dn` varchar(1024) COLLATE utf8mb4_unicode_ci DEFAULT NULL;
+
+-- +goose Down
+-- SQL section 'Down' is executed when this migration is rolled back
+
+ALTER TABLE `users`
+  DROP COLUMN `ldap_dn`;
@@ -0,0 +1,449 @@
+package mizumanju
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcie001/mizumanju/imgmap"
+	"github.com/marcie001/mizumanju/totp"
+)
+
+// fakeQuery は fakeDB が SQL に返す結果。
+// rows は SELECT の結果の行、affected と lastId は更新系の SQL の結果。
+// rowsErr は rows を読み終えたときに io.EOF の代わりに返すエラー。
+type fakeQuery struct {
+	rows     [][]driver.Value
+	affected int64
+	lastId   int64
+	err      error
+	rowsErr  error
+}
+
+// fakeExec は fakeDB が受け取った SQL と引数。
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+// fakeDB はテストでデータベースの代わりにするドライバ。
+// handler が SQL ごとの結果を返し、受け取った SQL は execs に記録する。
+type fakeDB struct {
+	sync.Mutex
+	handler func(query string, args []driver.Value) fakeQuery
+	execs   []fakeExec
+}
+
+var (
+	fakeDriver     = &fakeDB{}
+	fakeDriverOnce sync.Once
+)
+
+// openFakeDB は queries で SQL に応える *sql.DB を返す関数。
+// queries に無い SQL はエラーにし、テストを失敗させる。
+func openFakeDB(t *testing.T, queries map[string]func(args []driver.Value) fakeQuery) *sql.DB {
+	fakeDriverOnce.Do(func() { sql.Register("fake", fakeDriver) })
+	fakeDriver.Lock()
+	fakeDriver.execs = nil
+	fakeDriver.handler = func(query string, args []driver.Value) fakeQuery {
+		if f, ok := queries[query]; ok {
+			return f(args)
+		}
+		t.Errorf("unexpected query: %s", query)
+		return fakeQuery{err: fmt.Errorf("unexpected query: %s", query)}
+	}
+	fakeDriver.Unlock()
+	db, err := sql.Open("fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// fakeRow は 1 行を返す fakeQuery を返す関数。
+func fakeRow(vals ...driver.Value) func([]driver.Value) fakeQuery {
+	return func([]driver.Value) fakeQuery {
+		return fakeQuery{rows: [][]driver.Value{vals}}
+	}
+}
+
+// fakeNoRows は行を返さない fakeQuery を返す関数。
+func fakeNoRows(args []driver.Value) fakeQuery {
+	return fakeQuery{}
+}
+
+// fakeAffected は affected 行を更新した fakeQuery を返す関数。
+func fakeAffected(affected int64) func([]driver.Value) fakeQuery {
+	return func([]driver.Value) fakeQuery {
+		return fakeQuery{affected: affected}
+	}
+}
+
+// executed は query を実行したときの引数を返す関数。
+func (d *fakeDB) executed(query string) ([]driver.Value, bool) {
+	d.Lock()
+	defer d.Unlock()
+	for _, e := range d.execs {
+		if e.query == query {
+			return e.args, true
+		}
+	}
+	return nil, false
+}
+
+func (d *fakeDB) run(query string, args []driver.Value) fakeQuery {
+	d.Lock()
+	d.execs = append(d.execs, fakeExec{query, args})
+	h := d.handler
+	d.Unlock()
+	return h(query, args)
+}
+
+func (d *fakeDB) Open(name string) (driver.Conn, error) {
+	return fakeConn{d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDB
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.d, query}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error {
+	return nil
+}
+
+func (fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	d     *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	q := s.d.run(s.query, args)
+	if q.err != nil {
+		return nil, q.err
+	}
+	return fakeResult{q}, nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	q := s.d.run(s.query, args)
+	if q.err != nil {
+		return nil, q.err
+	}
+	return &fakeRows{rows: q.rows, err: q.rowsErr}, nil
+}
+
+type fakeResult struct {
+	q fakeQuery
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.q.lastId, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.q.affected, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	i    int
+	err  error
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
+
+func TestVerifyTotp(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	step := totp.Step(now)
+	code, err := totp.Code(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, _ := totp.Code(secret, step-10)
+
+	tests := []struct {
+		name string
+		code string
+		// row は user_totp の secret, confirmed, last_step, failures, failed
+		row      []driver.Value
+		recovery int64
+		want     error
+		wantExec string
+	}{
+		{"valid code", code, []driver.Value{secret, now, step - 5, int64(0), nil}, 0, nil, sqlUpdateTotpSuccess},
+		{"wrong code", wrong, []driver.Value{secret, now, int64(0), int64(0), nil}, 0, ErrTotpInvalid, sqlUpdateTotpFailure},
+		{"replayed code", code, []driver.Value{secret, now, step, int64(0), nil}, 0, ErrTotpInvalid, sqlUpdateTotpFailure},
+		{"recovery code", "abcde-fghij", []driver.Value{secret, now, step - 5, int64(0), nil}, 1, nil, sqlUpdateTotpSuccess},
+		{"used recovery code", "abcde-fghij", []driver.Value{secret, now, step - 5, int64(0), nil}, 0, ErrTotpInvalid, sqlUpdateTotpFailure},
+		{"locked", code, []driver.Value{secret, now, int64(0), int64(maxTotpFailures), now.Add(-time.Minute)}, 0, ErrTotpLocked, ""},
+		{"lockout expired", code, []driver.Value{secret, now, int64(0), int64(maxTotpFailures), now.Add(-totpLockout - time.Minute)}, 0, nil, sqlUpdateTotpSuccess},
+		{"not confirmed", code, []driver.Value{secret, nil, int64(0), int64(0), nil}, 0, ErrNotFound, ""},
+		{"not enrolled", code, nil, 0, ErrNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := fakeNoRows
+			if tt.row != nil {
+				row = fakeRow(tt.row...)
+			}
+			db := openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindTotp:          row,
+				sqlUseRecoveryCode:   fakeAffected(tt.recovery),
+				sqlUpdateTotpSuccess: fakeAffected(1),
+				sqlUpdateTotpFailure: fakeAffected(1),
+			})
+			defer db.Close()
+			r := httptest.NewRequest("POST", "/api/login/totp", nil)
+			SetDB(r, db)
+
+			if err := VerifyTotp(r, 1, tt.code); err != tt.want {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			for _, q := range []string{sqlUpdateTotpSuccess, sqlUpdateTotpFailure} {
+				if _, ok := fakeDriver.executed(q); ok != (q == tt.wantExec) {
+					t.Errorf("executed %s = %v", q, ok)
+				}
+			}
+			if args, ok := fakeDriver.executed(sqlUpdateTotpSuccess); ok && tt.recovery > 0 && args[0] != step-5 {
+				// リカバリコードでは最後に使ったステップを変えない
+				t.Errorf("last step = %v, want %d", args[0], step-5)
+			}
+		})
+	}
+}
+
+func TestApplyScheduledStatuses(t *testing.T) {
+	now := time.Now()
+	db := openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+		sqlFindDueScheduledStatuses: func([]driver.Value) fakeQuery {
+			return fakeQuery{rows: [][]driver.Value{
+				{int64(1), int64(1), "Lunch", "", "", now.Add(-time.Minute), nil, false},
+				{int64(2), int64(2), "Lunch", "", "", now.Add(-time.Minute), nil, false},
+				{int64(3), int64(3), "Lunch", "", "", now.Add(-time.Minute), nil, false},
+			}}
+		},
+		// 1 は他のサーバが適用済み
+		sqlUpdateScheduledStatusApplied: func(args []driver.Value) fakeQuery {
+			if args[0] == int64(1) {
+				return fakeQuery{affected: 0}
+			}
+			return fakeQuery{affected: 1}
+		},
+		// 2 はステータスを更新できない
+		sqlUpdateUserStatus: func(args []driver.Value) fakeQuery {
+			if args[0] == int64(2) {
+				return fakeQuery{err: fmt.Errorf("update failed")}
+			}
+			return fakeQuery{affected: 1}
+		},
+		sqlInsertStatusHistory: fakeAffected(1),
+	})
+	defer db.Close()
+
+	if err := ApplyScheduledStatuses(db, now); err != nil {
+		t.Fatal(err)
+	}
+	fakeDriver.Lock()
+	defer fakeDriver.Unlock()
+	updated := make([]driver.Value, 0, 3)
+	for _, e := range fakeDriver.execs {
+		if e.query == sqlInsertStatusHistory {
+			updated = append(updated, e.args[0])
+		}
+	}
+	// 適用できなかったものがあっても、後のものは適用する
+	if len(updated) != 1 || updated[0] != int64(3) {
+		t.Errorf("history inserted for %v, want [3]", updated)
+	}
+}
+
+func TestSaveImageContentType(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{imageFormatPNG, "image/png"},
+		{imageFormatJPEG, "image/jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			origImages := images
+			defer func() { images = origImages }()
+			images = imgmap.New(imgmap.NewMemStore(), imgmap.Retention{})
+			db := openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindById:               fakeRow(int64(1), "User 01", "", "skype", editor, "user01", "user01@example.com", time.Now(), privacyNone, int64(0)),
+				sqlFindVoiceChatProviders: fakeNoRows,
+				sqlUpsertPresence:         fakeAffected(1),
+			})
+			defer db.Close()
+			r := httptest.NewRequest("PUT", "/api/users/me/image", nil)
+			SetDB(r, db)
+			SetImageConf(r, &ImageConf{Format: tt.format})
+
+			if err := SaveImage(r, 1, src); err != nil {
+				t.Fatal(err)
+			}
+			i, err := images.Latest(1)
+			if err != nil || i == nil {
+				t.Fatalf("Latest = %v, %v", i, err)
+			}
+			// アップロードした形式によらず、設定した形式で保存する
+			if i.ContentType != tt.want || http.DetectContentType(i.Data) != tt.want {
+				t.Errorf("content type = %s (detected %s), want %s", i.ContentType, http.DetectContentType(i.Data), tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyPresence(t *testing.T) {
+	cnf := &ImageConf{IdleAfter: 5 * time.Minute, AwayAfter: 30 * time.Minute}
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		m := now.Add(-d)
+		return &m
+	}
+	tests := []struct {
+		name     string
+		motionAt *time.Time
+		want     string
+	}{
+		{"never moved", nil, presenceAway},
+		{"just moved", ago(0), presenceActive},
+		{"before idle", ago(5*time.Minute - time.Second), presenceActive},
+		{"idle", ago(5 * time.Minute), presenceIdle},
+		{"before away", ago(30*time.Minute - time.Second), presenceIdle},
+		{"away", ago(30 * time.Minute), presenceAway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyPresence(cnf, tt.motionAt, now); got != tt.want {
+				t.Errorf("classifyPresence = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// filledPNG は幅 32、高さ 24 で c の色の PNG の imgmap.Img を返す関数。
+func filledPNG(t *testing.T, c color.Color) *imgmap.Img {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, filled(c)); err != nil {
+		t.Fatal(err)
+	}
+	return &imgmap.Img{Data: buf.Bytes(), ContentType: "image/png"}
+}
+
+// filled は幅 32、高さ 24 で c の色の画像を返す関数。
+func filled(c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestUpdatePresence(t *testing.T) {
+	img := filled(color.Black)
+	cnf := &ImageConf{MotionThreshold: 0.05, IdleAfter: 5 * time.Minute, AwayAfter: 30 * time.Minute}
+
+	tests := []struct {
+		name      string
+		prev      *imgmap.Img
+		motionAt  time.Time
+		wantQuery bool
+		want      string
+	}{
+		// 前回の画像が無いときは動きがあったとみなす
+		{"first image", nil, time.Time{}, false, presenceActive},
+		{"broken previous image", &imgmap.Img{Data: []byte("broken")}, time.Time{}, false, presenceActive},
+		{"moved", filledPNG(t, color.White), time.Time{}, false, presenceActive},
+		{"below threshold", filledPNG(t, color.Gray{0x08}), time.Now().Add(-10 * time.Minute), true, presenceIdle},
+		{"not moved for long", filledPNG(t, color.Black), time.Now().Add(-time.Hour), true, presenceAway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindMotionAt:   fakeRow(tt.motionAt),
+				sqlUpsertPresence: fakeAffected(1),
+			})
+			defer db.Close()
+			r := httptest.NewRequest("PUT", "/api/users/me/image", nil)
+			SetDB(r, db)
+			SetImageConf(r, cnf)
+
+			if err := updatePresence(r, 1, tt.prev, img); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fakeDriver.executed(sqlFindMotionAt); ok != tt.wantQuery {
+				t.Errorf("motion_at queried = %v, want %v", ok, tt.wantQuery)
+			}
+			args, ok := fakeDriver.executed(sqlUpsertPresence)
+			if !ok {
+				t.Fatal("presence not saved")
+			}
+			if args[1] != tt.want {
+				t.Errorf("presence = %v, want %s", args[1], tt.want)
+			}
+		})
+	}
+}
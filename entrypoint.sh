@@ -1,3 +1,3 @@
 #!/bin/sh
 
-goose up && mizumanju -d=$DATABASE_URL -h=$LISTEN_IP -m=$MAIL_ADDRESS -n=$NAME -p=$LISTEN_PORT -pp=$DEBUG_SERVER -sh=$SMTP_HOST -sp=$SMTP_PORT -ss=$SMTP_START_TLS -su=$SMTP_USER -sw=$SMTP_PASSWORD -u=$BASE_URL
+goose up && mizumanju -d=$DATABASE_URL -h=$LISTEN_IP -m=$MAIL_ADDRESS -n=$NAME -p=$LISTEN_PORT -pp=$DEBUG_SERVER -sh=$SMTP_HOST -sp=$SMTP_PORT -ss=$SMTP_START_TLS -su=$SMTP_USER -sw=$SMTP_PASSWORD -u=$BASE_URL -t=$DEFAULT_TEAM -is=$IMAGE_STORE -id=$IMAGE_DIR -oi="$OIDC_ISSUER" -oc="$OIDC_CLIENT_ID" -os="$OIDC_CLIENT_SECRET" -om="$OIDC_CLAIM" -ol="$OIDC_LINK_EMAIL" -op="$OIDC_PROVISION" -od="$OIDC_DEFAULT_ROLE" -ot="$OIDC_DEFAULT_TEAM" -lu="$LDAP_URL" -lt="$LDAP_START_TLS" -lb="$LDAP_BIND_DN" -lw="$LDAP_BIND_PASSWORD" -ld="$LDAP_USER_DN" -lr="$LDAP_BASE_DN" -lf="$LDAP_USER_FILTER" -la="$LDAP_AUTH_ID_ATTR" -ln="$LDAP_NAME_ATTR" -lm="$LDAP_EMAIL_ATTR" -lg="$LDAP_GROUP_ATTR" -lga="$LDAP_ADMIN_GROUPS" -lge="$LDAP_EDITOR_GROUPS" -ls="$LDAP_SYNC_INTERVAL" -lte="$LDAP_DEFAULT_TEAM" -lo="$LDAP_ADOPT_LOCAL"
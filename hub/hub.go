@@ -0,0 +1,129 @@
+// パッケージ hub はプロセス内でイベントを購読者に配信するパッケージ。
+// 新しいハブを生成し、イベントの購読、配信を行うサンプル。
+//     h := hub.New()
+//     sub := h.Subscribe()
+//     defer sub.Close()
+//     h.Publish(hub.Event{Type: hub.Frame, UserId: 1})
+//     e := <-sub.C
+package hub
+
+import (
+	"log"
+	"sync"
+)
+
+const (
+	// Frame はユーザ画像が更新されたことを表すイベントの種類
+	Frame = "frame"
+	// Status はユーザステータスが変更されたことを表すイベントの種類
+	Status = "status"
+	// UserAdded はユーザが追加されたことを表すイベントの種類
+	UserAdded = "userAdded"
+	// UserDeleted はユーザが削除されたことを表すイベントの種類
+	UserDeleted = "userDeleted"
+	// TeamChanged はチームのメンバーが変更されたことを表すイベントの種類。UserId が 0 のときはチームが削除されたことを表す
+	TeamChanged = "teamChanged"
+	// Knock は話しかけたいというリクエストが届いたことを表すイベントの種類
+	Knock = "knock"
+	// KnockAnswered は話しかけたいというリクエストに応答があったことを表すイベントの種類
+	KnockAnswered = "knockAnswered"
+
+	// 購読者ごとに溜めておけるイベントの数
+	bufferSize = 64
+	// 再開のために記録しておくイベントの数
+	logSize = 256
+)
+
+// Event はハブが配信するイベントを表す構造体。
+// Id は配信時に振る連番、UserId はイベントの対象のユーザ、Timestamp はイベントが発生した時刻 (UNIX 時間)。
+// To が 0 でないときは、To のユーザ宛てのイベントであることを表す。
+type Event struct {
+	Id        int64  `json:"id"`
+	Type      string `json:"type"`
+	UserId    int32  `json:"userId"`
+	To        int32  `json:"to,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// New は新しいハブを生成する関数。
+func New() *Hub {
+	return &Hub{
+		subs: make(map[*Subscription]struct{}),
+		log:  make([]Event, 0, logSize),
+	}
+}
+
+// Hub はイベントを購読者に配信する構造体。
+// 最近のイベントを log に記録し、途中から購読を再開できるようにする。
+type Hub struct {
+	sync.Mutex
+	subs map[*Subscription]struct{}
+	seq  int64
+	log  []Event
+}
+
+// Subscription はハブの購読を表す構造体。
+// 配信されたイベントは C から受信する。
+type Subscription struct {
+	C   <-chan Event
+	c   chan Event
+	hub *Hub
+}
+
+// Subscribe はハブを購読する関数。
+// 購読をやめるときは Subscription の Close を呼ぶ。
+func (h *Hub) Subscribe() *Subscription {
+	s, _ := h.SubscribeSince(0)
+	return s
+}
+
+// SubscribeSince はハブを購読し、記録しているイベントのうち Id が id より大きいものを返す関数。
+// id が 0 以下のときは記録しているイベントを返さない。
+// 記録しているイベントは最近のものだけなので、古い id を指定したときは一部のイベントが欠ける。
+func (h *Hub) SubscribeSince(id int64) (*Subscription, []Event) {
+	c := make(chan Event, bufferSize)
+	s := &Subscription{C: c, c: c, hub: h}
+	h.Lock()
+	defer h.Unlock()
+	var missed []Event
+	if id > 0 {
+		for _, e := range h.log {
+			if e.Id > id {
+				missed = append(missed, e)
+			}
+		}
+	}
+	h.subs[s] = struct{}{}
+	return s, missed
+}
+
+// Publish はすべての購読者に e を配信する関数。e には連番を振る。
+// 受信が追いつかず、溜めておけるイベントの数を超えた購読者にはイベントを配信しない。
+func (h *Hub) Publish(e Event) {
+	h.Lock()
+	defer h.Unlock()
+	h.seq++
+	e.Id = h.seq
+	if len(h.log) == logSize {
+		copy(h.log, h.log[1:])
+		h.log = h.log[:logSize-1]
+	}
+	h.log = append(h.log, e)
+	for s := range h.subs {
+		select {
+		case s.c <- e:
+		default:
+			log.Printf("Event dropped. Type: %s, UserId: %d", e.Type, e.UserId)
+		}
+	}
+}
+
+// Close は購読をやめる関数。C は閉じられる。
+func (s *Subscription) Close() {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,402 @@
+// パッケージ ical は iCalendar (RFC 5545) の予定を読み込むパッケージ。
+// VEVENT のみを扱い、RRULE による繰り返しを展開する。
+// 予定を読み込み、期間内の予定を取得するサンプル。
+//     c, err := ical.Parse(f)
+//     occs := c.Between(time.Now(), time.Now().Add(24*time.Hour))
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 日時の形式
+	dateTimeLayout = "20060102T150405"
+	// 日付の形式
+	dateLayout = "20060102"
+	// 1 行の最大バイト数
+	maxLineBytes = 64 * 1024
+)
+
+// ErrNotCalendar は読み込んだデータが iCalendar でないことを表すエラー
+var ErrNotCalendar = errors.New("Not an iCalendar.")
+
+// Calendar は iCalendar の予定の集合を表す構造体。
+type Calendar struct {
+	Events []*Event
+}
+
+// Event は VEVENT を表す構造体。
+// End は DTEND または DURATION から求めた終了日時。どちらも無いときは Start と同じ (終日の予定は翌日)。
+// RecurrenceID は繰り返しの予定のうち、変更した回の元の開始日時。
+// Cancelled は STATUS:CANCELLED、Transparent は TRANSP:TRANSPARENT (予定があっても空き時間として扱う) を表す。
+type Event struct {
+	UID          string
+	Summary      string
+	Start        time.Time
+	End          time.Time
+	AllDay       bool
+	Rule         *Rule
+	ExDates      []time.Time
+	RecurrenceID *time.Time
+	Cancelled    bool
+	Transparent  bool
+	// DTSTART より前に DURATION があるときのため、終了日時は読み終えてから求める
+	duration *time.Duration
+}
+
+// Occurrence は予定の 1 回分を表す構造体。
+type Occurrence struct {
+	Event *Event
+	Start time.Time
+	End   time.Time
+}
+
+// property は iCalendar の 1 行を表す構造体。
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// Parse は r から iCalendar を読み込む関数。
+// VTIMEZONE は読み込まず、TZID は IANA タイムゾーン名として解釈する。解釈できないときはサーバのタイムゾーンとする。
+func Parse(r io.Reader) (*Calendar, error) {
+	props, err := readProperties(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(props) == 0 || props[0].name != "BEGIN" || strings.ToUpper(props[0].value) != "VCALENDAR" {
+		return nil, ErrNotCalendar
+	}
+
+	c := &Calendar{Events: make([]*Event, 0, 16)}
+	var (
+		e     *Event
+		depth int
+	)
+	for _, p := range props {
+		switch p.name {
+		case "BEGIN":
+			if e != nil {
+				// VALARM などの VEVENT 内のコンポーネントは読み飛ばす
+				depth++
+			} else if strings.ToUpper(p.value) == "VEVENT" {
+				e = &Event{}
+			}
+			continue
+		case "END":
+			if depth > 0 {
+				depth--
+			} else if e != nil && strings.ToUpper(p.value) == "VEVENT" {
+				if err = e.complete(); err != nil {
+					return nil, err
+				}
+				c.Events = append(c.Events, e)
+				e = nil
+			}
+			continue
+		}
+		if e == nil || depth > 0 {
+			continue
+		}
+		if err = e.set(p); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.name, err)
+		}
+	}
+	return c, nil
+}
+
+// set は p を e に設定する関数。
+func (e *Event) set(p property) error {
+	var err error
+	switch p.name {
+	case "UID":
+		e.UID = p.value
+	case "SUMMARY":
+		e.Summary = unescape(p.value)
+	case "DTSTART":
+		e.Start, e.AllDay, err = parseTime(p)
+	case "DTEND":
+		e.End, _, err = parseTime(p)
+	case "DURATION":
+		var d time.Duration
+		if d, err = parseDuration(p.value); err == nil {
+			e.duration = &d
+		}
+	case "RRULE":
+		e.Rule, err = parseRule(p.value)
+	case "EXDATE":
+		for _, v := range strings.Split(p.value, ",") {
+			var t time.Time
+			if t, _, err = parseTime(property{name: p.name, params: p.params, value: v}); err != nil {
+				return err
+			}
+			e.ExDates = append(e.ExDates, t)
+		}
+	case "RECURRENCE-ID":
+		var t time.Time
+		if t, _, err = parseTime(p); err == nil {
+			e.RecurrenceID = &t
+		}
+	case "STATUS":
+		e.Cancelled = strings.ToUpper(p.value) == "CANCELLED"
+	case "TRANSP":
+		e.Transparent = strings.ToUpper(p.value) == "TRANSPARENT"
+	}
+	return err
+}
+
+// complete は VEVENT を読み終えたときに終了日時を補う関数。
+func (e *Event) complete() error {
+	if e.Start.IsZero() {
+		return errors.New("DTSTART is required.")
+	}
+	switch {
+	case !e.End.IsZero():
+	case e.duration != nil:
+		e.End = e.Start.Add(*e.duration)
+	case e.AllDay:
+		e.End = e.Start.AddDate(0, 0, 1)
+	default:
+		e.End = e.Start
+	}
+	if e.End.Before(e.Start) {
+		return errors.New("DTEND is before DTSTART.")
+	}
+	return nil
+}
+
+// Between は from から to までの間に行われている予定を開始日時の順に返す関数。
+// 繰り返しの予定は展開し、EXDATE で除外した回と RECURRENCE-ID で変更した回の元の日時は含めない。
+// 取り消した予定は含めない。
+func (c *Calendar) Between(from, to time.Time) []Occurrence {
+	// 変更した回の元の開始日時
+	overridden := make(map[string]map[int64]bool)
+	for _, e := range c.Events {
+		if e.RecurrenceID != nil {
+			if overridden[e.UID] == nil {
+				overridden[e.UID] = make(map[int64]bool)
+			}
+			overridden[e.UID][e.RecurrenceID.Unix()] = true
+		}
+	}
+
+	occs := make([]Occurrence, 0, 8)
+	for _, e := range c.Events {
+		d := e.End.Sub(e.Start)
+		starts := []time.Time{e.Start}
+		if e.Rule != nil && e.RecurrenceID == nil {
+			// 開始が from - d より後の回が from 以降に行われている
+			starts = e.Rule.expand(e.Start, from.Add(-d), to)
+		}
+		for _, s := range starts {
+			if e.Cancelled || overridden[e.UID][s.Unix()] && e.RecurrenceID == nil || e.excluded(s) {
+				continue
+			}
+			end := s.Add(d)
+			if s.Before(to) && (end.After(from) || d == 0 && !s.Before(from)) {
+				occs = append(occs, Occurrence{Event: e, Start: s, End: end})
+			}
+		}
+	}
+	sort.Sort(byStart(occs))
+	return occs
+}
+
+// excluded は開始日時 t の回が EXDATE で除外されているとき true を返す関数。
+func (e *Event) excluded(t time.Time) bool {
+	for _, x := range e.ExDates {
+		if x.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// byStart は Occurrence を開始日時の順にソートするための型
+type byStart []Occurrence
+
+func (a byStart) Len() int           { return len(a) }
+func (a byStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
+func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// readProperties は r を行に分けて読み込む関数。折り返した行はつなげる。
+func readProperties(r io.Reader) ([]property, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), maxLineBytes)
+	lines := make([]string, 0, 64)
+	for s.Scan() {
+		l := strings.TrimRight(s.Text(), "\r")
+		if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	props := make([]property, 0, len(lines))
+	for i, l := range lines {
+		p, err := parseProperty(l)
+		if err != nil {
+			// 読み込んだ内容をエラーに含めない
+			return nil, fmt.Errorf("Invalid content line %d.", i+1)
+		}
+		props = append(props, p)
+	}
+	return props, nil
+}
+
+// parseProperty は NAME;PARAM=VALUE:VALUE 形式の 1 行を読み込む関数。
+// ダブルクォートで囲んだパラメタの値には : と ; を含められる。
+func parseProperty(l string) (property, error) {
+	quoted := false
+	for i, c := range l {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ':' && !quoted:
+			p := property{params: make(map[string]string), value: l[i+1:]}
+			parts := splitUnquoted(l[:i], ';')
+			p.name = strings.ToUpper(parts[0])
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(param, "=", 2)
+				if len(kv) == 2 {
+					p.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+				}
+			}
+			return p, nil
+		}
+	}
+	return property{}, errors.New("Invalid line.")
+}
+
+// splitUnquoted は s をダブルクォートで囲まれていない sep で分割する関数。
+func splitUnquoted(s string, sep rune) []string {
+	parts := make([]string, 0, 2)
+	quoted, start := false, 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseTime は日時のプロパティを読み込む関数。日付のみのときは true を返す。
+// 末尾が Z のときは UTC、TZID があるときはそのタイムゾーン、どちらも無いときはサーバのタイムゾーンとする。
+func parseTime(p property) (time.Time, bool, error) {
+	loc := time.Local
+	if tzid, ok := p.params["TZID"]; ok {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	v := strings.TrimSpace(p.value)
+	switch {
+	case p.params["VALUE"] == "DATE" || len(v) == len(dateLayout):
+		t, err := time.ParseInLocation(dateLayout, v, loc)
+		return t, true, err
+	case strings.HasSuffix(v, "Z"):
+		t, err := time.Parse(dateTimeLayout, strings.TrimSuffix(v, "Z"))
+		return t, false, err
+	}
+	t, err := time.ParseInLocation(dateTimeLayout, v, loc)
+	return t, false, err
+}
+
+// parseDuration は P1DT2H30M 形式の期間を読み込む関数。
+func parseDuration(v string) (time.Duration, error) {
+	neg := false
+	switch {
+	case strings.HasPrefix(v, "-"):
+		neg = true
+		v = v[1:]
+	case strings.HasPrefix(v, "+"):
+		v = v[1:]
+	}
+	if !strings.HasPrefix(v, "P") {
+		return 0, fmt.Errorf("Invalid duration: %s", v)
+	}
+	var (
+		d      time.Duration
+		n      int
+		inTime bool
+	)
+	for _, c := range v[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + int(c-'0')
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("Invalid duration: %s", v)
+		}
+		n = 0
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
+
+// unescape は TEXT 型の値のエスケープを戻す関数。
+func unescape(v string) string {
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range v {
+		switch {
+		case escaped && (c == 'n' || c == 'N'):
+			b.WriteByte('\n')
+		case escaped:
+			b.WriteRune(c)
+		case c == '\\':
+			escaped = true
+			continue
+		default:
+			b.WriteRune(c)
+		}
+		escaped = false
+	}
+	return b.String()
+}
+
+// atoi は s を整数に変換する関数。
+func atoi(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid number: %s", s)
+	}
+	return n, nil
+}
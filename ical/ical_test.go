@@ -0,0 +1,219 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// calendar は VEVENT の行から iCalendar を組み立てる関数。
+func calendar(events ...[]string) string {
+	lines := []string{"BEGIN:VCALENDAR", "VERSION:2.0"}
+	for _, e := range events {
+		lines = append(lines, "BEGIN:VEVENT")
+		lines = append(lines, e...)
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func utc(s string) time.Time {
+	t, err := time.Parse(dateTimeLayout, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func local(s string) time.Time {
+	t, err := time.ParseInLocation(dateTimeLayout, s, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestBetween(t *testing.T) {
+	tests := []struct {
+		name     string
+		ics      string
+		from, to time.Time
+		want     []time.Time
+	}{
+		{
+			name: "WEEKLY BYDAY",
+			ics: calendar([]string{
+				"UID:weekly",
+				"DTSTART:20261005T090000Z",
+				"DTEND:20261005T093000Z",
+				"RRULE:FREQ=WEEKLY;BYDAY=MO,WE",
+			}),
+			from: utc("20261012T000000"),
+			to:   utc("20261019T000000"),
+			want: []time.Time{utc("20261012T090000"), utc("20261014T090000")},
+		},
+		{
+			name: "WEEKLY INTERVAL and COUNT",
+			ics: calendar([]string{
+				"UID:count",
+				"DTSTART:20261005T090000Z",
+				"DURATION:PT30M",
+				"RRULE:FREQ=WEEKLY;INTERVAL=2;COUNT=2",
+			}),
+			from: utc("20261001T000000"),
+			to:   utc("20261201T000000"),
+			want: []time.Time{utc("20261005T090000"), utc("20261019T090000")},
+		},
+		{
+			name: "MONTHLY last Friday",
+			ics: calendar([]string{
+				"UID:monthly",
+				"DTSTART:20260130T170000Z",
+				"DTEND:20260130T180000Z",
+				"RRULE:FREQ=MONTHLY;BYDAY=-1FR",
+			}),
+			from: utc("20261001T000000"),
+			to:   utc("20261201T000000"),
+			want: []time.Time{utc("20261030T170000"), utc("20261127T170000")},
+		},
+		{
+			name: "EXDATE",
+			ics: calendar([]string{
+				"UID:exdate",
+				"DTSTART:20261012T100000Z",
+				"DTEND:20261012T103000Z",
+				"RRULE:FREQ=DAILY",
+				"EXDATE:20261014T100000Z",
+			}),
+			from: utc("20261012T000000"),
+			to:   utc("20261016T000000"),
+			want: []time.Time{utc("20261012T100000"), utc("20261013T100000"), utc("20261015T100000")},
+		},
+		{
+			name: "RECURRENCE-ID",
+			ics: calendar([]string{
+				"UID:override",
+				"DTSTART:20261012T100000Z",
+				"DTEND:20261012T103000Z",
+				"RRULE:FREQ=DAILY",
+			}, []string{
+				"UID:override",
+				"RECURRENCE-ID:20261013T100000Z",
+				"DTSTART:20261013T150000Z",
+				"DTEND:20261013T153000Z",
+			}),
+			from: utc("20261012T000000"),
+			to:   utc("20261015T000000"),
+			want: []time.Time{utc("20261012T100000"), utc("20261013T150000"), utc("20261014T100000")},
+		},
+		{
+			name: "cancelled RECURRENCE-ID",
+			ics: calendar([]string{
+				"UID:cancel",
+				"DTSTART:20261012T100000Z",
+				"DTEND:20261012T103000Z",
+				"RRULE:FREQ=DAILY",
+			}, []string{
+				"UID:cancel",
+				"RECURRENCE-ID:20261013T100000Z",
+				"DTSTART:20261013T100000Z",
+				"DTEND:20261013T103000Z",
+				"STATUS:CANCELLED",
+			}),
+			from: utc("20261012T000000"),
+			to:   utc("20261014T000000"),
+			want: []time.Time{utc("20261012T100000")},
+		},
+		{
+			name: "UNTIL date is inclusive",
+			ics: calendar([]string{
+				"UID:until-date",
+				"DTSTART:20261018T150000",
+				"DTEND:20261018T160000",
+				"RRULE:FREQ=DAILY;UNTIL=20261020",
+			}),
+			from: local("20261017T000000"),
+			to:   local("20261025T000000"),
+			want: []time.Time{local("20261018T150000"), local("20261019T150000"), local("20261020T150000")},
+		},
+		{
+			name: "UNTIL date-time",
+			ics: calendar([]string{
+				"UID:until",
+				"DTSTART:20261018T150000Z",
+				"DTEND:20261018T160000Z",
+				"RRULE:FREQ=DAILY;UNTIL=20261020T150000Z",
+			}),
+			from: utc("20261017T000000"),
+			to:   utc("20261025T000000"),
+			want: []time.Time{utc("20261018T150000"), utc("20261019T150000"), utc("20261020T150000")},
+		},
+		{
+			name: "HOURLY long after DTSTART",
+			ics: calendar([]string{
+				"UID:hourly",
+				"DTSTART:20000101T000000Z",
+				"DTEND:20000101T003000Z",
+				"RRULE:FREQ=HOURLY",
+			}),
+			from: utc("20261016T103000"),
+			to:   utc("20261016T123000"),
+			want: []time.Time{utc("20261016T110000"), utc("20261016T120000")},
+		},
+		{
+			name: "ongoing occurrence",
+			ics: calendar([]string{
+				"UID:ongoing",
+				"DTSTART:19900102T090000Z",
+				"DTEND:19900102T170000Z",
+				"RRULE:FREQ=YEARLY",
+			}),
+			from: utc("20260102T120000"),
+			to:   utc("20260102T130000"),
+			want: []time.Time{utc("20260102T090000")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse(strings.NewReader(tt.ics))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			occs := c.Between(tt.from, tt.to)
+			got := make([]time.Time, len(occs))
+			for i, o := range occs {
+				got[i] = o.Start
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name string
+		ics  string
+	}{
+		{"not a calendar", "hello\r\n"},
+		{"invalid line", "BEGIN:VCALENDAR\r\nsecret value\r\nEND:VCALENDAR\r\n"},
+		{"missing DTSTART", calendar([]string{"UID:1"})},
+		{"DTEND before DTSTART", calendar([]string{"UID:1", "DTSTART:20261012T100000Z", "DTEND:20261012T090000Z"})},
+		{"unsupported FREQ", calendar([]string{"UID:1", "DTSTART:20261012T100000Z", "RRULE:FREQ=SECONDLY"})},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.ics))
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%s: error contains the input: %v", tt.name, err)
+		}
+	}
+}
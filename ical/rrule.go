@@ -0,0 +1,329 @@
+package ical
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// 1 度に展開する期間の最大数。展開が終わらないのを防ぐ
+	maxPeriods = 100000
+)
+
+// weekdays は BYDAY の曜日の表記
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Rule は RRULE を表す構造体。
+// Freq は HOURLY, DAILY, WEEKLY, MONTHLY, YEARLY のいずれか。Count, Until が無いときは無期限に繰り返す。
+// Until は最後の回の開始日時の上限。UNTIL が日付のみのときは、その日の終わり。
+// 週の始まりは月曜日とし、WKST は読み込まない。
+type Rule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+}
+
+// WeekdayNum は BYDAY の曜日を表す構造体。
+// N が 0 でないときは、月 (または年) の N 番目 (負のときは後ろから) のその曜日を表す。
+type WeekdayNum struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// parseRule は FREQ=WEEKLY;BYDAY=MO,WE 形式の RRULE を読み込む関数。
+func parseRule(v string) (*Rule, error) {
+	r := &Rule{Interval: 1}
+	for _, part := range strings.Split(v, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var err error
+		switch val := strings.ToUpper(kv[1]); strings.ToUpper(kv[0]) {
+		case "FREQ":
+			switch val {
+			case "HOURLY", "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				r.Freq = val
+			default:
+				return nil, fmt.Errorf("Unsupported FREQ: %s", val)
+			}
+		case "INTERVAL":
+			if r.Interval, err = atoi(val); err == nil && r.Interval < 1 {
+				err = fmt.Errorf("Invalid INTERVAL: %s", val)
+			}
+		case "COUNT":
+			r.Count, err = atoi(val)
+		case "UNTIL":
+			var (
+				t      time.Time
+				allDay bool
+			)
+			if t, allDay, err = parseTime(property{params: map[string]string{}, value: val}); err == nil {
+				if allDay {
+					// 日付のみのときはその日を含む
+					t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+				}
+				r.Until = &t
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(val, ",") {
+				var wn WeekdayNum
+				if wn, err = parseWeekdayNum(d); err != nil {
+					break
+				}
+				r.ByDay = append(r.ByDay, wn)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(val, ",") {
+				var n int
+				if n, err = atoi(d); err != nil {
+					break
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, m := range strings.Split(val, ",") {
+				var n int
+				if n, err = atoi(m); err != nil {
+					break
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(n))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Freq == "" {
+		return nil, errors.New("FREQ is required.")
+	}
+	return r, nil
+}
+
+// parseWeekdayNum は -1FR 形式の曜日を読み込む関数。
+func parseWeekdayNum(v string) (WeekdayNum, error) {
+	if len(v) < 2 {
+		return WeekdayNum{}, fmt.Errorf("Invalid BYDAY: %s", v)
+	}
+	d, ok := weekdays[v[len(v)-2:]]
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("Invalid BYDAY: %s", v)
+	}
+	wn := WeekdayNum{Weekday: d}
+	if n := strings.TrimPrefix(v[:len(v)-2], "+"); n != "" {
+		var err error
+		if wn.N, err = atoi(n); err != nil {
+			return WeekdayNum{}, err
+		}
+	}
+	return wn, nil
+}
+
+// expand は開始日時が start の予定の繰り返しのうち、開始日時が from 以上 to 未満のものを返す関数。
+// COUNT は start からの回数で数える。COUNT が無いときは from の少し前の期間から展開する。
+func (r *Rule) expand(start, from, to time.Time) []time.Time {
+	starts := make([]time.Time, 0, 8)
+	n := 0
+	k0 := 0
+	if r.Count == 0 {
+		k0 = r.firstPeriod(start, from)
+	}
+	for k := k0; k < k0+maxPeriods; k++ {
+		cands, base := r.candidates(start, k)
+		if !base.Before(to) {
+			break
+		}
+		for _, c := range cands {
+			if c.Before(start) {
+				continue
+			}
+			if r.Until != nil && c.After(*r.Until) || !c.Before(to) {
+				return starts
+			}
+			n++
+			if r.Count > 0 && n > r.Count {
+				return starts
+			}
+			if !c.Before(from) {
+				starts = append(starts, c)
+			}
+		}
+	}
+	return starts
+}
+
+// firstPeriod は from より前に始まる最後の期間の番号を返す関数。from が start 以前のときは 0 を返す。
+// 夏時間による時刻のずれに備え、1 つ前の期間を返す。
+func (r *Rule) firstPeriod(start, from time.Time) int {
+	if !from.After(start) {
+		return 0
+	}
+	from = from.In(start.Location())
+	sy, sm, sd := start.Date()
+	fy, fm, fd := from.Date()
+	days := int(time.Date(fy, fm, fd, 0, 0, 0, 0, time.UTC).Sub(time.Date(sy, sm, sd, 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	var periods int
+	switch r.Freq {
+	case "HOURLY":
+		periods = int(from.Sub(start).Hours())
+	case "DAILY":
+		periods = days
+	case "WEEKLY":
+		// 週は月曜日から始まる
+		periods = (days + (int(start.Weekday())+6)%7) / 7
+	case "MONTHLY":
+		periods = (fy-sy)*12 + int(fm-sm)
+	case "YEARLY":
+		periods = fy - sy
+	}
+	k := periods/r.Interval - 1
+	if k < 0 {
+		return 0
+	}
+	return k
+}
+
+// candidates は k 番目の期間の繰り返しの開始日時の候補を古い順に返す関数。
+// base はその期間の始まりの日時。
+func (r *Rule) candidates(start time.Time, k int) (cands []time.Time, base time.Time) {
+	y, m, d := start.Date()
+	loc := start.Location()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, start.Hour(), start.Minute(), start.Second(), 0, loc)
+	}
+
+	switch r.Freq {
+	case "HOURLY":
+		t := start.Add(time.Duration(k*r.Interval) * time.Hour)
+		return []time.Time{t}, t
+	case "DAILY":
+		t := at(y, m, d+k*r.Interval)
+		if r.matchDay(t) {
+			cands = []time.Time{t}
+		}
+		return cands, t
+	case "WEEKLY":
+		// 月曜日から始まる週
+		monday := d - (int(start.Weekday())+6)%7 + k*r.Interval*7
+		base = time.Date(y, m, monday, 0, 0, 0, 0, loc)
+		if len(r.ByDay) == 0 {
+			return []time.Time{at(y, m, monday+(int(start.Weekday())+6)%7)}, base
+		}
+		for _, wn := range r.ByDay {
+			cands = append(cands, at(y, m, monday+(int(wn.Weekday)+6)%7))
+		}
+	case "MONTHLY":
+		first := time.Date(y, m+time.Month(k*r.Interval), 1, 0, 0, 0, 0, loc)
+		if len(r.ByMonth) > 0 && !containsMonth(r.ByMonth, first.Month()) {
+			return nil, first
+		}
+		cands = r.monthDays(first, d, at)
+		base = first
+	case "YEARLY":
+		base = time.Date(y+k*r.Interval, 1, 1, 0, 0, 0, 0, loc)
+		months := r.ByMonth
+		if len(months) == 0 {
+			months = []time.Month{m}
+		}
+		for _, month := range months {
+			first := time.Date(base.Year(), month, 1, 0, 0, 0, 0, loc)
+			cands = append(cands, r.monthDays(first, d, at)...)
+		}
+	}
+	sort.Sort(byTime(cands))
+	return cands, base
+}
+
+// monthDays は first から始まる月の、BYMONTHDAY と BYDAY に当てはまる日を返す関数。
+// どちらも無いときは day 日 (その月に無いときは無し) を返す。
+func (r *Rule) monthDays(first time.Time, day int, at func(int, time.Month, int) time.Time) []time.Time {
+	y, m := first.Year(), first.Month()
+	last := daysIn(y, m)
+	days := make([]time.Time, 0, 4)
+	switch {
+	case len(r.ByMonthDay) > 0:
+		for _, md := range r.ByMonthDay {
+			if md < 0 {
+				md = last + md + 1
+			}
+			if md >= 1 && md <= last {
+				days = append(days, at(y, m, md))
+			}
+		}
+	case len(r.ByDay) > 0:
+		for _, wn := range r.ByDay {
+			// その月の最初のその曜日
+			d := 1 + (int(wn.Weekday)-int(first.Weekday())+7)%7
+			switch {
+			case wn.N > 0:
+				d += (wn.N - 1) * 7
+			case wn.N < 0:
+				d += ((last-d)/7 + wn.N + 1) * 7
+			default:
+				for ; d <= last; d += 7 {
+					days = append(days, at(y, m, d))
+				}
+				continue
+			}
+			if d >= 1 && d <= last {
+				days = append(days, at(y, m, d))
+			}
+		}
+	case day <= last:
+		days = append(days, at(y, m, day))
+	}
+	return days
+}
+
+// matchDay は DAILY の繰り返しで t が BYDAY, BYMONTH に当てはまるとき true を返す関数。
+func (r *Rule) matchDay(t time.Time) bool {
+	if len(r.ByMonth) > 0 && !containsMonth(r.ByMonth, t.Month()) {
+		return false
+	}
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wn := range r.ByDay {
+		if wn.Weekday == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// containsMonth は months に m が含まれるとき true を返す関数。
+func containsMonth(months []time.Month, m time.Month) bool {
+	for _, month := range months {
+		if month == m {
+			return true
+		}
+	}
+	return false
+}
+
+// daysIn は y 年 m 月の日数を返す関数。
+func daysIn(y int, m time.Month) int {
+	return time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// byTime は time.Time をソートするための型
+type byTime []time.Time
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Less(i, j int) bool { return a[i].Before(a[j]) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -179,6 +179,213 @@ func noimage_png() ([]byte, error) {
 	)
 }
 
+func offhours_png() ([]byte, error) {
+	return bindata_read([]byte{
+		0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6d, 0x56,
+		0x59, 0x54, 0x93, 0xd7, 0x1a, 0xfd, 0x13, 0x93, 0xf0, 0x23, 0x08, 0x11,
+		0x09, 0x20, 0x88, 0x24, 0xd1, 0x62, 0xa4, 0x61, 0x28, 0x09, 0x29, 0x29,
+		0x53, 0xc4, 0x50, 0x19, 0xc3, 0x20, 0x28, 0x08, 0x01, 0xa4, 0x50, 0x44,
+		0x11, 0xa4, 0x11, 0x0a, 0x04, 0x48, 0x64, 0x90, 0x92, 0x80, 0x80, 0x14,
+		0x81, 0x84, 0x41, 0x05, 0x8d, 0x01, 0x91, 0x41, 0x22, 0xd5, 0x30, 0x68,
+		0x69, 0x19, 0x16, 0xb3, 0x08, 0x69, 0x2a, 0x0a, 0x14, 0x10, 0x51, 0x99,
+		0xa7, 0x1b, 0x50, 0x68, 0xbc, 0xeb, 0xae, 0xd5, 0xfb, 0xd0, 0x97, 0xbd,
+		0xf6, 0x3a, 0x0f, 0xfb, 0x9c, 0xef, 0x3b, 0xdf, 0xd9, 0xfb, 0x64, 0xb8,
+		0xd1, 0x4e, 0xec, 0xd9, 0xad, 0xbd, 0x1b, 0x00, 0x80, 0x3d, 0x0e, 0xf6,
+		0x54, 0x0f, 0x00, 0x80, 0xc8, 0x29, 0x50, 0x0d, 0x42, 0xe5, 0x38, 0x30,
+		0x4d, 0x12, 0x01, 0x80, 0x22, 0xd1, 0x81, 0x7a, 0xcc, 0x33, 0xf6, 0xcf,
+		0x0f, 0x25, 0x2f, 0x5d, 0xf7, 0xf5, 0xea, 0xb0, 0x43, 0x5f, 0x3e, 0xa7,
+		0xef, 0xc5, 0xc1, 0x15, 0x3d, 0xb0, 0x50, 0x28, 0xfc, 0xa8, 0xfd, 0x61,
+		0x28, 0xa6, 0x74, 0xdf, 0xaf, 0x69, 0x19, 0xdb, 0x0e, 0xed, 0x36, 0x5d,
+		0x4e, 0x5f, 0xe4, 0xb2, 0xb5, 0xcc, 0x60, 0x66, 0x06, 0x0a, 0xee, 0x4e,
+		0xe6, 0x27, 0x6f, 0xc2, 0xff, 0x7c, 0xce, 0x98, 0x35, 0x1e, 0xfc, 0xa8,
+		0xd6, 0x8a, 0x8e, 0xbe, 0x72, 0xf0, 0x91, 0x45, 0x3f, 0x63, 0x89, 0x9e,
+		0x60, 0x24, 0x5e, 0x68, 0x21, 0xb8, 0x8e, 0x95, 0x48, 0xdb, 0xfe, 0x30,
+		0x2d, 0xca, 0x04, 0x72, 0x50, 0x4a, 0x47, 0x01, 0x18, 0x40, 0x01, 0xfe,
+		0x15, 0x56, 0x02, 0x0f, 0xc1, 0xe1, 0xfa, 0x45, 0xce, 0x88, 0x94, 0x67,
+		0xde, 0x78, 0x8d, 0x1d, 0x3b, 0xbc, 0xc6, 0x10, 0xd1, 0xc5, 0xcb, 0x2b,
+		0xbd, 0xed, 0xd6, 0xf6, 0xed, 0xfb, 0xf7, 0x33, 0xf1, 0x18, 0xb6, 0x03,
+		0x98, 0xde, 0xe6, 0xdb, 0x0a, 0xc2, 0xa0, 0x82, 0xf8, 0x79, 0x37, 0xf7,
+		0x9f, 0x79, 0x3c, 0x5e, 0x4b, 0x4b, 0x0b, 0x87, 0xb3, 0xfb, 0x79, 0xa1,
+		0x8d, 0x7a, 0x29, 0xa2, 0x57, 0x4f, 0x2c, 0x16, 0x47, 0xbe, 0x6e, 0x22,
+		0xcf, 0xd0, 0x8a, 0x69, 0x33, 0x6b, 0xef, 0x25, 0xc6, 0xf4, 0x27, 0x54,
+		0xeb, 0xbd, 0x37, 0x83, 0x41, 0x44, 0x0a, 0x83, 0xc1, 0xb0, 0x2e, 0x33,
+		0x3e, 0x6d, 0x71, 0xbf, 0xa6, 0x46, 0x4f, 0x5b, 0x1b, 0x5b, 0x07, 0xba,
+		0x41, 0xa9, 0xe5, 0x83, 0x05, 0xc6, 0x01, 0x6f, 0x12, 0x1a, 0x5d, 0x5c,
+		0x5c, 0x4a, 0x4a, 0x4a, 0x34, 0x8d, 0xfc, 0xd0, 0x6d, 0x60, 0x20, 0xd5,
+		0x43, 0xf8, 0xa2, 0xa7, 0xa7, 0x67, 0x64, 0xe4, 0x54, 0x8b, 0xea, 0xea,
+		0xdb, 0xc1, 0x43, 0xfc, 0xac, 0x67, 0x7c, 0xa4, 0x73, 0x8a, 0x36, 0xa7,
+		0xab, 0xab, 0x0b, 0xba, 0xba, 0x3d, 0xa6, 0xc0, 0xa1, 0x62, 0x0f, 0x1f,
+		0x80, 0x28, 0xa7, 0x8e, 0x2d, 0xa8, 0xa6, 0xd9, 0xa6, 0x91, 0x4f, 0xe1,
+		0xd4, 0x79, 0x85, 0x85, 0x8b, 0x5b, 0x9f, 0x2a, 0xe8, 0xa0, 0xd1, 0x15,
+		0x4e, 0x6f, 0xb6, 0x9e, 0xcd, 0xf7, 0xa1, 0xa1, 0xdc, 0xe8, 0xd5, 0x23,
+		0xae, 0xa5, 0x03, 0x30, 0x5b, 0x37, 0x08, 0xe7, 0x37, 0xb9, 0xd6, 0x5e,
+		0xe6, 0xce, 0x02, 0x70, 0x0e, 0x0e, 0xc3, 0x69, 0x13, 0x08, 0x04, 0x3b,
+		0x55, 0xb4, 0x96, 0xf2, 0x73, 0x24, 0xe8, 0x06, 0x53, 0xcb, 0xa0, 0x1a,
+		0xe4, 0x1b, 0x44, 0x28, 0x0b, 0x3d, 0xdf, 0x7d, 0xda, 0xda, 0xc8, 0xa0,
+		0x26, 0xbf, 0x41, 0x26, 0x7f, 0x45, 0x81, 0xc8, 0x56, 0x67, 0x87, 0x96,
+		0x97, 0xeb, 0xa3, 0xfe, 0x7a, 0x1c, 0xbf, 0x76, 0x3e, 0x20, 0x40, 0x6f,
+		0x0e, 0x0b, 0x43, 0xa1, 0x77, 0xc2, 0x23, 0x23, 0x75, 0x2a, 0x37, 0x94,
+		0x30, 0x99, 0x1a, 0xaa, 0xd0, 0xc2, 0xa2, 0xbf, 0x54, 0x12, 0x5c, 0x93,
+		0x83, 0xae, 0x01, 0x69, 0xe8, 0x12, 0x9a, 0x0e, 0x63, 0x94, 0x4c, 0x22,
+		0xdd, 0xa0, 0x09, 0xc2, 0xd0, 0xb0, 0x4e, 0x63, 0x27, 0x27, 0xa7, 0x76,
+		0x65, 0xbc, 0x76, 0x96, 0x36, 0x89, 0x04, 0x33, 0x51, 0xcc, 0xa0, 0x06,
+		0x45, 0x45, 0x0d, 0xd6, 0x4e, 0x18, 0x1a, 0x19, 0x99, 0x1e, 0x4a, 0x05,
+		0xe2, 0x82, 0xe3, 0xe2, 0xc8, 0x45, 0xce, 0xda, 0xa4, 0xa6, 0x60, 0xd3,
+		0xae, 0x73, 0x5a, 0x90, 0x65, 0x3b, 0x6c, 0x6e, 0x21, 0x9f, 0x4f, 0x88,
+		0xcd, 0x69, 0xcf, 0x46, 0x42, 0x1c, 0xf3, 0x0f, 0xb4, 0x8c, 0x43, 0x41,
+		0x36, 0xc0, 0x06, 0xee, 0xb4, 0xcd, 0xcf, 0xcf, 0x6f, 0x6e, 0xc6, 0x0b,
+		0x53, 0x1d, 0x99, 0x18, 0xca, 0x35, 0xe9, 0xd8, 0xd8, 0x11, 0x4f, 0x58,
+		0x4e, 0x41, 0xac, 0x25, 0xed, 0x1e, 0x88, 0x36, 0xae, 0xf3, 0xce, 0x74,
+		0xdb, 0x4b, 0xf1, 0x57, 0x51, 0x51, 0x01, 0x51, 0x90, 0xa9, 0x34, 0x27,
+		0x34, 0x2c, 0x87, 0xa7, 0x16, 0xff, 0x1b, 0x3a, 0xd7, 0x7e, 0x31, 0x18,
+		0x07, 0x05, 0xd0, 0x94, 0x79, 0x37, 0x2f, 0x51, 0xaa, 0xad, 0x97, 0x7a,
+		0x9a, 0xfe, 0x71, 0xb6, 0xdf, 0xed, 0x30, 0xed, 0x5b, 0x58, 0x36, 0xd2,
+		0x13, 0xb0, 0xb5, 0x03, 0x14, 0xa3, 0xcc, 0x0f, 0xa4, 0x72, 0x80, 0x65,
+		0x5b, 0x38, 0x05, 0x10, 0x0a, 0xab, 0xab, 0xbf, 0xf8, 0xac, 0x3a, 0x76,
+		0x21, 0x36, 0xdf, 0xf1, 0x5e, 0x83, 0x26, 0x74, 0x4a, 0xcb, 0xce, 0x3d,
+		0x62, 0xf4, 0x17, 0x77, 0x83, 0x5b, 0xcf, 0xfd, 0xc1, 0x1c, 0xe6, 0xbb,
+		0x77, 0xef, 0xf0, 0x1a, 0xe5, 0xa1, 0x3d, 0xff, 0xd9, 0x8b, 0xa5, 0x08,
+		0x83, 0x1e, 0x4a, 0x33, 0x5b, 0xbd, 0x75, 0xbb, 0x67, 0x31, 0x94, 0x83,
+		0xfb, 0xb5, 0xb4, 0x4c, 0x96, 0x2f, 0xea, 0xbb, 0x0c, 0x21, 0x10, 0x88,
+		0x73, 0xfa, 0xb0, 0x4e, 0xcd, 0x53, 0x55, 0xa2, 0xaa, 0xaa, 0xee, 0xda,
+		0x89, 0xe8, 0xe8, 0x68, 0x9f, 0xea, 0x53, 0x3c, 0x45, 0xc8, 0x72, 0x67,
+		0xfe, 0x97, 0xa7, 0x33, 0xf7, 0x7b, 0x87, 0x84, 0xdc, 0x39, 0xfb, 0xdd,
+		0x71, 0xf9, 0x6c, 0xfd, 0x41, 0xbe, 0x31, 0x3f, 0x1f, 0xf1, 0x86, 0x85,
+		0xbc, 0x89, 0x1c, 0x6d, 0x66, 0x4a, 0xd8, 0xee, 0xc3, 0x12, 0xc9, 0x10,
+		0x11, 0x74, 0x03, 0x8b, 0x69, 0x82, 0x97, 0x73, 0x24, 0x4f, 0xfb, 0x6f,
+		0xb9, 0x0a, 0x10, 0xe7, 0x6b, 0x2f, 0xe7, 0x62, 0x1e, 0xfb, 0x21, 0x14,
+		0xdb, 0xa7, 0x7f, 0xc0, 0xb0, 0x91, 0xf8, 0x5c, 0xcf, 0x4b, 0xfe, 0x4d,
+		0xb1, 0xee, 0xa3, 0xae, 0x26, 0xe7, 0x78, 0x31, 0x0b, 0xaf, 0xad, 0xfc,
+		0x01, 0x64, 0xf2, 0x6e, 0x37, 0x65, 0x84, 0x82, 0x02, 0xd7, 0x62, 0xce,
+		0xdc, 0xdc, 0xdc, 0x7e, 0xe1, 0x04, 0xfb, 0xb6, 0x3b, 0x9d, 0x9e, 0xb8,
+		0xf2, 0xa6, 0x37, 0xa8, 0xb7, 0x19, 0xc7, 0xf1, 0xa0, 0xd3, 0x5d, 0xbe,
+		0x44, 0x53, 0xbe, 0x8a, 0x7a, 0xec, 0xd7, 0xd6, 0xd6, 0x16, 0x23, 0x6e,
+		0x7e, 0xda, 0x21, 0x7a, 0x39, 0x27, 0xa7, 0x53, 0x01, 0x60, 0x3b, 0xd0,
+		0x3e, 0xfe, 0x4a, 0xfc, 0x63, 0x9a, 0x2c, 0xe1, 0x72, 0x62, 0x62, 0x22,
+		0x8b, 0xc5, 0xf2, 0xf1, 0xd9, 0x4f, 0xd6, 0x4c, 0xde, 0x1d, 0xa8, 0x25,
+		0xd7, 0xab, 0xa1, 0x8b, 0x4f, 0x15, 0xee, 0x1a, 0xdc, 0x4a, 0xbb, 0x09,
+		0x55, 0x4f, 0x3d, 0x47, 0x8c, 0x8f, 0x8d, 0xd5, 0xca, 0xee, 0x48, 0x79,
+		0x16, 0x68, 0x79, 0x50, 0xd3, 0xb6, 0x41, 0x24, 0xf2, 0xf2, 0xf4, 0x2c,
+		0x6e, 0xf8, 0xb4, 0xb9, 0xb9, 0x29, 0xa9, 0x09, 0x58, 0x21, 0x9a, 0x55,
+		0x84, 0xf1, 0x3a, 0x26, 0xc3, 0xc2, 0xc3, 0x2d, 0xc3, 0x52, 0xdc, 0x70,
+		0xab, 0x2b, 0x33, 0xae, 0x6b, 0xaa, 0xb1, 0xe6, 0xea, 0x10, 0x5a, 0xef,
+		0xea, 0x6a, 0x43, 0xff, 0x4c, 0x77, 0xfd, 0xd4, 0xbd, 0xdb, 0x38, 0x43,
+		0x43, 0x43, 0x3a, 0x9d, 0x4e, 0xe2, 0x1b, 0x76, 0x9f, 0x89, 0x97, 0xcf,
+		0xc4, 0x89, 0x13, 0x27, 0x66, 0xb2, 0x3b, 0x82, 0xea, 0x1a, 0x1a, 0x1a,
+		0x62, 0x2d, 0x4b, 0xf3, 0x48, 0xf6, 0xfa, 0x79, 0x2b, 0x2b, 0x2b, 0xd2,
+		0x82, 0x9f, 0x2e, 0x3f, 0xf6, 0x8b, 0x68, 0x14, 0x57, 0x56, 0x72, 0xd6,
+		0xed, 0xd8, 0xfb, 0x14, 0x11, 0x29, 0x4a, 0x4a, 0x4a, 0x7c, 0x3e, 0x3f,
+		0x9e, 0x34, 0x42, 0xbc, 0x78, 0xf9, 0x32, 0xb1, 0x1b, 0x91, 0x6b, 0x3f,
+		0x35, 0x5c, 0x75, 0x7a, 0xc6, 0x47, 0x2c, 0x39, 0x2f, 0x7a, 0xe2, 0xf7,
+		0xa0, 0xaf, 0xaf, 0x6f, 0x79, 0x79, 0x39, 0xef, 0x91, 0x74, 0x74, 0xf4,
+		0xe3, 0x47, 0xd9, 0xc3, 0x3e, 0xde, 0xd0, 0xc0, 0xc0, 0x80, 0x54, 0x9a,
+		0x81, 0x00, 0x17, 0x35, 0xef, 0x0a, 0x04, 0x5f, 0x93, 0x48, 0xb4, 0xb5,
+		0x23, 0x59, 0x59, 0x59, 0x56, 0x56, 0x56, 0x3e, 0xaf, 0x51, 0x34, 0xc1,
+		0x90, 0x85, 0x85, 0x85, 0x75, 0x59, 0xe4, 0x85, 0x0b, 0xef, 0x3d, 0x25,
+		0x76, 0xbc, 0xbb, 0xf4, 0x96, 0x04, 0xe9, 0xe4, 0x52, 0x70, 0x6b, 0xff,
+		0xa5, 0xab, 0x85, 0x69, 0xc8, 0xf2, 0xf2, 0xf2, 0x51, 0x2b, 0x0a, 0x7b,
+		0x67, 0x7c, 0x63, 0x4b, 0x70, 0xf7, 0x6e, 0xdf, 0x62, 0x7a, 0x48, 0x48,
+		0xc8, 0xc1, 0x6c, 0x81, 0x50, 0x38, 0x5b, 0xe6, 0x9b, 0xb4, 0xb5, 0x7e,
+		0x91, 0xc9, 0xb4, 0x50, 0xcb, 0x28, 0x0e, 0x4e, 0xbe, 0x8d, 0xab, 0xac,
+		0xbc, 0x51, 0x50, 0xb0, 0xb1, 0xbe, 0xfe, 0x2e, 0xae, 0x2e, 0x31, 0x24,
+		0x64, 0x7a, 0xb2, 0x23, 0x3b, 0xf4, 0x27, 0x1f, 0xaf, 0x61, 0xdf, 0xc6,
+		0x88, 0xa5, 0x25, 0x10, 0x86, 0x2c, 0x72, 0x7e, 0xd3, 0x96, 0xae, 0x7a,
+		0xe1, 0xc2, 0x85, 0x99, 0x31, 0x2f, 0x5f, 0x5f, 0x5f, 0x26, 0x93, 0x09,
+		0x89, 0x00, 0x7b, 0xfa, 0xfa, 0xe2, 0x9b, 0x5f, 0x17, 0x67, 0x1a, 0x1d,
+		0xb4, 0x49, 0xc2, 0xcb, 0xf6, 0xbd, 0xa8, 0x57, 0x5a, 0x9c, 0xee, 0xd6,
+		0xac, 0x91, 0xf0, 0xab, 0x9a, 0xa5, 0xe1, 0x8f, 0xd6, 0xd7, 0xd7, 0x47,
+		0x46, 0x46, 0xf2, 0x10, 0x1d, 0x33, 0x87, 0xf3, 0x1d, 0xe3, 0x9a, 0x5f,
+		0xcb, 0x64, 0x32, 0xbf, 0xb9, 0x5a, 0x91, 0x48, 0x24, 0x10, 0x28, 0x40,
+		0xa6, 0xa6, 0x65, 0x2b, 0x33, 0xe4, 0x31, 0x41, 0x65, 0xe5, 0xc6, 0xc2,
+		0x58, 0xbf, 0xcc, 0x6e, 0x3d, 0x3b, 0x60, 0x2a, 0x61, 0x89, 0x2b, 0x7f,
+		0x13, 0x8f, 0x1e, 0x91, 0x60, 0x39, 0xd7, 0x2e, 0x99, 0x5b, 0x5a, 0x5b,
+		0x97, 0xe6, 0x29, 0x65, 0xe0, 0x1b, 0xe4, 0x0b, 0x44, 0xa2, 0x79, 0x49,
+		0x1f, 0xc1, 0x92, 0x50, 0x40, 0x13, 0x84, 0x86, 0x86, 0x4a, 0x46, 0x46,
+		0xae, 0x77, 0x05, 0xfb, 0xa7, 0x34, 0x78, 0xe3, 0x55, 0x0f, 0x5a, 0x76,
+		0xfe, 0xc0, 0xd8, 0x05, 0xe9, 0xf9, 0x56, 0x3f, 0xaf, 0x88, 0xc7, 0xdb,
+		0x0d, 0x83, 0xa6, 0x91, 0x8b, 0x7f, 0x0f, 0x12, 0x3e, 0x78, 0x10, 0x23,
+		0x7e, 0x65, 0x66, 0x66, 0xb6, 0xd3, 0xf4, 0x8d, 0xe3, 0x1d, 0x0f, 0x2e,
+		0x97, 0x9b, 0xd4, 0xca, 0x8a, 0x8c, 0xac, 0x09, 0xac, 0x3e, 0x29, 0x3f,
+		0xbb, 0xbc, 0x6e, 0x45, 0x66, 0xb2, 0x8b, 0x7d, 0x86, 0xe4, 0xbd, 0xa1,
+		0xf7, 0x82, 0xa6, 0xed, 0x01, 0x5d, 0x5d, 0x38, 0xf4, 0x4a, 0x63, 0xe4,
+		0x98, 0x01, 0xc7, 0xc3, 0xcb, 0x6b, 0xfa, 0x92, 0xf9, 0x87, 0x18, 0xf9,
+		0x75, 0xb5, 0xee, 0xe8, 0x64, 0x77, 0xec, 0xcb, 0xa0, 0xe2, 0xd4, 0x39,
+		0x1d, 0x93, 0x75, 0xde, 0x78, 0x2d, 0x65, 0x8d, 0xed, 0xd3, 0x5d, 0x0b,
+		0x1b, 0xdd, 0xd2, 0x7d, 0x87, 0x51, 0xe8, 0xf4, 0xc9, 0xce, 0x93, 0xb9,
+		0x5d, 0xc1, 0x2a, 0x49, 0x67, 0x9f, 0x16, 0x53, 0xb1, 0xb9, 0xf8, 0xc6,
+		0x97, 0xa9, 0xe3, 0x67, 0xcd, 0x1f, 0x22, 0x41, 0x58, 0x1f, 0xe3, 0xc7,
+		0x91, 0xfb, 0x99, 0x59, 0x59, 0x0e, 0xbf, 0xfc, 0xd6, 0x94, 0x09, 0xc5,
+		0xe3, 0xf1, 0x03, 0xaf, 0xba, 0x32, 0x2b, 0xa0, 0x30, 0xe8, 0x95, 0x92,
+		0x12, 0xdd, 0xcd, 0xcd, 0x80, 0x25, 0x59, 0x82, 0xbc, 0x7b, 0x60, 0xe0,
+		0x99, 0x5f, 0x27, 0x16, 0xdf, 0x4b, 0x6a, 0x66, 0xdf, 0xfa, 0x14, 0x16,
+		0x17, 0x53, 0x81, 0xa1, 0xfa, 0xfa, 0x7a, 0x5b, 0x4d, 0x05, 0x07, 0x78,
+		0x67, 0xb0, 0x69, 0x55, 0x55, 0x15, 0xf1, 0x71, 0x29, 0x15, 0xc3, 0x56,
+		0x94, 0x4a, 0xa5, 0x47, 0xe7, 0xbf, 0x4e, 0x70, 0x84, 0x0b, 0xdb, 0xed,
+		0xd5, 0x14, 0x4d, 0x08, 0x84, 0xe3, 0x33, 0x23, 0x45, 0xb8, 0x38, 0x0e,
+		0x9b, 0x0a, 0x3d, 0xac, 0xa6, 0xf8, 0x4d, 0x63, 0x1f, 0x35, 0xcd, 0x16,
+		0x03, 0x03, 0xe2, 0x72, 0x67, 0xba, 0x40, 0x18, 0xbb, 0xb5, 0x56, 0x2c,
+		0xe6, 0x02, 0x77, 0xb1, 0x07, 0x54, 0x86, 0xaa, 0xd7, 0x1e, 0xd6, 0xd5,
+		0x61, 0x1c, 0xda, 0xf1, 0xc9, 0x3c, 0x15, 0xb5, 0xd0, 0x1e, 0xec, 0xbd,
+		0x59, 0x74, 0x54, 0x7b, 0x05, 0x12, 0xad, 0x96, 0x31, 0x35, 0x25, 0xfa,
+		0x51, 0xe8, 0xed, 0xeb, 0xcb, 0xa5, 0x62, 0xc1, 0x40, 0x44, 0x30, 0xf3,
+		0x29, 0xb7, 0x09, 0xf3, 0x94, 0x95, 0x33, 0x51, 0x80, 0xd7, 0xa3, 0x96,
+		0xbb, 0xc3, 0x28, 0x40, 0x1c, 0xd9, 0xd2, 0x92, 0x0a, 0x60, 0x62, 0x7f,
+		0xb1, 0x03, 0xdb, 0x9f, 0x81, 0x6e, 0x95, 0xc1, 0xa6, 0xfb, 0x0d, 0x9e,
+		0x4a, 0x03, 0x91, 0xe1, 0x88, 0xa0, 0x3a, 0xad, 0x31, 0x1b, 0x2b, 0x1d,
+		0xd9, 0xf6, 0x39, 0x35, 0x28, 0xf8, 0x6c, 0x4d, 0x15, 0xcd, 0x46, 0xbe,
+		0x88, 0xa2, 0xc8, 0xc3, 0x05, 0xd6, 0x49, 0x16, 0x7a, 0x72, 0xbe, 0x47,
+		0xc4, 0xc1, 0x3b, 0x37, 0x0a, 0x42, 0x20, 0x10, 0xe5, 0x3d, 0x7a, 0x57,
+		0x76, 0x09, 0xe1, 0x39, 0x67, 0x8d, 0x54, 0x91, 0x14, 0xb9, 0x6d, 0x03,
+		0x90, 0xd4, 0x71, 0x35, 0xf0, 0x7f, 0x14, 0x09, 0x54, 0x68, 0x8e, 0xff,
+		0xf5, 0x3b, 0x97, 0x48, 0xe8, 0xfc, 0x92, 0x02, 0xd1, 0x98, 0x87, 0xcb,
+		0xf7, 0xa4, 0x00, 0xc7, 0x3d, 0x7c, 0x7d, 0x9d, 0x08, 0x29, 0x4d, 0xd0,
+		0x17, 0xc3, 0xc3, 0x83, 0x3d, 0xe8, 0x1a, 0x20, 0x3f, 0x3f, 0x9f, 0x1c,
+		0xd0, 0x40, 0x57, 0x0b, 0xee, 0xe4, 0xdb, 0x5d, 0xbd, 0x5a, 0x01, 0xe6,
+		0x7c, 0x2d, 0x84, 0xbf, 0x9d, 0x9b, 0x0b, 0xc1, 0x25, 0x9c, 0xf9, 0x10,
+		0xc3, 0x8c, 0x8c, 0x34, 0x86, 0x16, 0x42, 0xf8, 0xbd, 0x23, 0x83, 0x83,
+		0xc7, 0xca, 0xac, 0x51, 0xba, 0xba, 0xba, 0x24, 0xfe, 0x1e, 0x88, 0xb3,
+		0x2d, 0x83, 0x41, 0x48, 0x3c, 0x63, 0xc3, 0xbb, 0xeb, 0x70, 0xfd, 0x2b,
+		0x1f, 0x58, 0xed, 0x99, 0x6a, 0x9a, 0x20, 0xaf, 0xb4, 0x5a, 0x41, 0x30,
+		0x44, 0x36, 0x35, 0x0d, 0x12, 0x9d, 0xd9, 0xfb, 0xd4, 0x53, 0x59, 0x59,
+		0xd9, 0x44, 0xb7, 0x82, 0xe0, 0xae, 0xc1, 0xc5, 0xeb, 0x1e, 0xc7, 0x42,
+		0x88, 0x2e, 0x3a, 0xda, 0xda, 0xd7, 0xa7, 0xd2, 0xe7, 0x7a, 0xbc, 0xab,
+		0x4f, 0x09, 0x93, 0xf4, 0xf1, 0x1e, 0xa2, 0x07, 0x6d, 0x13, 0x6f, 0x17,
+		0x16, 0x04, 0x05, 0xa1, 0xc7, 0x1e, 0x7d, 0xc4, 0xfd, 0x90, 0x64, 0x76,
+		0x31, 0x28, 0x28, 0x88, 0xc5, 0x2a, 0x9b, 0xdf, 0x3e, 0x72, 0xe8, 0xd0,
+		0xa1, 0xe9, 0xe9, 0xe9, 0xfa, 0x12, 0x51, 0x05, 0x77, 0xea, 0xd5, 0x63,
+		0x46, 0x7a, 0xdc, 0x2d, 0x9b, 0xb0, 0x88, 0x88, 0x1b, 0xb5, 0x1b, 0xdd,
+		0xbe, 0x90, 0x54, 0xa4, 0xed, 0x4f, 0x81, 0x26, 0xe6, 0xd6, 0xd6, 0x46,
+		0x71, 0x92, 0xc8, 0xf0, 0xf0, 0x0f, 0x6f, 0xdf, 0xde, 0xab, 0xac, 0xbc,
+		0xbe, 0xb2, 0x7a, 0x47, 0x63, 0x7c, 0xe3, 0xc8, 0x62, 0x2b, 0x6b, 0xa7,
+		0xe5, 0xc9, 0x13, 0x83, 0x09, 0xee, 0x77, 0x1a, 0xdc, 0xe9, 0x89, 0xb6,
+		0xf4, 0xeb, 0xad, 0x26, 0x15, 0x8b, 0xd3, 0x53, 0x36, 0x0e, 0x77, 0x3c,
+		0x14, 0x14, 0x14, 0x6e, 0xb9, 0xe1, 0x96, 0x58, 0xce, 0x8b, 0xb4, 0xe6,
+		0xe1, 0xf3, 0x72, 0x33, 0x43, 0xa1, 0x50, 0x31, 0x62, 0xfa, 0xe7, 0x5c,
+		0xc6, 0xb4, 0x19, 0xfa, 0xc3, 0xe4, 0x8e, 0x78, 0xcc, 0x04, 0x90, 0x7b,
+		0x3e, 0xf0, 0x0f, 0xfc, 0x3f, 0xff, 0x07, 0xd8, 0x32, 0x93, 0x7e, 0xfe,
+		0xb1, 0xfe, 0x52, 0xab, 0xad, 0xf7, 0x3b, 0xac, 0xcd, 0xd5, 0x59, 0x9b,
+		0x46, 0x72, 0x4b, 0xf3, 0xb6, 0xa1, 0xab, 0xce, 0x84, 0x03, 0x2b, 0xfa,
+		0x63, 0xc0, 0x5a, 0x59, 0x6e, 0x69, 0xe2, 0xf7, 0x36, 0xe5, 0x93, 0xcc,
+		0x01, 0xc6, 0x65, 0xcc, 0x3d, 0x00, 0xf8, 0x1c, 0x9e, 0x5d, 0x61, 0x2c,
+		0x9f, 0xb5, 0x9d, 0xab, 0xa8, 0xf7, 0x92, 0xf9, 0x86, 0xd0, 0x0a, 0xbd,
+		0x4f, 0x22, 0xac, 0xde, 0x09, 0xb9, 0x65, 0x02, 0x68, 0x18, 0x0a, 0x70,
+		0x44, 0xb5, 0x03, 0x00, 0x28, 0xcf, 0x2a, 0xc0, 0xd6, 0x04, 0x81, 0x33,
+		0xbb, 0xd6, 0x7f, 0x29, 0xb4, 0x6c, 0x69, 0xe0, 0xe1, 0x74, 0xdc, 0x35,
+		0xff, 0x51, 0x86, 0x4d, 0x92, 0xbf, 0x74, 0x41, 0xc7, 0x04, 0xf1, 0x5f,
+		0xc3, 0x7e, 0xa2, 0xbe, 0x61, 0xcd, 0xde, 0x3e, 0x9f, 0xd7, 0xca, 0x90,
+		0x10, 0x0a, 0xfa, 0x13, 0x01, 0x40, 0x2e, 0x1f, 0x68, 0xbd, 0x2a, 0x81,
+		0x0c, 0x1d, 0x87, 0x7f, 0xe6, 0x68, 0xcc, 0x91, 0x61, 0x88, 0xd0, 0x60,
+		0x17, 0x0a, 0x48, 0xbd, 0x09, 0xfd, 0x99, 0xf8, 0x86, 0xdf, 0x38, 0xc2,
+		0xfa, 0x76, 0xc6, 0x66, 0x63, 0x32, 0x9a, 0xbd, 0x25, 0x57, 0xaf, 0xa5,
+		0xaa, 0xb1, 0x67, 0x6f, 0x41, 0xff, 0xb5, 0xa6, 0xa3, 0xb2, 0x31, 0x60,
+		0x26, 0x5f, 0x72, 0xb2, 0xe0, 0xf6, 0x7e, 0xcb, 0xcf, 0xbf, 0x29, 0x07,
+		0x3b, 0x1a, 0xf5, 0x81, 0x6d, 0x60, 0xf2, 0xdf, 0xb0, 0xbb, 0xff, 0xf1,
+		0x6d, 0x09, 0x00, 0x00,
+	},
+		"offhours.png",
+	)
+}
+
 // Asset loads and returns the asset for the given name.
 // It returns an error if the asset could not be found or
 // could not be loaded.
@@ -201,7 +408,8 @@ func AssetNames() []string {
 
 // _bindata is a table, holding each asset generator, mapped to its name.
 var _bindata = map[string]func() ([]byte, error){
-	"noimage.png": noimage_png,
+	"noimage.png":  noimage_png,
+	"offhours.png": offhours_png,
 }
 
 // AssetDir returns the file names below a certain
@@ -242,5 +450,6 @@ type _bintree_t struct {
 }
 
 var _bintree = &_bintree_t{nil, map[string]*_bintree_t{
-	"noimage.png": &_bintree_t{noimage_png, map[string]*_bintree_t{}},
+	"noimage.png":  &_bintree_t{noimage_png, map[string]*_bintree_t{}},
+	"offhours.png": &_bintree_t{offhours_png, map[string]*_bintree_t{}},
 }}
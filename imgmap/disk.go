@@ -0,0 +1,201 @@
+package imgmap
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// diskLatestName は最新の画像のタイムスタンプを記録するファイルの名前
+const diskLatestName = "latest"
+
+// NewDiskStore は dir 以下に画像を保存する Store を生成する関数。
+// dir が無いときは作成する。
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+// DiskStore はディスクに画像を保存する Store の実装。
+// 画像は <dir>/<key>/<timestamp> に保存し、最新の画像のタイムスタンプを <dir>/<key>/latest に記録する。
+// MIME タイプは保存しておらず、読み込み時に画像データから判定する。
+// dir を NFS などで共有すれば、複数のサーバで画像を共有できる。
+type DiskStore struct {
+	dir string
+}
+
+// Save はディスクに画像を保存する関数。
+// 書き込み途中のファイルを読まれないよう、一時ファイルに書き込んでから名前を変更する。
+func (s *DiskStore) Save(key int32, i *Img) (err error) {
+	d := s.keyDir(key)
+	if err = os.MkdirAll(d, 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(d, ".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(i.Data); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), s.path(key, i.Timestamp)); err != nil {
+		return
+	}
+	return s.setLatest(key, i.Timestamp)
+}
+
+// setLatest は key の最新の画像のタイムスタンプとして timestamp を記録する関数。
+// 記録済みのタイムスタンプより古いときは記録しない。
+func (s *DiskStore) setLatest(key int32, timestamp int64) (err error) {
+	if t, ok := s.latest(key); ok && t >= timestamp {
+		return nil
+	}
+	f, err := ioutil.TempFile(s.keyDir(key), ".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.WriteString(strconv.FormatInt(timestamp, 10)); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), filepath.Join(s.keyDir(key), diskLatestName))
+}
+
+// latest は記録した key の最新の画像のタイムスタンプを返す関数。記録が無いときは false を返す。
+func (s *DiskStore) latest(key int32) (int64, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(s.keyDir(key), diskLatestName))
+	if err != nil {
+		return 0, false
+	}
+	t, err := strconv.ParseInt(string(b), 10, 64)
+	return t, err == nil
+}
+
+// Latest はディスクから最新の画像を取得する関数。
+// 記録した最新の画像のタイムスタンプを使い、画像の一覧は読まない。
+// 記録が無いときと、記録した画像が無いときは、画像の一覧から最新の画像を探す。
+func (s *DiskStore) Latest(key int32) (*Img, error) {
+	if t, ok := s.latest(key); ok {
+		i, err := s.Find(key, t)
+		if err != nil || i != nil {
+			return i, err
+		}
+	}
+	ts, err := s.timestamps(key)
+	if err != nil || len(ts) == 0 {
+		return nil, err
+	}
+	return s.Find(key, ts[len(ts)-1])
+}
+
+// Find はディスクからタイムスタンプが timestamp の画像を取得する関数。
+func (s *DiskStore) Find(key int32, timestamp int64) (*Img, error) {
+	b, err := ioutil.ReadFile(s.path(key, timestamp))
+	if os.IsNotExist(err) {
+		// 存在しない、または他のサーバが削除した
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &Img{Data: b, Timestamp: timestamp, ContentType: http.DetectContentType(b)}, nil
+}
+
+// Timestamps はディスクにある画像のタイムスタンプを取得する関数。
+func (s *DiskStore) Timestamps(key int32, since, until int64) ([]int64, error) {
+	ts, err := s.timestamps(key)
+	if err != nil {
+		return nil, err
+	}
+	from := sort.Search(len(ts), func(j int) bool { return ts[j] >= since })
+	to := sort.Search(len(ts), func(j int) bool { return ts[j] > until })
+	if from >= to {
+		return []int64{}, nil
+	}
+	return ts[from:to], nil
+}
+
+// Prune はディスクから古い画像を削除する関数。
+func (s *DiskStore) Prune(key int32, count int, before int64) error {
+	ts, err := s.timestamps(key)
+	if err != nil {
+		return err
+	}
+	n := 0
+	if count > 0 && len(ts) > count {
+		n = len(ts) - count
+	}
+	for n < len(ts)-1 && ts[n] < before {
+		n++
+	}
+	for _, t := range ts[:n] {
+		if err := os.Remove(s.path(key, t)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyDir は key の画像を保存するディレクトリを返す関数。
+func (s *DiskStore) keyDir(key int32) string {
+	return filepath.Join(s.dir, strconv.FormatInt(int64(key), 10))
+}
+
+// path は key のタイムスタンプが timestamp の画像のパスを返す関数。
+func (s *DiskStore) path(key int32, timestamp int64) string {
+	return filepath.Join(s.keyDir(key), strconv.FormatInt(timestamp, 10))
+}
+
+// timestamps は key の保存済み画像のタイムスタンプを古い順に返す関数。
+func (s *DiskStore) timestamps(key int32) ([]int64, error) {
+	f, err := os.Open(s.keyDir(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	ts := make([]int64, 0, len(names))
+	for _, n := range names {
+		t, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			// 一時ファイルや最新の画像の記録など
+			continue
+		}
+		ts = append(ts, t)
+	}
+	sort.Sort(int64s(ts))
+	return ts, nil
+}
+
+// int64s は []int64 をソートするための型
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
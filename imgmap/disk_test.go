@@ -0,0 +1,52 @@
+package imgmap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStoreLatest(t *testing.T) {
+	tests := []struct {
+		name string
+		// marker は latest に書き込む内容。空のときは変更せず、- のときは latest を削除する
+		marker string
+	}{
+		{"recorded", ""},
+		{"not recorded", "-"},
+		{"recorded image deleted", "99"},
+		{"broken record", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewDiskStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			saveAll(t, s, 1, 10, 30, 20)
+			latest := filepath.Join(s.keyDir(1), diskLatestName)
+			b, err := ioutil.ReadFile(latest)
+			if err != nil || string(b) != "30" {
+				t.Fatalf("latest = %q, %v, want 30", b, err)
+			}
+			switch tt.marker {
+			case "":
+			case "-":
+				// 記録する前に保存した画像
+				if err = os.Remove(latest); err != nil {
+					t.Fatal(err)
+				}
+			default:
+				if err = ioutil.WriteFile(latest, []byte(tt.marker), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			i, err := s.Latest(1)
+			if err != nil || i == nil || i.Timestamp != 30 || string(i.Data) != "frame30" {
+				t.Errorf("Latest = %v, %v, want frame30", i, err)
+			}
+		})
+	}
+}
@@ -1,56 +1,138 @@
 // パッケージ imgmap はユーザ画像の管理を行うパッケージ。
 // 新しいイメージマップを生成し、画像の保存、画像の取得を行うサンプル。
-//     m := imgmap.New()
-//     m.Set(1, userimagebytes)
-//     imgbytes, err := m.Get(1)
+//     m := imgmap.New(imgmap.NewMemStore(), imgmap.Retention{Count: 360, Age: 24 * time.Hour})
+//     err := m.Set(1, userimagebytes, "image/png")
+//     img, err := m.Get(1, 30*time.Second)
+// 画像の保存先は Store インタフェースを実装したものであれば差し替えられる。
+// このパッケージはメモリ (MemStore)、ディスク (DiskStore)、MySQL (DBStore) の実装を提供する。
 package imgmap
 
 import (
 	"sync"
 	"time"
+
+	"github.com/marcie001/mizumanju/hub"
 )
 
-// New は新しいイメージマップを生成する関数。
-func New() *ImgMap {
-	return &ImgMap{m: make(map[int32]*img)}
+// New は store を保存先とする新しいイメージマップを生成する関数。
+// 過去の画像は retention に従って保持する。
+func New(store Store, retention Retention) *ImgMap {
+	return &ImgMap{
+		store:     store,
+		retention: retention,
+		variants:  make(map[int32]*variantSet),
+	}
 }
 
 // ImgMap はイメージマップの構造体。
+// variants は最新の画像を縮小した画像のキャッシュで、mu で保護する。
+// hub が nil でないときは、画像を保存するたびに hub.Frame イベントを配信する。
 type ImgMap struct {
-	sync.RWMutex
-	m map[int32]*img
+	store     Store
+	retention Retention
+	mu        sync.Mutex
+	variants  map[int32]*variantSet
+	hub       *hub.Hub
+}
+
+// SetHub は画像を保存したことを配信するハブを設定する関数。
+func (images *ImgMap) SetHub(h *hub.Hub) {
+	images.hub = h
+}
+
+// Retention は過去の画像の保持期間の設定。
+// Count 枚を超える画像と Age より古い画像は削除する。
+// 0 のときはその条件では削除しない。ただし、最新の画像は常に保持する。
+type Retention struct {
+	Count int
+	Age   time.Duration
 }
 
-// img はユーザ画像情報の構造体。
-// timestamp は画像の有効期間を判定するときに使う。
-type img struct {
-	data      []byte
-	timestamp int64
+// Img はユーザ画像情報の構造体。
+// Timestamp は画像の有効期間を判定するときに使う。
+// ContentType は Data の MIME タイプ。
+// Stale は画像が無い、または有効期間が過ぎているため、Data が画像が無いことを表す画像であることを表す。
+type Img struct {
+	Data        []byte
+	Timestamp   int64
+	ContentType string
+	Stale       bool
 }
 
-// Get はレシーバから画像データを取得する関数。
+// Get はレシーバから有効期間 ttl の画像を取得する関数。
 // キーに対する画像が登録されていないとき、または有効期間が過ぎているときは、
-// 画像が無いことを表す画像を返す。
-func (images *ImgMap) Get(key int32) ([]byte, error) {
+// 画像が無いことを表す画像を返す。このとき Timestamp は最後の画像のタイムスタンプ (無いときは 0) になる。
+func (images *ImgMap) Get(key int32, ttl time.Duration) (*Img, error) {
 	now := time.Now().Unix()
-	images.RLock()
-	i := images.m[key]
-	images.RUnlock()
+	i, err := images.store.Latest(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if i != nil && i.Timestamp > now-int64(ttl/time.Second) {
+		return i, nil
+	}
+	n, err := noImage()
+	if err != nil {
+		return nil, err
+	}
+	if i != nil {
+		n.Timestamp = i.Timestamp
+	}
+	return n, nil
+}
 
-	if i != nil && i.timestamp > now-30 {
-		return i.data, nil
+// Latest は有効期間に関わらず key の最新の画像を返す関数。画像が無いときは nil を返す。
+func (images *ImgMap) Latest(key int32) (*Img, error) {
+	return images.store.Latest(key)
+}
+
+// noImage は画像が無いことを表す画像を返す関数。
+func noImage() (*Img, error) {
+	b, err := Asset("noimage.png")
+	if err != nil {
+		return nil, err
+	}
+	return &Img{Data: b, ContentType: "image/png", Stale: true}, nil
+}
+
+// OffHours は勤務時間外であることを表す画像を返す関数。
+func OffHours() (*Img, error) {
+	b, err := Asset("offhours.png")
+	if err != nil {
+		return nil, err
 	}
-	return Asset("noimage.png")
+	return &Img{Data: b, ContentType: "image/png", Stale: true}, nil
 }
 
-// Get はレシーバに画像データを保存する関数。
-func (images *ImgMap) Set(key int32, imgdata []byte) {
-	i := &img{
-		data:      imgdata,
-		timestamp: time.Now().Unix(),
+// Set はレシーバに MIME タイプが contentType の画像データを保存する関数。
+// 保存後、ハブに配信し、保持期間を過ぎた画像を削除する。
+func (images *ImgMap) Set(key int32, imgdata []byte, contentType string) error {
+	i := &Img{
+		Data:        imgdata,
+		Timestamp:   time.Now().Unix(),
+		ContentType: contentType,
+	}
+
+	if err := images.store.Save(key, i); err != nil {
+		return err
+	}
+	if images.hub != nil {
+		images.hub.Publish(hub.Event{Type: hub.Frame, UserId: key, Timestamp: i.Timestamp})
+	}
+	var before int64
+	if images.retention.Age > 0 {
+		before = i.Timestamp - int64(images.retention.Age/time.Second)
 	}
+	return images.store.Prune(key, images.retention.Count, before)
+}
+
+// History は since 以上 until 以下に保存された画像のタイムスタンプを古い順に返す関数。
+func (images *ImgMap) History(key int32, since, until int64) ([]int64, error) {
+	return images.store.Timestamps(key, since, until)
+}
 
-	images.Lock()
-	images.m[key] = i
-	images.Unlock()
+// At はタイムスタンプが timestamp の画像を返す関数。画像が無いときは nil を返す。
+func (images *ImgMap) At(key int32, timestamp int64) (*Img, error) {
+	return images.store.Find(key, timestamp)
 }
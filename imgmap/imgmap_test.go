@@ -0,0 +1,111 @@
+package imgmap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/marcie001/mizumanju/hub"
+)
+
+func TestGet(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		saved     []int64
+		wantStale bool
+		wantTime  int64
+	}{
+		{"no image", nil, true, 0},
+		{"fresh", []int64{now - 100, now - 10}, false, now - 10},
+		// 有効期間が過ぎていても、最後の画像のタイムスタンプを返す
+		{"expired", []int64{now - 100, now - 60}, true, now - 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemStore()
+			saveAll(t, s, 1, tt.saved...)
+			i, err := New(s, Retention{}).Get(1, 30*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i.Stale != tt.wantStale || i.Timestamp != tt.wantTime {
+				t.Errorf("Get = (stale %v, %d), want (stale %v, %d)", i.Stale, i.Timestamp, tt.wantStale, tt.wantTime)
+			}
+			if tt.wantStale && i.ContentType != "image/png" {
+				t.Errorf("ContentType = %s, want image/png", i.ContentType)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := NewMemStore()
+	saveAll(t, s, 1, 10, 20, 30, 40)
+	images := New(s, Retention{})
+
+	tests := []struct {
+		name         string
+		since, until int64
+		want         []int64
+	}{
+		{"all", 0, 100, []int64{10, 20, 30, 40}},
+		{"inclusive", 20, 30, []int64{20, 30}},
+		{"between frames", 21, 29, nil},
+		{"after last", 41, 100, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := images.History(1, tt.since, tt.until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ts) != len(tt.want) || len(ts) > 0 && !reflect.DeepEqual(ts, tt.want) {
+				t.Errorf("History = %v, want %v", ts, tt.want)
+			}
+			for _, timestamp := range ts {
+				if i, err := images.At(1, timestamp); err != nil || i == nil || i.Timestamp != timestamp {
+					t.Errorf("At(%d) = %v, %v", timestamp, i, err)
+				}
+			}
+		})
+	}
+	if i, err := images.At(1, 25); err != nil || i != nil {
+		t.Errorf("At(25) = %v, %v, want nil", i, err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s := NewMemStore()
+	now := time.Now().Unix()
+	saveAll(t, s, 1, now-7200, now-120, now-60)
+	images := New(s, Retention{Count: 3, Age: time.Hour})
+	h := hub.New()
+	images.SetHub(h)
+	sub := h.Subscribe()
+	defer sub.Close()
+
+	if err := images.Set(1, []byte("new"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	i, err := images.Latest(1)
+	if err != nil || i == nil || string(i.Data) != "new" || i.ContentType != "image/jpeg" {
+		t.Fatalf("Latest = %v, %v, want new", i, err)
+	}
+	select {
+	case e := <-sub.C:
+		if e.Type != hub.Frame || e.UserId != 1 || e.Timestamp != i.Timestamp {
+			t.Errorf("event = %+v, want a frame of user 1", e)
+		}
+	default:
+		t.Error("frame event not published")
+	}
+	// 保持期間を過ぎた画像は削除する
+	ts, err := images.History(1, 0, i.Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{now - 120, now - 60, i.Timestamp}; !reflect.DeepEqual(ts, want) {
+		t.Errorf("History = %v, want %v", ts, want)
+	}
+}
@@ -0,0 +1,39 @@
+package imgmap
+
+import (
+	"image"
+)
+
+const (
+	// 差分を計算するときに縮小する画像の幅
+	diffWidth = 32
+	// 差分を計算するときに縮小する画像の高さ
+	diffHeight = 24
+)
+
+// Diff は a と b の差分の大きさを 0 から 1 の値で返す関数。
+// 両方を小さく縮小してから輝度の差の絶対値の平均を求めるため、細かなノイズの影響は受けにくい。
+func Diff(a, b image.Image) float64 {
+	la, lb := luminance(a), luminance(b)
+	var sum int
+	for i := range la {
+		d := int(la[i]) - int(lb[i])
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return float64(sum) / float64(len(la)*0xff)
+}
+
+// luminance は img を diffWidth x diffHeight に縮小した各画素の輝度を返す関数。
+func luminance(img image.Image) []uint8 {
+	s := Scale(img, diffWidth, diffHeight)
+	l := make([]uint8, 0, diffWidth*diffHeight)
+	for o := 0; o < len(s.Pix); o += 4 {
+		// ITU-R BT.601 の係数
+		y := (299*int(s.Pix[o]) + 587*int(s.Pix[o+1]) + 114*int(s.Pix[o+2])) / 1000
+		l = append(l, uint8(y))
+	}
+	return l
+}
@@ -0,0 +1,56 @@
+package imgmap
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// uniform は幅 w、高さ h で c の色の画像を返す関数。
+func uniform(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestDiff(t *testing.T) {
+	gray := uniform(320, 240, color.Gray{0x80})
+	noisy := uniform(320, 240, color.Gray{0x80})
+	// 数画素だけ変わっても、縮小すると差分はほとんど無い
+	for i := 0; i < 10; i++ {
+		noisy.Set(i*31, i*23, color.White)
+	}
+	half := uniform(320, 240, color.Black)
+	for y := 0; y < 240; y++ {
+		for x := 160; x < 320; x++ {
+			half.Set(x, y, color.White)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		a, b     image.Image
+		min, max float64
+	}{
+		{"identical", gray, gray, 0, 0},
+		{"black and white", uniform(320, 240, color.Black), uniform(320, 240, color.White), 1, 1},
+		{"noise", gray, noisy, 0, 0.02},
+		{"half changed", uniform(320, 240, color.Black), half, 0.45, 0.55},
+		// 大きさが異なっても比較できる
+		{"different sizes", gray, uniform(64, 48, color.Gray{0x80}), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := Diff(tt.a, tt.b); d < tt.min || d > tt.max {
+				t.Errorf("Diff = %f, want between %f and %f", d, tt.min, tt.max)
+			}
+			if d, r := Diff(tt.a, tt.b), Diff(tt.b, tt.a); d != r {
+				t.Errorf("Diff is not symmetric: %f, %f", d, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package imgmap
+
+import (
+	"database/sql"
+)
+
+const (
+	// 画像登録/更新 SQL
+	sqlUpsertImage string = "INSERT INTO user_images (user_id, data, captured, content_type) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE data = ?, content_type = ?"
+	// 最新画像取得 SQL
+	sqlFindLatestImage string = "SELECT data, captured, content_type FROM user_images WHERE user_id = ? ORDER BY captured DESC LIMIT 1"
+	// 画像取得 SQL
+	sqlFindImage string = "SELECT data, captured, content_type FROM user_images WHERE user_id = ? AND captured = ?"
+	// タイムスタンプ取得 SQL
+	sqlFindImageTimestamps string = "SELECT captured FROM user_images WHERE user_id = ? AND captured BETWEEN ? AND ? ORDER BY captured"
+	// 枚数超過画像削除 SQL。新しい方から count 枚目より古い画像を削除する
+	sqlDeleteImagesOverCount string = "DELETE FROM user_images WHERE user_id = ? AND captured < (SELECT captured FROM (SELECT captured FROM user_images WHERE user_id = ? ORDER BY captured DESC LIMIT 1 OFFSET ?) t)"
+	// 期限切れ画像削除 SQL。最新の画像は削除しない
+	sqlDeleteImagesBefore string = "DELETE FROM user_images WHERE user_id = ? AND captured < ? AND captured < (SELECT captured FROM (SELECT MAX(captured) AS captured FROM user_images WHERE user_id = ?) t)"
+)
+
+// NewDBStore は MySQL の user_images テーブルに画像を保存する Store を生成する関数。
+func NewDBStore(db *sql.DB) *DBStore {
+	return &DBStore{db: db}
+}
+
+// DBStore は MySQL に画像を BLOB として保存する Store の実装。
+type DBStore struct {
+	db *sql.DB
+}
+
+// Save は MySQL に画像を保存する関数。
+func (s *DBStore) Save(key int32, i *Img) error {
+	_, err := s.db.Exec(sqlUpsertImage, key, i.Data, i.Timestamp, i.ContentType, i.Data, i.ContentType)
+	return err
+}
+
+// Latest は MySQL から最新の画像を取得する関数。
+func (s *DBStore) Latest(key int32) (*Img, error) {
+	return s.find(sqlFindLatestImage, key)
+}
+
+// Find は MySQL からタイムスタンプが timestamp の画像を取得する関数。
+func (s *DBStore) Find(key int32, timestamp int64) (*Img, error) {
+	return s.find(sqlFindImage, key, timestamp)
+}
+
+// find は query で画像を 1 枚取得する関数。
+func (s *DBStore) find(query string, args ...interface{}) (*Img, error) {
+	i := &Img{}
+	err := s.db.QueryRow(query, args...).Scan(&i.Data, &i.Timestamp, &i.ContentType)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return i, nil
+}
+
+// Timestamps は MySQL にある画像のタイムスタンプを取得する関数。
+func (s *DBStore) Timestamps(key int32, since, until int64) (ts []int64, err error) {
+	ts = make([]int64, 0, 64)
+	rows, err := s.db.Query(sqlFindImageTimestamps, key, since, until)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rerr := rows.Close(); err == nil {
+			err = rerr
+		}
+	}()
+	for rows.Next() {
+		var t int64
+		if err = rows.Scan(&t); err != nil {
+			return
+		}
+		ts = append(ts, t)
+	}
+	err = rows.Err()
+	return
+}
+
+// Prune は MySQL から古い画像を削除する関数。
+func (s *DBStore) Prune(key int32, count int, before int64) error {
+	if count > 0 {
+		if _, err := s.db.Exec(sqlDeleteImagesOverCount, key, key, count-1); err != nil {
+			return err
+		}
+	}
+	if before > 0 {
+		if _, err := s.db.Exec(sqlDeleteImagesBefore, key, before, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package imgmap
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// ぼかしの半径を画像の長辺に対する割合で表したときの分母
+	blurDivisor = 40
+	// モザイクの 1 区画の大きさを画像の長辺に対する割合で表したときの分母
+	pixelateDivisor = 24
+)
+
+var (
+	// シルエットの暗い部分の色
+	silhouetteDark = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	// シルエットの明るい部分の色
+	silhouetteLight = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+)
+
+// Blur は src をぼかした画像を返す関数。
+// 画像の大きさに応じた半径のボックスブラーを縦横 2 回ずつかける。
+func Blur(src image.Image) *image.RGBA {
+	dst := copyRGBA(src)
+	radius := longSide(dst.Rect) / blurDivisor
+	if radius < 1 {
+		radius = 1
+	}
+	for i := 0; i < 2; i++ {
+		boxBlur(dst, radius, true)
+		boxBlur(dst, radius, false)
+	}
+	return dst
+}
+
+// Pixelate は src にモザイクをかけた画像を返す関数。
+func Pixelate(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	block := longSide(b) / pixelateDivisor
+	if block < 2 {
+		block = 2
+	}
+	w, h := (b.Dx()+block-1)/block, (b.Dy()+block-1)/block
+	return Scale(Scale(src, w, h), b.Dx(), b.Dy())
+}
+
+// Silhouette は src をぼかしてから 2 色にした、輪郭だけがわかる画像を返す関数。
+// 平均より暗い画素を暗い色、それ以外を明るい色にする。
+func Silhouette(src image.Image) *image.RGBA {
+	dst := Blur(src)
+	lum := make([]uint8, 0, dst.Rect.Dx()*dst.Rect.Dy())
+	var sum uint64
+	for o := 0; o < len(dst.Pix); o += 4 {
+		y := color.GrayModel.Convert(color.RGBA{dst.Pix[o], dst.Pix[o+1], dst.Pix[o+2], 0xff}).(color.Gray).Y
+		lum = append(lum, y)
+		sum += uint64(y)
+	}
+	if len(lum) == 0 {
+		return dst
+	}
+	mean := uint8(sum / uint64(len(lum)))
+	for n, y := range lum {
+		c := silhouetteLight
+		if y < mean {
+			c = silhouetteDark
+		}
+		o := n * 4
+		dst.Pix[o], dst.Pix[o+1], dst.Pix[o+2], dst.Pix[o+3] = c.R, c.G, c.B, c.A
+	}
+	return dst
+}
+
+// boxBlur は img に半径 radius のボックスブラーを横方向 (horizontal が true のとき) または縦方向にかける関数。
+func boxBlur(img *image.RGBA, radius int, horizontal bool) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	lines, length, step, stride := h, w, 4, img.Stride
+	if !horizontal {
+		lines, length, step, stride = w, h, img.Stride, 4
+	}
+	line := make([]uint8, length*4)
+	for l := 0; l < lines; l++ {
+		base := l * stride
+		for i := 0; i < length; i++ {
+			copy(line[i*4:i*4+4], img.Pix[base+i*step:base+i*step+4])
+		}
+		var sum [4]int
+		// 範囲外は端の画素で埋めたものとして扱う
+		at := func(i int) int {
+			if i < 0 {
+				return 0
+			}
+			if i >= length {
+				return (length - 1) * 4
+			}
+			return i * 4
+		}
+		for i := -radius; i <= radius; i++ {
+			o := at(i)
+			for c := 0; c < 4; c++ {
+				sum[c] += int(line[o+c])
+			}
+		}
+		n := radius*2 + 1
+		for i := 0; i < length; i++ {
+			d := base + i*step
+			for c := 0; c < 4; c++ {
+				img.Pix[d+c] = uint8(sum[c] / n)
+			}
+			in, out := at(i+radius+1), at(i-radius)
+			for c := 0; c < 4; c++ {
+				sum[c] += int(line[in+c]) - int(line[out+c])
+			}
+		}
+	}
+}
+
+// copyRGBA は src を原点から始まる新しい *image.RGBA にコピーする関数。
+func copyRGBA(src image.Image) *image.RGBA {
+	rgba := toRGBA(src)
+	if rgba == src {
+		c := *rgba
+		c.Pix = append([]uint8(nil), rgba.Pix...)
+		return &c
+	}
+	return rgba
+}
+
+// longSide は r の長辺の長さを返す関数。
+func longSide(r image.Rectangle) int {
+	if r.Dx() > r.Dy() {
+		return r.Dx()
+	}
+	return r.Dy()
+}
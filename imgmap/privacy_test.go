@@ -0,0 +1,94 @@
+package imgmap
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// halfImage は左半分が黒、右半分が白の画像を返す関数。
+func halfImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x >= w/2 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+func TestPrivacyFilters(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter func(image.Image) *image.RGBA
+	}{
+		{"blur", Blur},
+		{"pixelate", Pixelate},
+		{"silhouette", Silhouette},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := halfImage(96, 64)
+			orig := append([]uint8(nil), src.Pix...)
+			dst := tt.filter(src)
+			if dst.Bounds() != src.Bounds() {
+				t.Errorf("bounds = %v, want %v", dst.Bounds(), src.Bounds())
+			}
+			if string(src.Pix) != string(orig) {
+				t.Error("source image modified")
+			}
+		})
+	}
+}
+
+func TestBlur(t *testing.T) {
+	dst := Blur(halfImage(96, 64))
+	// 境界の画素は黒と白の中間になり、境界から離れた画素は元の色のまま
+	if r, _, _, _ := dst.At(48, 32).RGBA(); r>>8 < 0x40 || r>>8 > 0xc0 {
+		t.Errorf("edge = %d, want a middle gray", r>>8)
+	}
+	if r, _, _, _ := dst.At(0, 32).RGBA(); r != 0 {
+		t.Errorf("left = %d, want black", r>>8)
+	}
+	if r, _, _, _ := dst.At(95, 32).RGBA(); r>>8 != 0xff {
+		t.Errorf("right = %d, want white", r>>8)
+	}
+}
+
+func TestPixelate(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			src.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 3), 0, 0xff})
+		}
+	}
+	dst := Pixelate(src)
+	// 96 / pixelateDivisor = 4 画素の区画の中は同じ色になる
+	block := 96 / pixelateDivisor
+	for y := 0; y < 64; y += block {
+		for x := 0; x < 96; x += block {
+			c := dst.RGBAAt(x+1, y+1)
+			if got := dst.RGBAAt(x+block-2, y+block-2); got != c {
+				t.Fatalf("block at (%d, %d) has %v and %v", x, y, c, got)
+			}
+		}
+	}
+}
+
+func TestSilhouette(t *testing.T) {
+	dst := Silhouette(halfImage(96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			if c := dst.RGBAAt(x, y); c != silhouetteDark && c != silhouetteLight {
+				t.Fatalf("color at (%d, %d) = %v, want one of two colors", x, y, c)
+			}
+		}
+	}
+	if dst.RGBAAt(0, 32) != silhouetteDark || dst.RGBAAt(95, 32) != silhouetteLight {
+		t.Errorf("dark and light sides not kept")
+	}
+}
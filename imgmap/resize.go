@@ -0,0 +1,71 @@
+package imgmap
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Resize は src を幅 width に縮小した画像を返す関数。高さは縦横比を保つ。
+// width が 0 以下、または src の幅以上のときは src をそのまま返す。
+func Resize(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if width <= 0 || width >= b.Dx() {
+		return src
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	return Scale(src, width, height)
+}
+
+// Scale は src を幅 width、高さ height に拡大縮小した画像を返す関数。
+// 縮小は対応する範囲の画素の平均 (面積平均法)、拡大は最近傍法で行う。
+func Scale(src image.Image, width, height int) *image.RGBA {
+	s := toRGBA(src)
+	sw, sh := s.Rect.Dx(), s.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy0 := y * sh / height
+		sy1 := (y + 1) * sh / height
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < width; x++ {
+			sx0 := x * sw / width
+			sx1 := (x + 1) * sw / width
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				o := sy*s.Stride + sx0*4
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint32(s.Pix[o])
+					g += uint32(s.Pix[o+1])
+					b += uint32(s.Pix[o+2])
+					a += uint32(s.Pix[o+3])
+					o += 4
+					n++
+				}
+			}
+			d := y*dst.Stride + x*4
+			dst.Pix[d] = uint8(r / n)
+			dst.Pix[d+1] = uint8(g / n)
+			dst.Pix[d+2] = uint8(b / n)
+			dst.Pix[d+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// toRGBA は src を原点から始まる *image.RGBA に変換する関数。
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == image.ZP {
+		return rgba
+	}
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, src, b.Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,109 @@
+package imgmap
+
+import (
+	"sort"
+	"sync"
+)
+
+// Store は画像の保存先を表すインタフェース。
+// 複数のサーバで画像を共有する場合は、共有できる保存先の実装を使う。
+type Store interface {
+	// Save は key の画像として i を保存する。
+	Save(key int32, i *Img) error
+	// Latest は key の最新の画像を返す。画像が無いときは nil を返す。
+	Latest(key int32) (*Img, error)
+	// Find は key のタイムスタンプが timestamp の画像を返す。画像が無いときは nil を返す。
+	Find(key int32, timestamp int64) (*Img, error)
+	// Timestamps は key の since 以上 until 以下の画像のタイムスタンプを古い順に返す。
+	Timestamps(key int32, since, until int64) ([]int64, error)
+	// Prune は key の新しい方から count 枚を超える画像と before より古い画像を削除する。
+	// count, before が 0 のときはその条件では削除しない。最新の画像は削除しない。
+	Prune(key int32, count int, before int64) error
+}
+
+// NewMemStore はプロセス内のメモリに画像を保存する Store を生成する関数。
+func NewMemStore() *MemStore {
+	return &MemStore{m: make(map[int32][]*Img)}
+}
+
+// MemStore はメモリに画像を保存する Store の実装。
+// 画像はキーごとに古い順に保持する。サーバを再起動すると画像は失われる。
+type MemStore struct {
+	mu sync.RWMutex
+	m  map[int32][]*Img
+}
+
+// Save はメモリに画像を保存する関数。
+func (s *MemStore) Save(key int32, i *Img) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frames := s.m[key]
+	n := sort.Search(len(frames), func(j int) bool { return frames[j].Timestamp >= i.Timestamp })
+	switch {
+	case n < len(frames) && frames[n].Timestamp == i.Timestamp:
+		frames[n] = i
+	case n == len(frames):
+		s.m[key] = append(frames, i)
+	default:
+		frames = append(frames, nil)
+		copy(frames[n+1:], frames[n:])
+		frames[n] = i
+		s.m[key] = frames
+	}
+	return nil
+}
+
+// Latest はメモリから最新の画像を取得する関数。
+func (s *MemStore) Latest(key int32) (*Img, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	frames := s.m[key]
+	if len(frames) == 0 {
+		return nil, nil
+	}
+	return frames[len(frames)-1], nil
+}
+
+// Find はメモリからタイムスタンプが timestamp の画像を取得する関数。
+func (s *MemStore) Find(key int32, timestamp int64) (*Img, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	frames := s.m[key]
+	n := sort.Search(len(frames), func(j int) bool { return frames[j].Timestamp >= timestamp })
+	if n < len(frames) && frames[n].Timestamp == timestamp {
+		return frames[n], nil
+	}
+	return nil, nil
+}
+
+// Timestamps はメモリにある画像のタイムスタンプを取得する関数。
+func (s *MemStore) Timestamps(key int32, since, until int64) ([]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ts := make([]int64, 0, len(s.m[key]))
+	for _, i := range s.m[key] {
+		if since <= i.Timestamp && i.Timestamp <= until {
+			ts = append(ts, i.Timestamp)
+		}
+	}
+	return ts, nil
+}
+
+// Prune はメモリから古い画像を削除する関数。
+func (s *MemStore) Prune(key int32, count int, before int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frames := s.m[key]
+	n := 0
+	if count > 0 && len(frames) > count {
+		n = len(frames) - count
+	}
+	for n < len(frames)-1 && frames[n].Timestamp < before {
+		n++
+	}
+	if n > 0 {
+		// 古い画像を参照し続けないようにコピーする
+		s.m[key] = append(make([]*Img, 0, len(frames)-n+1), frames[n:]...)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package imgmap
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// stores はテストする Store を生成する関数を返す関数。
+func stores(t *testing.T) map[string]func() Store {
+	return map[string]func() Store{
+		"memory": func() Store { return NewMemStore() },
+		"disk": func() Store {
+			s, err := NewDiskStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+}
+
+// saveAll は key の画像としてタイムスタンプが ts の画像を順に保存する関数。
+func saveAll(t *testing.T, s Store, key int32, ts ...int64) {
+	for _, timestamp := range ts {
+		if err := s.Save(key, &Img{Data: []byte(fmt.Sprint("frame", timestamp)), Timestamp: timestamp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	for name, newStore := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			s := newStore()
+			if i, err := s.Latest(1); err != nil || i != nil {
+				t.Fatalf("Latest of an empty key = %v, %v, want nil", i, err)
+			}
+
+			// 古い順に保存されなくても、タイムスタンプの順に扱う
+			saveAll(t, s, 1, 30, 10, 20)
+			saveAll(t, s, 2, 5)
+			if err := s.Save(1, &Img{Data: []byte("replaced"), Timestamp: 20}); err != nil {
+				t.Fatal(err)
+			}
+
+			i, err := s.Latest(1)
+			if err != nil || i == nil || i.Timestamp != 30 || string(i.Data) != "frame30" {
+				t.Errorf("Latest = %v, %v, want frame30", i, err)
+			}
+			if i, err = s.Find(1, 20); err != nil || i == nil || string(i.Data) != "replaced" {
+				t.Errorf("Find(20) = %v, %v, want replaced", i, err)
+			}
+			if i, err = s.Find(1, 15); err != nil || i != nil {
+				t.Errorf("Find(15) = %v, %v, want nil", i, err)
+			}
+			ts, err := s.Timestamps(1, 15, 30)
+			if err != nil || !reflect.DeepEqual(ts, []int64{20, 30}) {
+				t.Errorf("Timestamps(15, 30) = %v, %v, want [20 30]", ts, err)
+			}
+			if ts, err = s.Timestamps(1, 31, 40); err != nil || len(ts) != 0 {
+				t.Errorf("Timestamps(31, 40) = %v, %v, want []", ts, err)
+			}
+			if ts, err = s.Timestamps(2, 0, 100); err != nil || !reflect.DeepEqual(ts, []int64{5}) {
+				t.Errorf("Timestamps of key 2 = %v, %v, want [5]", ts, err)
+			}
+		})
+	}
+}
+
+func TestStorePrune(t *testing.T) {
+	tests := []struct {
+		name   string
+		count  int
+		before int64
+		want   []int64
+	}{
+		{"no limits", 0, 0, []int64{10, 20, 30, 40, 50}},
+		{"count", 3, 0, []int64{30, 40, 50}},
+		{"count above stored", 10, 0, []int64{10, 20, 30, 40, 50}},
+		{"age", 0, 35, []int64{40, 50}},
+		{"age at a timestamp", 0, 30, []int64{30, 40, 50}},
+		{"age stricter than count", 3, 45, []int64{50}},
+		{"count stricter than age", 2, 25, []int64{40, 50}},
+		{"count one", 1, 0, []int64{50}},
+		// 最新の画像は保持期間を過ぎても削除しない
+		{"keep newest", 0, 100, []int64{50}},
+	}
+	for name, newStore := range stores(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				s := newStore()
+				saveAll(t, s, 1, 10, 20, 30, 40, 50)
+				saveAll(t, s, 2, 10)
+				if err := s.Prune(1, tt.count, tt.before); err != nil {
+					t.Fatal(err)
+				}
+				ts, err := s.Timestamps(1, 0, 100)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(ts, tt.want) {
+					t.Errorf("Timestamps = %v, want %v", ts, tt.want)
+				}
+				if i, err := s.Latest(1); err != nil || i == nil || i.Timestamp != 50 {
+					t.Errorf("Latest = %v, %v, want 50", i, err)
+				}
+				// 他のキーの画像は削除しない
+				if ts, err := s.Timestamps(2, 0, 100); err != nil || !reflect.DeepEqual(ts, []int64{10}) {
+					t.Errorf("Timestamps of key 2 = %v, %v, want [10]", ts, err)
+				}
+			})
+		}
+	}
+}
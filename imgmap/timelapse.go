@@ -0,0 +1,84 @@
+package imgmap
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+)
+
+const (
+	// タイムラプスの最大フレーム数。これを超える場合は間引く
+	MaxTimelapseFrames = 300
+)
+
+// ErrNoFrames はタイムラプスにするフレームが無いことを表すエラー
+var ErrNoFrames = errors.New("No frames")
+
+// Timelapse は from 以上 to 以下に保存された画像をつなげたアニメーション GIF を w に書き出す関数。
+// 各フレームは幅 width に縮小し (2 枚目以降は 1 枚目と同じ大きさにする)、fps フレーム/秒で再生する。
+// フレームが MaxTimelapseFrames を超えるときは等間隔に間引く。
+// 画像として読めないフレームは飛ばす。
+func (images *ImgMap) Timelapse(w io.Writer, key int32, from, to int64, fps int, width int) error {
+	ts, err := images.History(key, from, to)
+	if err != nil {
+		return err
+	}
+	ts = sample(ts, MaxTimelapseFrames)
+
+	delay := 100 / fps
+	if delay < 2 {
+		// 多くのブラウザは 2/100 秒未満の遅延を正しく扱わない
+		delay = 2
+	}
+	anim := &gif.GIF{}
+	var rect image.Rectangle
+	for _, t := range ts {
+		i, err := images.At(key, t)
+		if err != nil {
+			return err
+		}
+		if i == nil {
+			// 取得までの間に削除された
+			continue
+		}
+		src, _, err := image.Decode(bytes.NewReader(i.Data))
+		if err != nil {
+			log.Printf("Skip frame. Key: %d, Timestamp: %d, Error: %s", key, t, err)
+			continue
+		}
+		if len(anim.Image) == 0 {
+			src = Resize(src, width)
+			rect = image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy())
+		} else {
+			// GIF は全フレームが最初のフレームの範囲に収まる必要がある
+			src = Scale(src, rect.Dx(), rect.Dy())
+		}
+		frame := image.NewPaletted(rect, palette.Plan9)
+		draw.FloydSteinberg.Draw(frame, frame.Rect, src, src.Bounds().Min)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	if len(anim.Image) == 0 {
+		return ErrNoFrames
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// sample は ts から最大 max 個の要素を等間隔に取り出す関数。
+func sample(ts []int64, max int) []int64 {
+	if len(ts) <= max {
+		return ts
+	}
+	s := make([]int64, max)
+	for i := range s {
+		s[i] = ts[i*len(ts)/max]
+	}
+	return s
+}
@@ -0,0 +1,93 @@
+package imgmap
+
+import (
+	"bytes"
+	"image/color"
+	"image/gif"
+	"reflect"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   []int64
+		max  int
+		want []int64
+	}{
+		{"empty", nil, 3, nil},
+		{"fewer than max", []int64{1, 2}, 3, []int64{1, 2}},
+		{"equal to max", []int64{1, 2, 3}, 3, []int64{1, 2, 3}},
+		{"half", []int64{1, 2, 3, 4, 5, 6}, 3, []int64{1, 3, 5}},
+		{"uneven", []int64{1, 2, 3, 4, 5, 6, 7}, 3, []int64{1, 3, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sample(tt.ts, tt.max); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sample = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimelapse(t *testing.T) {
+	s := NewMemStore()
+	// 2 枚目以降は大きさが異なっても 1 枚目の大きさにそろえる
+	for ts, data := range map[int64][]byte{
+		10: testPNG(t, 64, 48, color.White),
+		20: testPNG(t, 32, 32, color.Black),
+		30: []byte("broken"),
+		40: testPNG(t, 128, 96, color.White),
+	} {
+		if err := s.Save(1, &Img{Data: data, Timestamp: ts}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	images := New(s, Retention{})
+
+	tests := []struct {
+		name       string
+		from, to   int64
+		fps, width int
+		wantFrames int
+		wantDelay  int
+		wantWidth  int
+		wantHeight int
+	}{
+		{"all", 0, 100, 10, 32, 3, 10, 32, 24},
+		{"range", 15, 35, 10, 32, 1, 10, 32, 32},
+		{"slow", 0, 100, 1, 32, 3, 100, 32, 24},
+		// 2/100 秒より短い遅延にはしない
+		{"fast", 0, 100, 100, 32, 3, 2, 32, 24},
+		{"wider than original", 10, 10, 10, 640, 1, 10, 64, 48},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			if err := images.Timelapse(buf, 1, tt.from, tt.to, tt.fps, tt.width); err != nil {
+				t.Fatal(err)
+			}
+			anim, err := gif.DecodeAll(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(anim.Image) != tt.wantFrames {
+				t.Fatalf("frames = %d, want %d", len(anim.Image), tt.wantFrames)
+			}
+			for n, frame := range anim.Image {
+				if anim.Delay[n] != tt.wantDelay {
+					t.Errorf("delay of frame %d = %d, want %d", n, anim.Delay[n], tt.wantDelay)
+				}
+				if b := frame.Bounds(); b.Dx() != tt.wantWidth || b.Dy() != tt.wantHeight {
+					t.Errorf("size of frame %d = %dx%d, want %dx%d", n, b.Dx(), b.Dy(), tt.wantWidth, tt.wantHeight)
+				}
+			}
+		})
+	}
+
+	for _, r := range [][2]int64{{11, 19}, {30, 30}, {50, 100}} {
+		if err := images.Timelapse(new(bytes.Buffer), 1, r[0], r[1], 10, 32); err != ErrNoFrames {
+			t.Errorf("Timelapse(%d, %d) err = %v, want %v", r[0], r[1], err, ErrNoFrames)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package imgmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sync"
+	"time"
+)
+
+// JPEG にエンコードするときの品質
+const jpegQuality = 85
+
+// variantWidths は縮小画像の幅。指定された幅はこのいずれかに切り上げるため、1 枚の画像の縮小画像はこの数までになる
+var variantWidths = []int{160, 320, 480, 640, 960, 1280, 1920}
+
+// variantSet は内容のハッシュが sum の画像を縮小した画像の集合。
+// 同じ秒に保存した画像を区別するため、タイムスタンプではなく内容で最新の画像を判定する。
+type variantSet struct {
+	sum [sha256.Size]byte
+	m   map[int]*variant
+}
+
+// variant は縮小画像。生成は一度だけ行う。
+type variant struct {
+	once sync.Once
+	img  *Img
+	err  error
+}
+
+// GetWidth は key の有効期間 ttl の最新の画像を幅 width 以下に縮小した画像を返す関数。
+// width は variantWidths のいずれかに切り上げ、最大のものより大きいときは縮小しない。
+// 縮小画像は最新の画像ごとにキャッシュし、同じ幅の縮小は一度だけ行う。
+// width が 0 以下、または元の画像の幅以上のときは Get と同じ画像を返す。
+func (images *ImgMap) GetWidth(key int32, ttl time.Duration, width int) (*Img, error) {
+	i, err := images.Get(key, ttl)
+	if err != nil || width <= 0 || i.Stale {
+		// 画像が無いことを表す画像は縮小しない
+		return i, err
+	}
+	width = variantWidth(width)
+	if width == 0 {
+		return i, nil
+	}
+	sum := sha256.Sum256(i.Data)
+
+	images.mu.Lock()
+	vs := images.variants[key]
+	if vs == nil || vs.sum != sum {
+		vs = &variantSet{sum: sum, m: make(map[int]*variant, len(variantWidths))}
+		images.variants[key] = vs
+	}
+	v := vs.m[width]
+	if v == nil {
+		v = &variant{}
+		vs.m[width] = v
+	}
+	images.mu.Unlock()
+
+	v.once.Do(func() {
+		v.img, v.err = resizeImg(i, width)
+	})
+	return v.img, v.err
+}
+
+// variantWidth は width を variantWidths のうち width 以上で最小の幅に切り上げる関数。
+// 最大の幅より大きいときは 0 を返す。
+func variantWidth(width int) int {
+	for _, w := range variantWidths {
+		if width <= w {
+			return w
+		}
+	}
+	return 0
+}
+
+// resizeImg は i を幅 width に縮小した画像を返す関数。
+// i の幅が width 以下のときは i を返す。
+func resizeImg(i *Img, width int) (*Img, error) {
+	src, _, err := image.Decode(bytes.NewReader(i.Data))
+	if err != nil {
+		return nil, err
+	}
+	if src.Bounds().Dx() <= width {
+		return i, nil
+	}
+	buf := new(bytes.Buffer)
+	if err = Encode(buf, Resize(src, width), i.ContentType); err != nil {
+		return nil, err
+	}
+	return &Img{
+		Data:        buf.Bytes(),
+		Timestamp:   i.Timestamp,
+		ContentType: i.ContentType,
+	}, nil
+}
+
+// JPEG は i を JPEG に変換した画像を返す関数。i が JPEG のときは i を返す。
+func JPEG(i *Img) (*Img, error) {
+	if i.ContentType == "image/jpeg" {
+		return i, nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(i.Data))
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err = Encode(buf, src, "image/jpeg"); err != nil {
+		return nil, err
+	}
+	return &Img{
+		Data:        buf.Bytes(),
+		Timestamp:   i.Timestamp,
+		ContentType: "image/jpeg",
+		Stale:       i.Stale,
+	}, nil
+}
+
+// Encode は img を MIME タイプ contentType の形式で w に書き出す関数。
+// image/jpeg 以外は PNG で書き出す。
+func Encode(w io.Writer, img image.Image, contentType string) error {
+	if contentType == "image/jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	return png.Encode(w, img)
+}
@@ -0,0 +1,83 @@
+package imgmap
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// testPNG は幅 w、高さ h で c の色の PNG を返す関数。
+func testPNG(t *testing.T, w, h int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVariantWidth(t *testing.T) {
+	tests := []struct {
+		width int
+		want  int
+	}{
+		{1, 160},
+		{160, 160},
+		{161, 320},
+		{500, 640},
+		{1920, 1920},
+		// 最大の幅より大きいときは縮小しない
+		{1921, 0},
+	}
+	for _, tt := range tests {
+		if got := variantWidth(tt.width); got != tt.want {
+			t.Errorf("variantWidth(%d) = %d, want %d", tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestGetWidth(t *testing.T) {
+	images := New(NewMemStore(), Retention{})
+	if err := images.Set(1, testPNG(t, 800, 8, color.White), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := images.GetWidth(1, time.Minute, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _, err := image.DecodeConfig(bytes.NewReader(a.Data)); err != nil || c.Width != 320 {
+		t.Errorf("width = %d, %v, want 320", c.Width, err)
+	}
+	// 同じ幅に切り上げる幅はキャッシュした縮小画像を返す
+	if b, err := images.GetWidth(1, time.Minute, 310); err != nil || b != a {
+		t.Errorf("GetWidth(310) was not cached")
+	}
+	orig, err := images.Get(1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full, err := images.GetWidth(1, time.Minute, 4000); err != nil || !bytes.Equal(full.Data, orig.Data) {
+		t.Errorf("GetWidth(4000) resized the image")
+	}
+
+	// 同じ秒に保存した画像でも、新しい画像を縮小する
+	if err := images.Set(1, testPNG(t, 800, 8, color.Black), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := images.GetWidth(1, time.Minute, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a.Data, b.Data) {
+		t.Error("variant of the previous image returned")
+	}
+}
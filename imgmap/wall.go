@@ -0,0 +1,119 @@
+package imgmap
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// 壁の 1 枚あたりの画像の幅
+	wallTileWidth = 320
+	// 壁の 1 枚あたりの画像の高さ
+	wallTileHeight = 240
+	// 壁の画像と名前の余白
+	wallPadding = 4
+)
+
+var (
+	// 壁の背景色
+	wallBackground = color.RGBA{0x22, 0x22, 0x22, 0xff}
+	// 壁の名前の色
+	wallForeground = color.RGBA{0xee, 0xee, 0xee, 0xff}
+)
+
+// Tile は壁に並べる 1 枚を表す構造体。
+// Key の有効期間 TTL の最新の画像の下に Label を描く。
+type Tile struct {
+	Key   int32
+	Label string
+	TTL   time.Duration
+}
+
+// Wall は tiles の最新の画像を格子状に並べ、各画像の下に名前を描いた JPEG を w に書き出す関数。
+// 名前は face で描く。画像が無い、または有効期間が過ぎているときは、画像が無いことを表す画像を並べる。
+func (images *ImgMap) Wall(w io.Writer, tiles []Tile, face font.Face) error {
+	cols := int(math.Ceil(math.Sqrt(float64(len(tiles)))))
+	if cols == 0 {
+		cols = 1
+	}
+	rows := (len(tiles) + cols - 1) / cols
+	if rows == 0 {
+		rows = 1
+	}
+	m := face.Metrics()
+	labelHeight := (m.Ascent + m.Descent).Ceil() + wallPadding*2
+	cellHeight := wallTileHeight + labelHeight
+
+	dst := image.NewRGBA(image.Rect(0, 0, cols*wallTileWidth, rows*cellHeight))
+	draw.Draw(dst, dst.Rect, image.NewUniform(wallBackground), image.ZP, draw.Src)
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(wallForeground),
+		Face: face,
+	}
+	for n, t := range tiles {
+		origin := image.Pt(n%cols*wallTileWidth, n/cols*cellHeight)
+		i, err := images.GetWidth(t.Key, t.TTL, wallTileWidth)
+		if err != nil {
+			return err
+		}
+		src, _, err := image.Decode(bytes.NewReader(i.Data))
+		if err != nil {
+			log.Printf("Skip tile. Key: %d, Error: %s", t.Key, err)
+		} else {
+			fit := fitRect(src.Bounds(), image.Rect(0, 0, wallTileWidth, wallTileHeight)).Add(origin)
+			draw.Draw(dst, fit, Scale(src, fit.Dx(), fit.Dy()), image.ZP, draw.Src)
+		}
+
+		label := truncate(face, t.Label, wallTileWidth-wallPadding*2)
+		d.Dot = fixed.Point26_6{
+			X: fixed.I(origin.X+wallTileWidth/2) - d.MeasureString(label)/2,
+			Y: fixed.I(origin.Y+wallTileHeight+wallPadding) + m.Ascent,
+		}
+		d.DrawString(label)
+	}
+	return jpeg.Encode(w, dst, &jpeg.Options{Quality: jpegQuality})
+}
+
+// fitRect は縦横比を保ったまま src を bounds に収めた、bounds の中央に位置する矩形を返す関数。
+func fitRect(src, bounds image.Rectangle) image.Rectangle {
+	w, h := bounds.Dx(), src.Dy()*bounds.Dx()/src.Dx()
+	if h > bounds.Dy() {
+		w, h = src.Dx()*bounds.Dy()/src.Dy(), bounds.Dy()
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	min := bounds.Min.Add(image.Pt((bounds.Dx()-w)/2, (bounds.Dy()-h)/2))
+	return image.Rectangle{min, min.Add(image.Pt(w, h))}
+}
+
+// truncate は face で描いたときに幅 width に収まるよう s を切り詰める関数。
+func truncate(face font.Face, s string, width int) string {
+	max := fixed.I(width)
+	if font.MeasureString(face, s) <= max {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 {
+		r = r[:len(r)-1]
+		t := string(r) + "..."
+		if font.MeasureString(face, t) <= max {
+			return t
+		}
+	}
+	return ""
+}
@@ -0,0 +1,355 @@
+package mizumanju
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/marcie001/mizumanju/hub"
+)
+
+const (
+	// ユーザ DN のテンプレートと検索フィルタでログイン ID に置き換える文字列
+	ldapUsernamePlaceholder = "{username}"
+	// LDAP サーバと通信するときの待ち時間
+	ldapTimeout = 30 * time.Second
+	// 同期するときに 1 度に検索するエントリの数
+	ldapPageSize = 500
+)
+
+// errLDAPConflict はディレクトリのユーザと同じログイン ID のローカルのユーザがいることを表すエラー
+var errLDAPConflict = errors.New("A local user has the same auth ID as the LDAP user.")
+
+// ldapUser はディレクトリのエントリから読み込んだユーザを表す構造体。
+// Role はグループから求めたロールで、どのグループにも所属していないときは空。
+type ldapUser struct {
+	DN     string
+	AuthId string
+	Name   string
+	Email  string
+	Role   string
+}
+
+// ldapAuthenticator は LDAP サーバにバインドしてユーザを認証する Authenticator。
+// 認証したユーザは users に作成または更新し、ディレクトリで管理するユーザとする。
+type ldapAuthenticator struct {
+	cnf *LDAPConf
+}
+
+// ldapEnabled は cnf が LDAP で認証する設定のとき true を返す関数。
+func ldapEnabled(cnf *LDAPConf) bool {
+	return cnf != nil && cnf.URL != ""
+}
+
+// Authenticate は LDAP サーバにユーザとしてバインドして認証する関数。
+// ユーザ DN のテンプレートがあるときはそれにバインドし、無いときは検索したエントリにバインドする。
+func (a *ldapAuthenticator) Authenticate(db *sql.DB, authId, password string) (User, error) {
+	if authId == "" || password == "" {
+		// 空のパスワードでは認証しないまま成功する LDAP サーバがある
+		return User{}, ErrUnauthorized
+	}
+	conn, err := dialLDAP(a.cnf)
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+
+	var dn string
+	if a.cnf.UserDN != "" {
+		dn = strings.Replace(a.cnf.UserDN, ldapUsernamePlaceholder, ldap.EscapeDN(authId), -1)
+	} else {
+		if err = conn.Bind(a.cnf.BindDN, a.cnf.BindPassword); err != nil {
+			return User{}, err
+		}
+		entries, err := searchLDAP(conn, a.cnf, a.cnf.BaseDN, ldap.ScopeWholeSubtree, userFilter(a.cnf, ldap.EscapeFilter(authId)))
+		if err != nil {
+			return User{}, err
+		}
+		if len(entries) != 1 {
+			log.Printf("LDAP user not found or not unique. AuthId: %s, Entries: %d", authId, len(entries))
+			return User{}, ErrUnauthorized
+		}
+		dn = entries[0].DN
+	}
+
+	if err = conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			log.Printf("LDAP bind failed. DN: %s", dn)
+			return User{}, ErrUnauthorized
+		}
+		return User{}, err
+	}
+	// グループはユーザ自身の権限で読み込む
+	entries, err := searchLDAP(conn, a.cnf, dn, ldap.ScopeBaseObject, "(objectClass=*)")
+	if err != nil {
+		return User{}, err
+	}
+	if len(entries) != 1 {
+		return User{}, fmt.Errorf("LDAP entry not found. DN: %s", dn)
+	}
+	lu := newLDAPUser(a.cnf, entries[0])
+	if lu.Role == "" {
+		log.Printf("LDAP user is not a member of any mapped group. DN: %s", dn)
+		return User{}, ErrUnauthorized
+	}
+	if lu.AuthId == "" {
+		lu.AuthId = authId
+	}
+
+	id, err := upsertLDAPUser(db, a.cnf, lu)
+	if err == errLDAPConflict {
+		// ローカルのユーザはそのパスワードで認証する
+		log.Printf("LDAP user conflicts with a local user. AuthId: %s, DN: %s", lu.AuthId, dn)
+		return User{}, ErrUnauthorized
+	} else if err != nil {
+		return User{}, err
+	}
+	return scanLoginUser(db.QueryRow(sqlFindLoginUserById, id))
+}
+
+// dialLDAP は LDAP サーバに接続する関数。
+func dialLDAP(cnf *LDAPConf) (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(cnf.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if cnf.StartTLS {
+		u, err := url.Parse(cnf.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// searchLDAP は base 以下の filter に一致するエントリを、ユーザの読み込みに使う属性とともに検索する関数。
+func searchLDAP(conn *ldap.Conn, cnf *LDAPConf, base string, scope int, filter string) ([]*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, 0, 0, false, filter,
+		[]string{cnf.AuthIdAttr, cnf.NameAttr, cnf.EmailAttr, cnf.GroupAttr}, nil)
+	rslt, err := conn.SearchWithPaging(req, ldapPageSize)
+	if err != nil {
+		return nil, err
+	}
+	return rslt.Entries, nil
+}
+
+// userFilter はユーザを検索するフィルタの {username} を username に置き換える関数。
+// username はエスケープしておくこと。
+func userFilter(cnf *LDAPConf, username string) string {
+	return strings.Replace(cnf.UserFilter, ldapUsernamePlaceholder, username, -1)
+}
+
+// newLDAPUser はエントリからユーザを読み込む関数。
+func newLDAPUser(cnf *LDAPConf, e *ldap.Entry) ldapUser {
+	lu := ldapUser{
+		DN:     e.DN,
+		AuthId: e.GetEqualFoldAttributeValue(cnf.AuthIdAttr),
+		Name:   e.GetEqualFoldAttributeValue(cnf.NameAttr),
+		Email:  e.GetEqualFoldAttributeValue(cnf.EmailAttr),
+		Role:   cnf.role(e.GetEqualFoldAttributeValues(cnf.GroupAttr)),
+	}
+	if lu.Name == "" {
+		lu.Name = lu.AuthId
+	}
+	if n := []rune(lu.Name); len(n) > maxUserNameLength {
+		lu.Name = string(n[:maxUserNameLength])
+	}
+	return lu
+}
+
+// role は所属しているグループの DN からロールを求める関数。
+// 管理者のグループに所属していれば admin、編集者のグループに所属していれば editor とする。
+// どちらのグループも設定していないときは、全員を editor とする。
+func (cnf *LDAPConf) role(groups []string) string {
+	if len(cnf.AdminGroups) == 0 && len(cnf.EditorGroups) == 0 {
+		return editor
+	}
+	switch {
+	case containsDN(cnf.AdminGroups, groups):
+		return admin
+	case containsDN(cnf.EditorGroups, groups):
+		return editor
+	}
+	return ""
+}
+
+// containsDN は groups に want のいずれかと同じ DN が含まれるとき true を返す関数。
+// 属性名と値の大文字と小文字、空白の違いは無視する。
+func containsDN(want, groups []string) bool {
+	for _, g := range groups {
+		gdn, err := ldap.ParseDN(g)
+		if err != nil {
+			continue
+		}
+		for _, w := range want {
+			if wdn, err := ldap.ParseDN(w); err == nil && gdn.EqualFold(wdn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upsertLDAPUser はディレクトリのユーザを users に作成または更新し、ユーザの ID を返す関数。
+// 同じログイン ID のディレクトリで管理するユーザがいるときは、削除されていても更新する。
+// 同じログイン ID のローカルのユーザがいるときは、cnf.AdoptLocal が true なら更新し、false なら errLDAPConflict を返す。
+func upsertLDAPUser(db *sql.DB, cnf *LDAPConf, lu ldapUser) (id int32, err error) {
+	if utf8.RuneCountInString(lu.AuthId) > maxUserNameLength {
+		return 0, fmt.Errorf("LDAP auth ID is too long. DN: %s", lu.DN)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	added := false
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil && added {
+			events.Publish(hub.Event{Type: hub.UserAdded, UserId: id, Timestamp: time.Now().Unix()})
+		}
+	}()
+
+	var deleted, managed bool
+	err = tx.QueryRow(sqlFindLDAPUser, lu.AuthId).Scan(&id, &deleted, &managed)
+	switch {
+	case err == sql.ErrNoRows:
+		rslt, err := tx.Exec(sqlInsertLDAPUser, lu.AuthId, lu.Name, defaultVoiceChatProvider, lu.Role, lu.Email, time.Now(), privacyNone, lu.DN)
+		if err != nil {
+			return 0, err
+		}
+		n, err := rslt.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = int32(n)
+		added = true
+		log.Printf("LDAP user created. ID: %d, AuthId: %s", id, lu.AuthId)
+	case err != nil:
+		return
+	case !managed && !cnf.AdoptLocal:
+		return 0, errLDAPConflict
+	default:
+		if !managed {
+			log.Printf("Local user adopted as LDAP user. ID: %d, AuthId: %s", id, lu.AuthId)
+		}
+		if _, err = tx.Exec(sqlUpdateLDAPUser, lu.Name, lu.Role, lu.Email, lu.DN, id); err != nil {
+			return
+		}
+		added = deleted
+	}
+	if added && cnf.DefaultTeam != 0 {
+		_, err = tx.Exec(sqlInsertTeamMember, cnf.DefaultTeam, id)
+	}
+	return
+}
+
+// SweepLDAPUsers は interval ごとにディレクトリのユーザを同期する関数。
+// 戻らないので goroutine で実行する。
+func SweepLDAPUsers(db *sql.DB, cnf *LDAPConf, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := SyncLDAPUsers(db, cnf); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// SyncLDAPUsers はディレクトリのユーザを users に同期する関数。
+// グループに所属しているユーザを作成または更新し、ディレクトリで管理するユーザのうち、見つからなかったユーザを削除する。
+// ローカルのユーザは、AdoptLocal が false なら更新も削除もしない。
+// 1 人も見つからなかったときは、設定や LDAP サーバの誤りとみなして削除しない。
+func SyncLDAPUsers(db *sql.DB, cnf *LDAPConf) error {
+	if cnf.BaseDN == "" {
+		return errors.New("LDAP base DN is required to sync users.")
+	}
+	conn, err := dialLDAP(cnf)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.Bind(cnf.BindDN, cnf.BindPassword); err != nil {
+		return err
+	}
+	entries, err := searchLDAP(conn, cnf, cnf.BaseDN, ldap.ScopeWholeSubtree, userFilter(cnf, "*"))
+	if err != nil {
+		return err
+	}
+
+	members := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		lu := newLDAPUser(cnf, e)
+		if lu.Role == "" || lu.AuthId == "" {
+			continue
+		}
+		// 更新に失敗しても、ディレクトリにいるユーザは削除しない
+		members[strings.ToLower(lu.AuthId)] = true
+		if _, err := upsertLDAPUser(db, cnf, lu); err == errLDAPConflict {
+			log.Printf("LDAP user conflicts with a local user. Skip syncing. AuthId: %s, DN: %s", lu.AuthId, lu.DN)
+		} else if err != nil {
+			log.Printf("Failed to sync LDAP user. DN: %s, %v", lu.DN, err)
+		}
+	}
+	return removeLDAPUsers(db, members)
+}
+
+// removeLDAPUsers はディレクトリで管理するユーザのうち、ログイン ID が members に無いユーザを削除する関数。
+// members のキーは小文字にしたログイン ID。members が空のときは削除しない。
+func removeLDAPUsers(db *sql.DB, members map[string]bool) error {
+	if len(members) == 0 {
+		return errors.New("No LDAP users found. Skip deleting users.")
+	}
+
+	rows, err := db.Query(sqlFindLDAPUsers)
+	if err != nil {
+		return err
+	}
+	removed := make([]int32, 0, 8)
+	for rows.Next() {
+		var (
+			id     int32
+			authId string
+		)
+		if err = rows.Scan(&id, &authId); err != nil {
+			rows.Close()
+			return err
+		}
+		// auth_id は大文字と小文字を区別しない照合順序
+		if !members[strings.ToLower(authId)] {
+			removed = append(removed, id)
+		}
+	}
+	// 読み込みが途中で失敗したときは、読み込めなかったユーザを削除しないように何も削除しない
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	for _, id := range removed {
+		if _, err := db.Exec(sqlDeleteUser, id); err != nil {
+			log.Printf("Failed to delete LDAP user. ID: %d, %v", id, err)
+			continue
+		}
+		log.Printf("LDAP user deleted. ID: %d", id)
+		events.Publish(hub.Event{Type: hub.UserDeleted, UserId: id, Timestamp: time.Now().Unix()})
+	}
+	return nil
+}
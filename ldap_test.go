@@ -0,0 +1,176 @@
+package mizumanju
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/marcie001/mizumanju/hub"
+)
+
+func TestLDAPRole(t *testing.T) {
+	admins := []string{"cn=admins,ou=groups,dc=example,dc=com"}
+	editors := []string{"cn=editors,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"}
+	tests := []struct {
+		name    string
+		admins  []string
+		editors []string
+		groups  []string
+		want    string
+	}{
+		{"admin", admins, editors, []string{"cn=admins,ou=groups,dc=example,dc=com"}, admin},
+		{"admin and editor", admins, editors, []string{"cn=staff,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"}, admin},
+		{"editor", admins, editors, []string{"cn=staff,ou=groups,dc=example,dc=com"}, editor},
+		// 属性名と値の大文字と小文字、空白の違いは無視する
+		{"case and spaces", admins, editors, []string{"CN=Admins, OU=Groups, DC=example, DC=com"}, admin},
+		{"other group", admins, editors, []string{"cn=guests,ou=groups,dc=example,dc=com"}, ""},
+		{"similar DN", admins, editors, []string{"cn=admins,ou=other,dc=example,dc=com"}, ""},
+		{"invalid DN", admins, editors, []string{"admins"}, ""},
+		{"no groups", admins, editors, nil, ""},
+		{"admin groups only", admins, nil, []string{"cn=staff,ou=groups,dc=example,dc=com"}, ""},
+		// どちらのグループも設定していないときは全員を editor とする
+		{"no mapping", nil, nil, nil, editor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cnf := &LDAPConf{AdminGroups: tt.admins, EditorGroups: tt.editors}
+			if got := cnf.role(tt.groups); got != tt.want {
+				t.Errorf("role = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpsertLDAPUser(t *testing.T) {
+	errLookup := errors.New("lookup failed")
+	lu := ldapUser{DN: "uid=user01,ou=people,dc=example,dc=com", AuthId: "user01", Name: "User 01", Email: "user01@example.com", Role: editor}
+	tests := []struct {
+		name       string
+		adopt      bool
+		found      func([]driver.Value) fakeQuery
+		wantErr    error
+		wantId     int32
+		wantInsert bool
+		wantUpdate bool
+		wantAdded  bool
+	}{
+		{"new", false, fakeNoRows, nil, 5, true, false, true},
+		{"managed", false, fakeRow(int64(3), false, true), nil, 3, false, true, false},
+		// 削除されたユーザは作り直したものとみなす
+		{"managed and deleted", false, fakeRow(int64(3), true, true), nil, 3, false, true, true},
+		{"local", false, fakeRow(int64(3), false, false), errLDAPConflict, 0, false, false, false},
+		{"local adopted", true, fakeRow(int64(3), false, false), nil, 3, false, true, false},
+		{"lookup failed", false, func([]driver.Value) fakeQuery { return fakeQuery{err: errLookup} }, errLookup, 0, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindLDAPUser: tt.found,
+				sqlInsertLDAPUser: func([]driver.Value) fakeQuery {
+					return fakeQuery{affected: 1, lastId: 5}
+				},
+				sqlUpdateLDAPUser:   fakeAffected(1),
+				sqlInsertTeamMember: fakeAffected(1),
+			})
+			defer db.Close()
+			sub := events.Subscribe()
+			defer sub.Close()
+
+			id, err := upsertLDAPUser(db, &LDAPConf{DefaultTeam: 2, AdoptLocal: tt.adopt}, lu)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if id != tt.wantId {
+				t.Errorf("id = %d, want %d", id, tt.wantId)
+			}
+			if _, ok := fakeDriver.executed(sqlInsertLDAPUser); ok != tt.wantInsert {
+				t.Errorf("inserted = %v, want %v", ok, tt.wantInsert)
+			}
+			if _, ok := fakeDriver.executed(sqlUpdateLDAPUser); ok != tt.wantUpdate {
+				t.Errorf("updated = %v, want %v", ok, tt.wantUpdate)
+			}
+			// 追加したユーザだけを既定のチームに所属させ、追加を配信する
+			args, ok := fakeDriver.executed(sqlInsertTeamMember)
+			if ok != tt.wantAdded {
+				t.Errorf("added to team = %v, want %v", ok, tt.wantAdded)
+			} else if ok && (args[0] != int64(2) || args[1] != int64(tt.wantId)) {
+				t.Errorf("team member = %v, want [2 %d]", args, tt.wantId)
+			}
+			select {
+			case e := <-sub.C:
+				if !tt.wantAdded || e.Type != hub.UserAdded || e.UserId != tt.wantId {
+					t.Errorf("event = %+v, want added %v", e, tt.wantAdded)
+				}
+			default:
+				if tt.wantAdded {
+					t.Error("user added event not published")
+				}
+			}
+		})
+	}
+
+	t.Run("auth ID too long", func(t *testing.T) {
+		db := openFakeDB(t, nil)
+		defer db.Close()
+		u := lu
+		u.AuthId = strings.Repeat("a", maxUserNameLength+1)
+		if _, err := upsertLDAPUser(db, &LDAPConf{}, u); err == nil {
+			t.Error("err = nil, want an error")
+		}
+	})
+}
+
+func TestRemoveLDAPUsers(t *testing.T) {
+	found := fakeQuery{rows: [][]driver.Value{
+		{int64(1), "User01"},
+		{int64(2), "user02"},
+		{int64(3), "user03"},
+	}}
+	broken := found
+	broken.rowsErr = errors.New("connection lost")
+
+	tests := []struct {
+		name        string
+		members     map[string]bool
+		rows        fakeQuery
+		wantErr     bool
+		wantQuery   bool
+		wantDeleted []driver.Value
+	}{
+		// auth_id の大文字と小文字は区別しない
+		{"sync", map[string]bool{"user01": true, "user03": true}, found, false, true, []driver.Value{int64(2)}},
+		{"all found", map[string]bool{"user01": true, "user02": true, "user03": true}, found, false, true, nil},
+		// 1 人も見つからなかったときは設定や LDAP サーバの誤りとみなして削除しない
+		{"no members", map[string]bool{}, found, true, false, nil},
+		// 読み込みが途中で失敗したときは削除しない
+		{"rows error", map[string]bool{"user01": true}, broken, true, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindLDAPUsers: func([]driver.Value) fakeQuery { return tt.rows },
+				sqlDeleteUser:    fakeAffected(1),
+			})
+			defer db.Close()
+
+			if err := removeLDAPUsers(db, tt.members); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if _, ok := fakeDriver.executed(sqlFindLDAPUsers); ok != tt.wantQuery {
+				t.Errorf("queried = %v, want %v", ok, tt.wantQuery)
+			}
+			fakeDriver.Lock()
+			defer fakeDriver.Unlock()
+			var deleted []driver.Value
+			for _, e := range fakeDriver.execs {
+				if e.query == sqlDeleteUser {
+					deleted = append(deleted, e.args[0])
+				}
+			}
+			if len(deleted) != len(tt.wantDeleted) || len(deleted) > 0 && deleted[0] != tt.wantDeleted[0] {
+				t.Errorf("deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
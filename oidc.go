@@ -0,0 +1,347 @@
+package mizumanju
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/context"
+	"github.com/marcie001/mizumanju/hub"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// ID トークンの sub クレームでユーザを対応付ける
+	oidcClaimSub = "sub"
+	// ID トークンの email クレームでユーザを対応付ける
+	oidcClaimEmail = "email"
+	// ログインを始めてからコールバックを受け付ける時間
+	oidcLoginTTL = 10 * time.Minute
+	// ID プロバイダと通信するときの待ち時間
+	oidcTimeout = 30 * time.Second
+)
+
+var (
+	// oidcProvider はディスカバリした ID プロバイダ。起動時に ID プロバイダが停止していてもよいよう、最初のログインでディスカバリする
+	oidcProvider struct {
+		sync.Mutex
+		p *oidc.Provider
+	}
+	// oidcClient は ID プロバイダと通信する HTTP クライアント
+	oidcClient = &http.Client{Timeout: oidcTimeout}
+)
+
+// oidcClaims は ID トークンのクレームのうち、ユーザの対応付けと作成に使うもの。
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// oidcEnabled は OpenID Connect でログインできるとき true を返す関数。
+func oidcEnabled() bool {
+	return oidcConf != nil && oidcConf.Issuer != ""
+}
+
+// findOIDCProvider は ID プロバイダをディスカバリする関数。成功したときは結果を使い回す。
+func findOIDCProvider(r *http.Request) (*oidc.Provider, error) {
+	oidcProvider.Lock()
+	defer oidcProvider.Unlock()
+	if oidcProvider.p != nil {
+		return oidcProvider.p, nil
+	}
+	p, err := oidc.NewProvider(oidc.ClientContext(r.Context(), oidcClient), oidcConf.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider.p = p
+	return p, nil
+}
+
+// oauth2Config は ID プロバイダ p の認可コードフローの設定を返す関数。
+func oauth2Config(p *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oidcConf.ClientID,
+		ClientSecret: oidcConf.ClientSecret,
+		RedirectURL:  oidcConf.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// randomString は URL に使えるランダムな文字列を返す関数。
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getOIDCLogin は /api/auth/oidc/login へのリクエストを処理する関数。
+// state, nonce, PKCE の検証用の値をセッションに保存し、ID プロバイダの認可エンドポイントにリダイレクトする。
+func getOIDCLogin(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	if !oidcEnabled() {
+		return nil, ErrNotFound
+	}
+	provider, err := findOIDCProvider(r)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	state, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	auth, _ := store.Get(r, sessionAuth)
+	auth.Values["oidcState"] = state
+	auth.Values["oidcNonce"] = nonce
+	auth.Values["oidcVerifier"] = verifier
+	auth.Values["oidcExpires"] = time.Now().Add(oidcLoginTTL).Unix()
+	auth.Save(r, w)
+
+	u := oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, u, http.StatusFound)
+	return nil, nil
+}
+
+// getOIDCCallback は /api/auth/oidc/callback へのリクエストを処理する関数。
+// 認可コードを ID トークンに交換して検証し、対応するユーザで /api/login と同じようにログインさせ、トップページにリダイレクトする。
+// 2 段階認証を有効にしているユーザは、/api/login/totp でコードを確認するまでログインさせない。
+func getOIDCCallback(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	if !oidcEnabled() {
+		return nil, ErrNotFound
+	}
+	scnf, ok := context.Get(r, systemkey).(*SystemConf)
+	if !ok {
+		return nil, errors.New("SystemConf instance not found.")
+	}
+
+	auth, _ := store.Get(r, sessionAuth)
+	state, _ := auth.Values["oidcState"].(string)
+	nonce, _ := auth.Values["oidcNonce"].(string)
+	verifier, _ := auth.Values["oidcVerifier"].(string)
+	exp, _ := auth.Values["oidcExpires"].(int64)
+	delete(auth.Values, "oidcState")
+	delete(auth.Values, "oidcNonce")
+	delete(auth.Values, "oidcVerifier")
+	delete(auth.Values, "oidcExpires")
+	auth.Save(r, w)
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("OIDC error: %s %s", e, q.Get("error_description"))
+		return nil, ErrUnauthorized
+	}
+	if state == "" || q.Get("state") != state || time.Now().Unix() > exp {
+		log.Println("OIDC state mismatch or expired.")
+		return nil, ErrUnauthorized
+	}
+
+	claims, err := exchangeOIDCCode(r, q.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrUnauthorized
+	}
+	user, err := findOIDCUser(r, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, msg, err := completeLogin(w, r, &user)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	u := *scnf.URL
+	if challenge {
+		u.RawQuery = "totp=required"
+	} else if msg != nil {
+		u.RawQuery = "totp=setup"
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return nil, nil
+}
+
+// exchangeOIDCCode は認可コード code を ID トークンに交換して検証し、クレームを返す関数。
+func exchangeOIDCCode(r *http.Request, code, verifier, nonce string) (*oidcClaims, error) {
+	if code == "" {
+		return nil, errors.New("OIDC code is empty.")
+	}
+	provider, err := findOIDCProvider(r)
+	if err != nil {
+		return nil, err
+	}
+	ctx := oidc.ClientContext(r.Context(), oidcClient)
+	token, err := oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("OIDC token response has no id_token.")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oidcConf.ClientID}).Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, errors.New("OIDC nonce mismatch.")
+	}
+	claims := &oidcClaims{}
+	if err = idToken.Claims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// findOIDCUser は ID トークンのクレームに対応するユーザを返す関数。
+// sub で対応付けるときは、LinkEmail が true なら、まだ対応付けていないユーザを確認済みのメールアドレスで対応付ける。
+// ただし管理者は乗っ取られないよう対応付けない。
+// 対応するユーザがいないときは、設定に従ってユーザを作成するか ErrUnauthorized を返す。
+func findOIDCUser(r *http.Request, claims *oidcClaims) (User, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return User{}, errors.New("DB instance not found.")
+	}
+
+	if oidcConf.Claim != oidcClaimEmail {
+		u, err := scanLoginUser(db.QueryRow(sqlFindByOIDCSubject, oidcConf.Issuer, claims.Subject))
+		if err != sql.ErrNoRows {
+			return u, err
+		}
+	}
+	if claims.Email != "" && claims.EmailVerified && (oidcConf.Claim == oidcClaimEmail || oidcConf.LinkEmail) {
+		u, err := scanLoginUser(db.QueryRow(sqlFindByEmailForLogin, claims.Email))
+		switch {
+		case err == nil && oidcConf.Claim == oidcClaimEmail:
+			return u, nil
+		case err == nil && u.Role == admin:
+			log.Printf("OIDC user is not linked to an administrator. ID: %d, Subject: %s", u.Id, claims.Subject)
+			return User{}, ErrUnauthorized
+		case err == nil:
+			rslt, err := db.Exec(sqlLinkOIDCSubject, oidcConf.Issuer, claims.Subject, u.Id)
+			if err != nil {
+				return User{}, err
+			}
+			if cnt, err := rslt.RowsAffected(); err != nil {
+				return User{}, err
+			} else if cnt == 0 {
+				// 別の ID プロバイダのユーザに対応付け済み
+				log.Printf("OIDC user is already linked. ID: %d, Subject: %s", u.Id, claims.Subject)
+				return User{}, ErrUnauthorized
+			}
+			return u, nil
+		case err != sql.ErrNoRows:
+			return User{}, err
+		}
+	}
+
+	if !oidcConf.Provision {
+		log.Printf("OIDC user not found. Subject: %s, Email: %s", claims.Subject, claims.Email)
+		return User{}, ErrUnauthorized
+	}
+	return insertOIDCUser(db, claims)
+}
+
+// scanLoginUser はログインするユーザを読み込む関数。Authenticate と同じ項目を返す。
+func scanLoginUser(row *sql.Row) (u User, err error) {
+	err = row.Scan(&u.Id, &u.AuthId, &u.Name, &u.VoiceChatID, &u.Role, &u.Created)
+	u.Image = fmt.Sprint("/api/users/", u.Id, "/image")
+	return
+}
+
+// insertOIDCUser は ID トークンのクレームからユーザを作成する関数。
+// パスワードは設定しないため、OpenID Connect でのみログインできる。
+func insertOIDCUser(db *sql.DB, claims *oidcClaims) (u User, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else if err = tx.Commit(); err == nil {
+			events.Publish(hub.Event{Type: hub.UserAdded, UserId: u.Id, Timestamp: time.Now().Unix()})
+			if oidcConf.DefaultTeam != 0 {
+				events.Publish(hub.Event{Type: hub.TeamChanged, UserId: u.Id, Timestamp: time.Now().Unix()})
+			}
+		}
+	}()
+
+	u = User{
+		Name:    claims.Name,
+		Role:    oidcConf.DefaultRole,
+		Created: time.Now(),
+	}
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+	if u.Name == "" {
+		u.Name = claims.PreferredUsername
+	}
+	if u.Name == "" {
+		u.Name = claims.Subject
+	}
+	if n := []rune(u.Name); len(n) > maxUserNameLength {
+		u.Name = string(n[:maxUserNameLength])
+	}
+	// ログイン ID は使われていないものを選ぶ
+	for _, id := range []string{claims.PreferredUsername, email, "oidc:" + claims.Subject} {
+		if id == "" || utf8.RuneCountInString(id) > maxUserNameLength {
+			continue
+		}
+		var cnt int
+		if err = tx.QueryRow(sqlCountAuthId, id).Scan(&cnt); err != nil {
+			return
+		}
+		if cnt == 0 {
+			u.AuthId = id
+			break
+		}
+	}
+	if u.AuthId == "" {
+		err = fmt.Errorf("No available auth ID for OIDC subject %s.", claims.Subject)
+		return
+	}
+
+	rslt, err := tx.Exec(sqlInsertOIDCUser, u.AuthId, u.Name, defaultVoiceChatProvider, u.Role, email, u.Created, privacyNone, oidcConf.Issuer, claims.Subject)
+	if err != nil {
+		return
+	}
+	id, err := rslt.LastInsertId()
+	if err != nil {
+		return
+	}
+	u.Id = int32(id)
+	u.Image = fmt.Sprint("/api/users/", u.Id, "/image")
+	if oidcConf.DefaultTeam != 0 {
+		_, err = tx.Exec(sqlInsertTeamMember, oidcConf.DefaultTeam, u.Id)
+	}
+	log.Printf("OIDC user provisioned. ID: %d, AuthId: %s", u.Id, u.AuthId)
+	return
+}
+
+// validOIDCClaim は c が ユーザを対応付けるクレームとして正しいとき true を返す関数。
+func validOIDCClaim(c string) bool {
+	c = strings.ToLower(c)
+	return c == oidcClaimSub || c == oidcClaimEmail
+}
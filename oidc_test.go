@@ -0,0 +1,403 @@
+package mizumanju
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer はテスト用の ID プロバイダ。ディスカバリ、JWKS、トークンエンドポイントを提供する。
+// 認可エンドポイントの代わりに issue で認可コードを発行する。
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	sync.Mutex
+	codes map[string]testGrant
+}
+
+// testGrant は認可コードに対応する PKCE のチャレンジと ID トークンのクレーム。
+type testGrant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key, codes: make(map[string]testGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                iss.URL,
+			"authorization_endpoint":                iss.URL + "/auth",
+			"token_endpoint":                        iss.URL + "/token",
+			"jwks_uri":                              iss.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		iss.Lock()
+		g, ok := iss.codes[r.Form.Get("code")]
+		delete(iss.codes, r.Form.Get("code"))
+		iss.Unlock()
+		id, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || id != "client" || secret != "secret" || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     iss.sign(t, g.claims),
+		})
+	})
+	iss.Server = httptest.NewServer(mux)
+	return iss
+}
+
+// issue は claims の ID トークンに交換できる認可コードを発行する関数。
+// claims に無い iss, aud, exp, iat は補う。
+func (iss *testIssuer) issue(challenge string, claims map[string]interface{}) string {
+	c := map[string]interface{}{
+		"iss": iss.URL,
+		"aud": "client",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	code := fmt.Sprint("code-", time.Now().UnixNano())
+	iss.Lock()
+	iss.codes[code] = testGrant{challenge, c}
+	iss.Unlock()
+	return code
+}
+
+// sign は claims を RS256 で署名した JWT を返す関数。
+func (iss *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// oidcLogin は /api/auth/oidc/login にリクエストし、セッションの Cookie と認可リクエストのパラメータを返す関数。
+func oidcLogin(t *testing.T) ([]*http.Cookie, url.Values) {
+	w := httptest.NewRecorder()
+	makeCtxHandler(getOIDCLogin, nil)(w, httptest.NewRequest("GET", "/api/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d, body = %s", w.Code, w.Body)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := loc.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" || q.Get("state") == "" {
+		t.Fatalf("authorization request lacks state, nonce or PKCE: %s", loc)
+	}
+	return w.Result().Cookies(), q
+}
+
+// oidcCallback は /api/auth/oidc/callback に query でリクエストし、レスポンスとセッションのユーザを返す関数。
+// pending はコードの確認を待っているユーザ。
+func oidcCallback(t *testing.T, cookies []*http.Cookie, query url.Values) (w *httptest.ResponseRecorder, user, pending *User) {
+	r := httptest.NewRequest("GET", "/api/auth/oidc/callback?"+query.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	makeCtxHandler(getOIDCCallback, nil)(w, r)
+
+	// セッションは保存し直すたびに Set-Cookie するため、最後のものを読み込む
+	r = httptest.NewRequest("GET", "/", nil)
+	if cs := w.Result().Cookies(); len(cs) > 0 {
+		r.AddCookie(cs[len(cs)-1])
+	}
+	auth, _ := store.Get(r, sessionAuth)
+	user, _ = auth.Values["user"].(*User)
+	pending, _ = auth.Values["pendingUser"].(*User)
+	return
+}
+
+// loginUserRow はログインするユーザの行を返す関数。
+func loginUserRow(id int32, authId, role string) func([]driver.Value) fakeQuery {
+	return fakeRow(int64(id), authId, authId, "", role, time.Now())
+}
+
+func TestOIDCCallback(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.Close()
+	gob.Register(&User{})
+
+	origSystem, origOIDC, origDB := systemConf, oidcConf, db
+	defer func() {
+		systemConf, oidcConf, db = origSystem, origOIDC, origDB
+		oidcProvider.p = nil
+	}()
+	base, _ := url.Parse("http://mizumanju.example/")
+	systemConf = &SystemConf{URL: base}
+	oidcProvider.p = nil
+
+	// totpDisabled は 2 段階認証を有効にしていない管理者以外のユーザの SQL
+	totpDisabled := map[string]func([]driver.Value) fakeQuery{
+		sqlFindTotpEnabled: fakeRow(int64(0)),
+	}
+	with := func(queries map[string]func([]driver.Value) fakeQuery) map[string]func([]driver.Value) fakeQuery {
+		m := make(map[string]func([]driver.Value) fakeQuery)
+		for k, v := range totpDisabled {
+			m[k] = v
+		}
+		for k, v := range queries {
+			m[k] = v
+		}
+		return m
+	}
+	verifiedEmail := map[string]interface{}{"sub": "alice-sub", "email": "alice@example.com", "email_verified": true, "name": "Alice"}
+
+	tests := []struct {
+		name    string
+		conf    OIDCConf
+		queries map[string]func([]driver.Value) fakeQuery
+		claims  map[string]interface{}
+		// tamper はコールバックのパラメータと ID トークンのクレームを書き換える
+		tamper   func(q url.Values, claims map[string]interface{})
+		wantCode int
+		wantLoc  string
+		wantUser int32
+		wantPend int32
+		wantExec string
+		denyExec string
+	}{
+		{
+			name:     "state mismatch",
+			claims:   verifiedEmail,
+			tamper:   func(q url.Values, claims map[string]interface{}) { q.Set("state", "forged") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "nonce mismatch",
+			claims:   verifiedEmail,
+			tamper:   func(q url.Values, claims map[string]interface{}) { claims["nonce"] = "forged" },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "PKCE mismatch",
+			claims:   verifiedEmail,
+			tamper:   func(q url.Values, claims map[string]interface{}) { q.Set("code_challenge", "forged") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong audience",
+			claims:   verifiedEmail,
+			tamper:   func(q url.Values, claims map[string]interface{}) { claims["aud"] = "other" },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "sub",
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject: loginUserRow(1, "alice", editor),
+			}),
+			claims:   verifiedEmail,
+			wantCode: http.StatusFound,
+			wantLoc:  "http://mizumanju.example/",
+			wantUser: 1,
+		},
+		{
+			name: "sub does not link by email without the option",
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject:   fakeNoRows,
+				sqlFindByEmailForLogin: loginUserRow(1, "alice", editor),
+			}),
+			claims:   verifiedEmail,
+			wantCode: http.StatusUnauthorized,
+			denyExec: sqlFindByEmailForLogin,
+		},
+		{
+			name: "sub links by verified email",
+			conf: OIDCConf{LinkEmail: true},
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject:   fakeNoRows,
+				sqlFindByEmailForLogin: loginUserRow(1, "alice", editor),
+				sqlLinkOIDCSubject:     fakeAffected(1),
+			}),
+			claims:   verifiedEmail,
+			wantCode: http.StatusFound,
+			wantUser: 1,
+			wantExec: sqlLinkOIDCSubject,
+		},
+		{
+			name: "sub does not link by unverified email",
+			conf: OIDCConf{LinkEmail: true},
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject: fakeNoRows,
+			}),
+			claims:   map[string]interface{}{"sub": "alice-sub", "email": "alice@example.com", "email_verified": false},
+			wantCode: http.StatusUnauthorized,
+			denyExec: sqlFindByEmailForLogin,
+		},
+		{
+			name: "sub never links an administrator",
+			conf: OIDCConf{LinkEmail: true},
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject:   fakeNoRows,
+				sqlFindByEmailForLogin: loginUserRow(1, "root", admin),
+			}),
+			claims:   verifiedEmail,
+			wantCode: http.StatusUnauthorized,
+			denyExec: sqlLinkOIDCSubject,
+		},
+		{
+			name: "email",
+			conf: OIDCConf{Claim: oidcClaimEmail},
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByEmailForLogin: loginUserRow(2, "bob", editor),
+			}),
+			claims:   verifiedEmail,
+			wantCode: http.StatusFound,
+			wantUser: 2,
+			denyExec: sqlFindByOIDCSubject,
+		},
+		{
+			name: "not found",
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject: fakeNoRows,
+			}),
+			claims:   verifiedEmail,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "provision",
+			conf: OIDCConf{Provision: true, DefaultTeam: 3},
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject: fakeNoRows,
+				sqlCountAuthId:       fakeRow(int64(0)),
+				sqlInsertOIDCUser: func([]driver.Value) fakeQuery {
+					return fakeQuery{affected: 1, lastId: 42}
+				},
+				sqlInsertTeamMember: fakeAffected(1),
+			}),
+			claims:   map[string]interface{}{"sub": "carol-sub", "preferred_username": "carol"},
+			wantCode: http.StatusFound,
+			wantUser: 42,
+			wantExec: sqlInsertTeamMember,
+		},
+		{
+			name: "TOTP challenge",
+			queries: map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject:  loginUserRow(1, "alice", editor),
+				sqlFindTotpEnabled:    fakeRow(int64(1)),
+				sqlCountRecoveryCodes: fakeRow(int64(10)),
+			},
+			claims:   verifiedEmail,
+			wantCode: http.StatusFound,
+			wantLoc:  "http://mizumanju.example/?totp=required",
+			wantPend: 1,
+		},
+		{
+			name: "TOTP setup required for administrators",
+			queries: with(map[string]func([]driver.Value) fakeQuery{
+				sqlFindByOIDCSubject: loginUserRow(1, "root", admin),
+				sqlFindSetting:       fakeRow("true"),
+			}),
+			claims:   verifiedEmail,
+			wantCode: http.StatusFound,
+			wantLoc:  "http://mizumanju.example/?totp=setup",
+			wantUser: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			conf.Issuer, conf.ClientID, conf.ClientSecret = iss.URL, "client", "secret"
+			conf.RedirectURL = "http://mizumanju.example/api/auth/oidc/callback"
+			if conf.Claim == "" {
+				conf.Claim = oidcClaimSub
+			}
+			if conf.DefaultRole == "" {
+				conf.DefaultRole = editor
+			}
+			oidcConf = &conf
+			db = openFakeDB(t, tt.queries)
+			defer db.Close()
+
+			cookies, auth := oidcLogin(t)
+			claims := map[string]interface{}{"nonce": auth.Get("nonce")}
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			q := url.Values{"state": {auth.Get("state")}}
+			if tt.tamper != nil {
+				tt.tamper(auth, claims)
+				q.Set("state", auth.Get("state"))
+			}
+			q.Set("code", iss.issue(auth.Get("code_challenge"), claims))
+
+			w, user, pending := oidcCallback(t, cookies, q)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d, body = %s", w.Code, tt.wantCode, w.Body)
+			}
+			if tt.wantLoc != "" && w.Header().Get("Location") != tt.wantLoc {
+				t.Errorf("Location = %s, want %s", w.Header().Get("Location"), tt.wantLoc)
+			}
+			var uid, pid int32
+			if user != nil {
+				uid = user.Id
+			}
+			if pending != nil {
+				pid = pending.Id
+			}
+			if uid != tt.wantUser || pid != tt.wantPend {
+				t.Errorf("logged in user = %d, pending user = %d, want %d and %d", uid, pid, tt.wantUser, tt.wantPend)
+			}
+			if _, ok := fakeDriver.executed(tt.wantExec); tt.wantExec != "" && !ok {
+				t.Errorf("not executed: %s", tt.wantExec)
+			}
+			if _, ok := fakeDriver.executed(tt.denyExec); tt.denyExec != "" && ok {
+				t.Errorf("executed: %s", tt.denyExec)
+			}
+		})
+	}
+}
@@ -1,18 +1,78 @@
 package mizumanju
 
+import (
+	"image"
+	"time"
+)
+
 // loginParams は /api/login のリクエストパラメタを表す構造体。
 type loginParams struct {
 	Username, Password string
 }
 
-// imageParams は /api/saveImage のリクエストパラメタを表す構造体。
+// tokenParams は /api/users/me/tokens のリクエストパラメタを表す構造体。
+// ExpiresAt が nil のときは無期限のトークンを発行する。
+type tokenParams struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// totpParams は 2 段階認証のコードを送るリクエストパラメタを表す構造体。
+// Code は認証アプリのコードまたはリカバリコード。
+type totpParams struct {
+	Code string `json:"code"`
+}
+
+// imageParams は /api/users/me/image のリクエストパラメタを表す構造体。
+// Image は BASE64 エンコードされた画像。decoded は入力チェック時にデコードした画像。
 type imageParams struct {
-	Image string
+	Image   string
+	decoded image.Image
 }
 
 // statusParams は /api/users/me/status のリクエストパラメタを表す構造体。
+// Status はメッセージ。Preset を指定したときは、省略した Status, Emoji, ExpiresAt にプリセットの値を使う。
 type statusParams struct {
-	Status string
+	Status    string
+	Preset    string
+	Emoji     string
+	ExpiresAt *time.Time
+}
+
+// scheduledStatusParams は /api/users/me/scheduledStatuses のリクエストパラメタを表す構造体。
+// Preset を指定したときは、省略した Status, Emoji, EndsAt にプリセットの値を使う。
+type scheduledStatusParams struct {
+	Status   string
+	Preset   string
+	Emoji    string
+	StartsAt time.Time
+	EndsAt   *time.Time
+}
+
+// calendarParams は /api/users/me/calendar のリクエストパラメタを表す構造体。
+// URL と Ics (アップロードした .ics ファイルの内容) のどちらか一方を指定する。
+// data は入力チェック時に読み込んだカレンダーのデータ。
+type calendarParams struct {
+	URL  string `json:"url"`
+	Ics  string `json:"ics"`
+	data []byte
+}
+
+// dndParams は /api/users/me/dnd のリクエストパラメタを表す構造体。
+type dndParams struct {
+	Dnd bool `json:"dnd"`
+}
+
+// knockParams は /api/users/{id}/knock のリクエストパラメタを表す構造体。
+type knockParams struct {
+	Message string `json:"message"`
+}
+
+// knockAnswerParams は /api/knocks/{id} のリクエストパラメタを表す構造体。
+// State は accepted または deferred。
+type knockAnswerParams struct {
+	State string `json:"state"`
 }
 
 // recoveryRequestParams は /api/recovery のリクエストパラメタを表す構造体
@@ -0,0 +1,129 @@
+package mizumanju
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// argon2id のメモリ使用量 (KiB)
+	argon2Memory = 64 * 1024
+	// argon2id の反復回数
+	argon2Time = 3
+	// argon2id の並列数
+	argon2Threads = 2
+	// argon2id のソルトのバイト数
+	argon2SaltLength = 16
+	// argon2id のハッシュのバイト数
+	argon2KeyLength = 32
+	// argon2id でハッシュしたパスワードの接頭辞
+	argon2Prefix = "$argon2id$"
+)
+
+// ErrInvalidHash はハッシュしたパスワードの形式が正しくないことを表すエラー
+var ErrInvalidHash = errors.New("Invalid password hash.")
+
+// argon2Params は argon2id のパラメタを表す構造体。
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// currentArgon2Params は新しくパスワードをハッシュするときのパラメタ
+var currentArgon2Params = argon2Params{memory: argon2Memory, time: argon2Time, threads: argon2Threads}
+
+// hashPassword はパスワードを argon2id でハッシュする関数。
+// 結果は $argon2id$v=19$m=65536,t=3,p=2$<ソルト>$<ハッシュ> の形式で、ソルトとハッシュは BASE64 (パディング無し)。
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := currentArgon2Params
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword はパスワードが正しいかチェックする関数。
+// argon2id と、以前の SHA-512 のハッシュの両方を扱う。
+// 正しく、かつ以前の形式または古いパラメタでハッシュしていたときは、rehash に true を返す。
+func checkPassword(userinput, password string, created time.Time) (ok, rehash bool, err error) {
+	if !strings.HasPrefix(password, argon2Prefix) {
+		hashed, err := legacyHashPassword(userinput, created)
+		if err != nil {
+			return false, false, err
+		}
+		ok = subtle.ConstantTimeCompare([]byte(password), []byte(hashed)) == 1
+		return ok, ok, nil
+	}
+
+	p, salt, key, err := parseArgon2Hash(password)
+	if err != nil {
+		return false, false, err
+	}
+	hashed := argon2.IDKey([]byte(userinput), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	ok = subtle.ConstantTimeCompare(key, hashed) == 1
+	return ok, ok && p != currentArgon2Params, nil
+}
+
+// parseArgon2Hash は argon2id でハッシュしたパスワードからパラメタ、ソルト、ハッシュを取り出す関数。
+func parseArgon2Hash(password string) (p argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", ソルト, ハッシュ
+	parts := strings.Split(password, "$")
+	if len(parts) != 6 {
+		err = ErrInvalidHash
+		return
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		err = ErrInvalidHash
+		return
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		err = ErrInvalidHash
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		err = ErrInvalidHash
+		return
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		err = ErrInvalidHash
+		return
+	}
+	return
+}
+
+// legacyHashPassword は以前の形式でパスワードをハッシュする関数。
+// 作成日時をソルトとして SHA-512 を 50 回繰り返す。既存のパスワードの確認にのみ使う。
+func legacyHashPassword(password string, created time.Time) (string, error) {
+	buf := new(bytes.Buffer)
+	ms := created.UnixNano()
+	err := binary.Write(buf, binary.LittleEndian, ms)
+	if err != nil {
+		return "", err
+	}
+	b := []byte(password)
+	var h [64]byte
+	for i := 0; i < 50; i++ {
+		if i == 0 {
+			b = append(b, buf.Bytes()...)
+		} else {
+			b = append(h[:], buf.Bytes()...)
+		}
+		h = sha512.Sum512(b)
+	}
+	return fmt.Sprintf("%x", h), nil
+}
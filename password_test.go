@@ -0,0 +1,69 @@
+package mizumanju
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// legacyPassword は以前の形式で作成日時 legacyCreated に "password" をハッシュした値
+const legacyPassword = "ee52ed28308162497558e31ae79f4b4fa074e929bfe51a5c7a191b19cfbde8b242d0e98ae018764b4cbd376720a09a6e3bc1e4456d34ac3f028d5227be6e85cb"
+
+var legacyCreated = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestLegacyHashPassword(t *testing.T) {
+	got, err := legacyHashPassword("password", legacyCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != legacyPassword {
+		t.Errorf("legacyHashPassword = %s, want %s", got, legacyPassword)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	current, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	old := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, 32*1024, 1, 2,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("password"), salt, 1, 32*1024, 2, argon2KeyLength)))
+	encSalt := base64.RawStdEncoding.EncodeToString(salt)
+
+	tests := []struct {
+		name     string
+		input    string
+		password string
+		ok       bool
+		rehash   bool
+		err      error
+	}{
+		{"legacy", "password", legacyPassword, true, true, nil},
+		{"legacy wrong password", "wrong", legacyPassword, false, false, nil},
+		{"argon2id", "password", current, true, false, nil},
+		{"argon2id wrong password", "wrong", current, false, false, nil},
+		{"argon2id old params", "password", old, true, true, nil},
+		{"argon2id old params wrong password", "wrong", old, false, false, nil},
+		{"missing parts", "password", argon2Prefix + "v=19$m=65536,t=3,p=2$" + encSalt, false, false, ErrInvalidHash},
+		{"unknown version", "password", argon2Prefix + "v=16$m=65536,t=3,p=2$" + encSalt + "$" + encSalt, false, false, ErrInvalidHash},
+		{"malformed params", "password", argon2Prefix + "v=19$m=x,t=3,p=2$" + encSalt + "$" + encSalt, false, false, ErrInvalidHash},
+		{"malformed salt", "password", argon2Prefix + "v=19$m=65536,t=3,p=2$!!$" + encSalt, false, false, ErrInvalidHash},
+		{"empty key", "password", argon2Prefix + "v=19$m=65536,t=3,p=2$" + encSalt + "$", false, false, ErrInvalidHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash, err := checkPassword(tt.input, tt.password, legacyCreated)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("checkPassword = (%v, %v), want (%v, %v)", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
@@ -12,13 +12,16 @@ import (
 	_ "net/http/pprof"
 	"net/mail"
 	"net/url"
+	"strings"
 	"text/template"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"github.com/marcie001/mizumanju/imgmap"
 )
 
 var (
@@ -31,8 +34,24 @@ var (
 	// SMTP 設定
 	smtpConf   *SmtpConf
 	systemConf *SystemConf
+	// 画像設定
+	imgConf *ImageConf
+	// カレンダー設定
+	calConf *CalendarConf
+	// OpenID Connect の設定
+	oidcConf *OIDCConf
+	// ログイン ID とパスワードで認証するときに、先頭から順に試す Authenticator
+	authenticators = []Authenticator{dbAuthenticator{}}
 	// ErrBadRequest は HTTP Status Code 401 に相応しいエラー
 	ErrBadRequest error = errors.New("Bad Request.")
+	// ErrNotModified はクライアントが持つデータが最新であり、レスポンスボディを返さないことを表す
+	ErrNotModified error = errors.New("Not Modified")
+	// API トークンで呼び出せる更新系の API と必要なスコープ。ここに無い更新系の API は API トークンでは呼び出せない
+	tokenWriteScopes = map[string]string{
+		"PUT /api/users/me/image":  scopeImageWrite,
+		"PUT /api/users/me/status": scopeStatusWrite,
+		"PUT /api/users/me/dnd":    scopeStatusWrite,
+	}
 	// ライセンス情報
 	Licenses = []License{
 		License{
@@ -51,20 +70,36 @@ const (
 	sessionAuth = "SessionAuth"
 	// context 内のログインユーザのキー
 	userkey = "LoginUser"
+	// context 内の認証に使った API トークンのキー。セッションで認証したときは無い
+	tokenkey = "APIToken"
 	// エラー時のレスポンステンプレート
 	errJsTmpl = `{"msgs":{"global":["%s"]},"data":null}`
 	// 404 エラー時のレスポンス
 	err404Tmpl = `{"msgs":{"global":["404 page not found"]},"data":null}`
+	// パスワードを確認してから 2 段階認証のコードを受け付ける時間
+	totpChallengeTTL = 5 * time.Minute
+	// ストリームで API トークンを削除していないか確認する間隔
+	tokenCheckInterval = time.Minute
+	// 期限切れのユーザステータスを掃除する間隔
+	statusSweepInterval = time.Minute
 	// ロール admin
 	admin = "admin"
 	// ロール editor
 	editor = "editor"
+	// API トークンのスコープ。GET リクエストで参照できる
+	scopeRead = "read"
+	// API トークンのスコープ。自分の画像を更新できる
+	scopeImageWrite = "image:write"
+	// API トークンのスコープ。自分のユーザステータスと DND を更新できる
+	scopeStatusWrite = "status:write"
 	// ユーザに表示する全体的なメッセージであることを表すキー
 	GlobalMsg = "global"
+	// 画像が無いことを表す画像かどうかを返すレスポンスヘッダ
+	staleHeader = "X-Mizumanju-Stale"
 )
 
 // starg はデータベースへの接続、テンプレート準備、ルーティングの定義、サーバ起動を行う。
-func Start(host string, port int32, dsn string, smtpHost string, smtpPort int, startTls bool, smtpUserName string, smtpPassword string, systemName string, systemUrl string, systemMailAddress string) {
+func Start(host string, port int32, dsn string, smtpHost string, smtpPort int, startTls bool, smtpUserName string, smtpPassword string, systemName string, systemUrl string, systemMailAddress string, defaultTeam int32, imageConf *ImageConf, calendarConf *CalendarConf, openIDConf *OIDCConf, ldapConf *LDAPConf) {
 
 	baseUrl, err := url.Parse(systemUrl)
 	if err != nil {
@@ -77,6 +112,7 @@ func Start(host string, port int32, dsn string, smtpHost string, smtpPort int, s
 			Name:    systemName,
 			Address: systemMailAddress,
 		},
+		DefaultTeam: defaultTeam,
 	}
 
 	smtpConf = &SmtpConf{
@@ -99,26 +135,129 @@ func Start(host string, port int32, dsn string, smtpHost string, smtpPort int, s
 		}
 	}()
 
+	if imageConf.Format != imageFormatPNG && imageConf.Format != imageFormatJPEG {
+		log.Fatalf("Unknown image format: %s", imageConf.Format)
+	}
+	imgConf = imageConf
+	imgStore, err := newImageStore(imgConf, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	images = imgmap.New(imgStore, imgmap.Retention{
+		Count: imgConf.RetentionCount,
+		Age:   imgConf.RetentionAge,
+	})
+	images.SetHub(events)
+	wallFont, err = loadWallFont(imgConf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// フォントの大きさが正しいか確認する
+	face, err := newWallFace(imgConf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	face.Close()
+
 	gob.Register(&User{})
 
+	go SweepUserStatuses(db, statusSweepInterval)
+
+	calConf = calendarConf
+	calendarClient = newCalendarClient(calConf)
+	go SweepCalendars(db, calConf, calendarSyncInterval)
+
+	oidcConf = openIDConf
+	if oidcEnabled() {
+		if !validOIDCClaim(oidcConf.Claim) {
+			log.Fatalf("Unknown OIDC claim: %s", oidcConf.Claim)
+		}
+		oidcConf.Claim = strings.ToLower(oidcConf.Claim)
+		if oidcConf.DefaultRole != admin && oidcConf.DefaultRole != editor {
+			log.Fatalf("Unknown role: %s", oidcConf.DefaultRole)
+		}
+		if oidcConf.RedirectURL == "" {
+			oidcConf.RedirectURL = baseUrl.ResolveReference(&url.URL{Path: "api/auth/oidc/callback"}).String()
+		}
+	}
+
+	if ldapEnabled(ldapConf) {
+		// ディレクトリで管理していないユーザは、これまで通りデータベースのパスワードで認証する
+		authenticators = []Authenticator{&ldapAuthenticator{cnf: ldapConf}, dbAuthenticator{}}
+		if ldapConf.SyncInterval > 0 {
+			go SweepLDAPUsers(db, ldapConf, ldapConf.SyncInterval)
+		}
+	}
+
 	router := mux.NewRouter()
 
-	router.HandleFunc("/api/login", makeCtxHandler(makeOne(validateLogin, login), new(loginParams))).Methods("POST")
+	router.HandleFunc("/api/login", makeCtxHandler(makeOne(validateLogin, login), func() params { return new(loginParams) })).Methods("POST")
+	router.HandleFunc("/api/login/totp", makeCtxHandler(makeOne(validateTotp, loginTotp), func() params { return new(totpParams) })).Methods("POST")
+	router.HandleFunc("/api/auth/oidc/login", makeCtxHandler(getOIDCLogin, nil)).Methods("GET")
+	router.HandleFunc("/api/auth/oidc/callback", makeCtxHandler(getOIDCCallback, nil)).Methods("GET")
 	router.HandleFunc("/api/users/me/displaySettings", makeCtxHandler(makeAuthedAction(getMyDisplaySettings), nil)).Methods("GET")
-	users := make([]User, 0, 32)
-	router.HandleFunc("/api/users/me/displaySettings", makeCtxHandler(makeAuthedAction(postMyDisplaySettings), &users)).Methods("POST")
-	router.HandleFunc("/api/users/me/image", makeCtxHandler(makeAuthedAction(putMyImage), new(imageParams))).Methods("PUT")
-	router.HandleFunc("/api/users/me/status", makeCtxHandler(makeAuthedAction(putMyStatus), new(statusParams))).Methods("PUT")
+	router.HandleFunc("/api/users/me/displaySettings", makeCtxHandler(makeAuthedAction(postMyDisplaySettings), func() params {
+		users := make([]User, 0, 32)
+		return &users
+	})).Methods("POST")
+	router.HandleFunc("/api/users/me/image", makeCtxHandler(makeAuthedAction(makeOne(validateImage, putMyImage)), func() params { return new(imageParams) })).Methods("PUT")
+	router.HandleFunc("/api/users/me/wall.jpg", makeCtxHandler(makeAuthedAction(getMyWall), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/workingHours", makeCtxHandler(makeAuthedAction(getMyWorkingHours), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/workingHours", makeCtxHandler(makeAuthedAction(makeOne(validateWorkingHours, putMyWorkingHours)), func() params { return new(WorkingHours) })).Methods("PUT")
+	router.HandleFunc("/api/users/me/scheduledStatuses", makeCtxHandler(makeAuthedAction(getMyScheduledStatuses), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/scheduledStatuses", makeCtxHandler(makeAuthedAction(makeOne(validateScheduledStatus, postMyScheduledStatus)), func() params { return new(scheduledStatusParams) })).Methods("POST")
+	router.HandleFunc("/api/users/me/scheduledStatuses/{id:[0-9]+}", makeCtxHandler(makeAuthedAction(deleteMyScheduledStatus), nil)).Methods("DELETE")
+	router.HandleFunc("/api/users/me/calendar", makeCtxHandler(makeAuthedAction(getMyCalendar), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/calendar", makeCtxHandler(makeAuthedAction(makeOne(validateCalendar, putMyCalendar)), func() params { return new(calendarParams) })).Methods("PUT")
+	router.HandleFunc("/api/users/me/calendar", makeCtxHandler(makeAuthedAction(deleteMyCalendar), nil)).Methods("DELETE")
+	router.HandleFunc("/api/users/me/dnd", makeCtxHandler(makeAuthedAction(putMyDnd), func() params { return new(dndParams) })).Methods("PUT")
+	router.HandleFunc("/api/users/me/knocks", makeCtxHandler(makeAuthedAction(getMyKnocks), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/knocks/sent", makeCtxHandler(makeAuthedAction(getMySentKnocks), nil)).Methods("GET")
+	router.HandleFunc("/api/knocks/{id:[0-9]+}", makeCtxHandler(makeAuthedAction(makeOne(validateKnockAnswer, putKnock)), func() params { return new(knockAnswerParams) })).Methods("PUT")
+	router.HandleFunc("/api/users/me/status", makeCtxHandler(makeAuthedAction(makeOne(validateStatus, putMyStatus)), func() params { return new(statusParams) })).Methods("PUT")
 	router.HandleFunc("/api/users/{id:[0-9]+}/image", makeCtxHandler(makeAuthedAction(getUserImage), nil)).Methods("GET")
+	router.HandleFunc("/api/users/{id:[0-9]+}/images", makeCtxHandler(makeAuthedAction(getUserImages), nil)).Methods("GET")
+	router.HandleFunc("/api/users/{id:[0-9]+}/images/{ts:[0-9]+}", makeCtxHandler(makeAuthedAction(getUserHistoryImage), nil)).Methods("GET")
+	router.HandleFunc("/api/users/{id:[0-9]+}/stream.mjpeg", makeCtxHandler(makeAuthedAction(getUserStream), nil)).Methods("GET")
+	router.HandleFunc("/api/users/{id:[0-9]+}/timelapse.gif", makeCtxHandler(makeAuthedAction(getUserTimelapse), nil)).Methods("GET")
+	router.HandleFunc("/api/users/{id:[0-9]+}/knock", makeCtxHandler(makeAuthedAction(makeOne(validateKnock, postKnock)), func() params { return new(knockParams) })).Methods("POST")
 	router.HandleFunc("/api/users/{id:[0-9]+}/status", makeCtxHandler(makeAuthedAction(getUserStatus), nil)).Methods("GET")
-	router.HandleFunc("/api/users/me/password", makeCtxHandler(makeAuthedAction(makeOne(validatePassword, putMyPassword)), new(passwordParams))).Methods("PUT")
+	router.HandleFunc("/api/users/{id:[0-9]+}/status/history", makeCtxHandler(makeAuthedAction(getUserStatusHistory), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/tokens", makeCtxHandler(makeAuthedAction(getMyTokens), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/tokens", makeCtxHandler(makeAuthedAction(makeOne(validateToken, postMyToken)), func() params { return new(tokenParams) })).Methods("POST")
+	router.HandleFunc("/api/users/me/tokens/{id:[0-9]+}", makeCtxHandler(makeAuthedAction(deleteMyToken), nil)).Methods("DELETE")
+	router.HandleFunc("/api/users/me/totp", makeCtxHandler(makeAuthedAction(getMyTotp), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/totp", makeCtxHandler(makeAuthedAction(postMyTotp), nil)).Methods("POST")
+	router.HandleFunc("/api/users/me/totp", makeCtxHandler(makeAuthedAction(makeOne(validateTotp, deleteMyTotp)), func() params { return new(totpParams) })).Methods("DELETE")
+	router.HandleFunc("/api/users/me/totp/confirm", makeCtxHandler(makeAuthedAction(makeOne(validateTotp, postMyTotpConfirm)), func() params { return new(totpParams) })).Methods("POST")
+	router.HandleFunc("/api/settings/security", makeCtxHandler(makeAuthedAction(getSecuritySettings, admin), nil)).Methods("GET")
+	router.HandleFunc("/api/settings/security", makeCtxHandler(makeAuthedAction(putSecuritySettings, admin), func() params { return new(SecuritySettings) })).Methods("PUT")
+	router.HandleFunc("/api/teams", makeCtxHandler(makeAuthedAction(getTeams), nil)).Methods("GET")
+	router.HandleFunc("/api/teams", makeCtxHandler(makeAuthedAction(makeOne(validateTeam, postTeam), admin), func() params { return new(Team) })).Methods("POST")
+	router.HandleFunc("/api/teams/{id:[0-9]+}", makeCtxHandler(makeAuthedAction(makeOne(validateTeam, putTeam), admin), func() params { return new(Team) })).Methods("PUT")
+	router.HandleFunc("/api/teams/{id:[0-9]+}", makeCtxHandler(makeAuthedAction(deleteTeam, admin), nil)).Methods("DELETE")
+	router.HandleFunc("/api/teams/{id:[0-9]+}/members", makeCtxHandler(makeAuthedAction(getTeamMembers), nil)).Methods("GET")
+	router.HandleFunc("/api/teams/{id:[0-9]+}/members/{userId:[0-9]+}", makeCtxHandler(makeAuthedAction(putTeamMember, admin), nil)).Methods("PUT")
+	router.HandleFunc("/api/teams/{id:[0-9]+}/members/{userId:[0-9]+}", makeCtxHandler(makeAuthedAction(deleteTeamMember, admin), nil)).Methods("DELETE")
+	router.HandleFunc("/api/voiceChatProviders", makeCtxHandler(makeAuthedAction(getVoiceChatProviders), nil)).Methods("GET")
+	router.HandleFunc("/api/voiceChatProviders", makeCtxHandler(makeAuthedAction(makeOne(validateVoiceChatProvider, postVoiceChatProvider), admin), func() params { return new(VoiceChatProvider) })).Methods("POST")
+	router.HandleFunc("/api/voiceChatProviders/{key}", makeCtxHandler(makeAuthedAction(makeOne(validateVoiceChatProvider, putVoiceChatProvider), admin), func() params { return new(VoiceChatProvider) })).Methods("PUT")
+	router.HandleFunc("/api/voiceChatProviders/{key}", makeCtxHandler(makeAuthedAction(deleteVoiceChatProvider, admin), nil)).Methods("DELETE")
+	router.HandleFunc("/api/statusPresets", makeCtxHandler(makeAuthedAction(getStatusPresets), nil)).Methods("GET")
+	router.HandleFunc("/api/statusPresets", makeCtxHandler(makeAuthedAction(makeOne(validateStatusPreset, postStatusPreset), admin), func() params { return new(StatusPreset) })).Methods("POST")
+	router.HandleFunc("/api/statusPresets/{key}", makeCtxHandler(makeAuthedAction(makeOne(validateStatusPreset, putStatusPreset), admin), func() params { return new(StatusPreset) })).Methods("PUT")
+	router.HandleFunc("/api/statusPresets/{key}", makeCtxHandler(makeAuthedAction(deleteStatusPreset, admin), nil)).Methods("DELETE")
+	router.HandleFunc("/api/status/timeline", makeCtxHandler(makeAuthedAction(getStatusTimeline), nil)).Methods("GET")
+	router.HandleFunc("/api/users/me/password", makeCtxHandler(makeAuthedAction(makeOne(validatePassword, putMyPassword)), func() params { return new(passwordParams) })).Methods("PUT")
 	router.HandleFunc("/api/users/{id:[0-9]+}", makeCtxHandler(makeAuthedAction(deleteUser, admin), nil)).Methods("DELETE")
 	router.HandleFunc("/api/users/me", makeCtxHandler(makeAuthedAction(getMe), nil)).Methods("GET")
 	router.HandleFunc("/api/users", makeCtxHandler(makeAuthedAction(getUsers, admin), nil)).Methods("GET")
-	router.HandleFunc("/api/users", makeCtxHandler(makeAuthedAction(makeOne(validateUser, postUser), admin), new(User))).Methods("POST")
-	router.HandleFunc("/api/users", makeCtxHandler(makeAuthedAction(makeOne(validateUser, postUser)), new(User))).Methods("PUT")
-	router.HandleFunc("/api/recovery/{key:[a-z0-9\\-]+}", makeCtxHandler(makeOne(validateRecovery, recovery), new(recoveryParams))).Methods("PUT")
-	router.HandleFunc("/api/recovery", makeCtxHandler(makeOne(validateRecoveryRequest, requestRecovery), new(recoveryRequestParams))).Methods("POST")
+	router.HandleFunc("/api/users", makeCtxHandler(makeAuthedAction(makeOne(validateUser, postUser), admin), func() params { return new(User) })).Methods("POST")
+	router.HandleFunc("/api/users", makeCtxHandler(makeAuthedAction(makeOne(validateUser, postUser)), func() params { return new(User) })).Methods("PUT")
+	router.HandleFunc("/api/recovery/{key:[a-z0-9\\-]+}", makeCtxHandler(makeOne(validateRecovery, recovery), func() params { return new(recoveryParams) })).Methods("PUT")
+	router.HandleFunc("/api/recovery", makeCtxHandler(makeOne(validateRecoveryRequest, requestRecovery), func() params { return new(recoveryRequestParams) })).Methods("POST")
+	router.HandleFunc("/api/events", makeCtxHandler(makeAuthedAction(getEvents), nil)).Methods("GET")
+	router.HandleFunc("/api/stream", makeCtxHandler(makeAuthedAction(getStream), nil)).Methods("GET")
 	router.HandleFunc("/api/licenses", getLicenses).Methods("GET")
 	http.Handle("/", router)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil))
@@ -130,12 +269,25 @@ type params interface{}
 // actionFunc は各パスに対する個別処理を行う関数の型。
 // []byte はレスポンスボディとしてクライアントに送信される。
 // また、error が nil でないとき、エラー用ステータスコードとメッセージがクライアントに送信される。
+// error が ErrNotModified のときは、ステータスコード 304 のみを送信する。
 type actionFunc func(w http.ResponseWriter, r *http.Request, p params) ([]byte, error)
 
 // makeAuthedAction は fn に事前認証チェック機能を付加する関数。
-// fn の処理の前に認証チェックを行い、ログインユーザ情報を context に格納する
+// fn の処理の前に認証チェックを行い、ログインユーザ情報を context に格納する。
+// セッションの他に Authorization: Bearer ヘッダの API トークンでも認証する。
+// 2 段階認証が必須の管理者が有効にしていないときは、管理者のみの機能を使えない
 func makeAuthedAction(fn actionFunc, roles ...string) actionFunc {
 	return func(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+		if token, ok := bearerToken(r); ok {
+			user, t, err := authenticateToken(r, token, roles)
+			if err != nil {
+				return nil, err
+			}
+			context.Set(r, userkey, user)
+			context.Set(r, tokenkey, t)
+			return fn(w, r, p)
+		}
+
 		auth, _ := store.Get(r, sessionAuth)
 		user, ok := auth.Values["user"].(*User)
 		if !ok {
@@ -145,11 +297,95 @@ func makeAuthedAction(fn actionFunc, roles ...string) actionFunc {
 			log.Printf("Unauthorized. ID: %d, Name: %s", user.Id, user.Name)
 			return nil, ErrUnauthorized
 		}
+		if user.Role == admin && inArray(roles, admin) {
+			if err := checkAdminTotp(r, user); err != nil {
+				return nil, err
+			}
+		}
 		context.Set(r, userkey, user)
 		return fn(w, r, p)
 	}
 }
 
+// checkAdminTotp は管理者に 2 段階認証を必須にしているとき、user が 2 段階認証を有効にしているか確認する関数。
+// ログインした後で必須にしたときも、有効にするまで管理者の機能を使えないようにする。
+func checkAdminTotp(r *http.Request, user *User) error {
+	settings, err := FindSecuritySettings(r)
+	if err != nil || !settings.RequireAdminTotp {
+		return err
+	}
+	ts, err := FindTotpStatus(r, user.Id)
+	if err != nil {
+		return err
+	}
+	if !ts.Enabled {
+		log.Printf("Two-factor authentication required. ID: %d, Name: %s", user.Id, user.Name)
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// bearerToken は Authorization: Bearer ヘッダの API トークンを返す関数。
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+// authenticateToken は API トークンで認証し、リクエストに必要なスコープがあるか確認する関数。
+// GET リクエストには scopeRead が、更新系のリクエストには tokenWriteScopes のスコープが必要。
+// 管理者のみの機能は API トークンでは使えない。
+func authenticateToken(r *http.Request, token string, roles []string) (*User, *APIToken, error) {
+	user, t, err := AuthenticateAPIToken(r, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	scopes := t.Scopes
+	if roles != nil {
+		log.Printf("Unauthorized. API tokens cannot be used for role-restricted actions. ID: %d, Name: %s", user.Id, user.Name)
+		return nil, nil, ErrUnauthorized
+	}
+	var scope string
+	if r.Method == "GET" || r.Method == "HEAD" {
+		scope = scopeRead
+	} else if route := mux.CurrentRoute(r); route != nil {
+		tmpl, _ := route.GetPathTemplate()
+		scope = tokenWriteScopes[r.Method+" "+tmpl]
+	}
+	if scope == "" || !inArray(scopes, scope) {
+		log.Printf("Unauthorized. Missing API token scope %q. ID: %d, Name: %s", scope, user.Id, user.Name)
+		return nil, nil, ErrUnauthorized
+	}
+	return &user, &t, nil
+}
+
+// authExpires は認証情報の有効期限を返す関数。
+// API トークンで認証したときはトークンの有効期限を返す。
+// 有効期限を持たないセッションとトークンは、今から最大有効期間が過ぎるまで有効とする。
+func authExpires(r *http.Request) time.Time {
+	auth, _ := store.Get(r, sessionAuth)
+	if t, ok := context.Get(r, tokenkey).(*APIToken); ok {
+		if t.ExpiresAt != nil {
+			return *t.ExpiresAt
+		}
+	} else if exp, ok := auth.Values["expires"].(int64); ok {
+		return time.Unix(exp, 0)
+	}
+	return time.Now().Add(time.Duration(auth.Options.MaxAge) * time.Second)
+}
+
+// checkAuth は長く続くリクエストの認証情報がまだ有効か確認する関数。
+// API トークンで認証したときは、トークンを削除していないか確認する。
+func checkAuth(r *http.Request) error {
+	t, ok := context.Get(r, tokenkey).(*APIToken)
+	if !ok {
+		return nil
+	}
+	return CheckAPIToken(r, t.Id)
+}
+
 // inArray は a に s と同等の要素が格納されているとき true を返す関数。
 func inArray(a []string, s string) bool {
 	for _, e := range a {
@@ -162,19 +398,26 @@ func inArray(a []string, s string) bool {
 }
 
 // makeCtxHandler は fn 処理の前に共通事前処理と後処理を付加する関数。
-// 事前処理は DB インスタンスを context にセットする。
+// 事前処理は DB インスタンスを context にセットし、newParams が生成したリクエストパラメタにリクエストボディを読み込む。
+// リクエストパラメタは同時に処理するリクエストで共有しないよう、リクエストごとに生成する。
 // 後処理はレスポンスの書き出し。
-func makeCtxHandler(fn actionFunc, p params) http.HandlerFunc {
+func makeCtxHandler(fn actionFunc, newParams func() params) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		SetDB(r, db)
 		SetMailTmpl(r, tmpl)
 		SetSmtpConf(r, smtpConf)
 		SetSystemConf(r, systemConf)
+		SetImageConf(r, imgConf)
+		SetCalendarConf(r, calConf)
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-		var err error
-		if p != nil {
-			err = json.NewDecoder(r.Body).Decode(&p)
+		var (
+			p   params
+			err error
+		)
+		if newParams != nil {
+			p = newParams()
+			err = json.NewDecoder(r.Body).Decode(p)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				fmt.Fprintln(w, fmt.Sprintf(errJsTmpl, err.Error()))
@@ -203,6 +446,10 @@ func makeCtxHandler(fn actionFunc, p params) http.HandlerFunc {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(ret)
 			return
+		case err == ErrNotModified:
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
 		case err != nil:
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
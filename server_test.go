@@ -0,0 +1,202 @@
+package mizumanju
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/marcie001/mizumanju/hub"
+)
+
+// sessionCookie は user でログインしたセッションの Cookie を返す関数。
+func sessionCookie(t *testing.T, user *User) *http.Cookie {
+	w := httptest.NewRecorder()
+	saveLogin(w, httptest.NewRequest("GET", "/", nil), user)
+	cs := w.Result().Cookies()
+	if len(cs) == 0 {
+		t.Fatal("session cookie not saved")
+	}
+	return cs[len(cs)-1]
+}
+
+func TestMakeAuthedActionAdminTotp(t *testing.T) {
+	gob.Register(&User{})
+	ok := func(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+		return []byte("{}"), nil
+	}
+
+	tests := []struct {
+		name     string
+		roles    []string
+		required string
+		enabled  int64
+		want     int
+	}{
+		{"not required", []string{admin}, "false", 0, http.StatusOK},
+		// ログインした後で必須にしたときも拒否する
+		{"required and disabled", []string{admin}, "true", 0, http.StatusUnauthorized},
+		{"required and enabled", []string{admin}, "true", 1, http.StatusOK},
+		{"required but not an admin route", nil, "true", 0, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origDB := db
+			defer func() { db = origDB }()
+			db = openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindSetting:        fakeRow(tt.required),
+				sqlFindTotpEnabled:    fakeRow(tt.enabled),
+				sqlCountRecoveryCodes: fakeRow(int64(10)),
+			})
+			defer db.Close()
+
+			r := httptest.NewRequest("GET", "/api/settings/security", nil)
+			r.AddCookie(sessionCookie(t, &User{Id: 1, Name: "root", Role: admin}))
+			w := httptest.NewRecorder()
+			makeCtxHandler(makeAuthedAction(ok, tt.roles...), nil)(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeAuthedActionTokenScopes(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+		return []byte("{}"), nil
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		roles  []string
+		role   string
+		scopes string
+		want   int
+	}{
+		{"read", "GET", "/api/users/me", nil, editor, scopeRead, http.StatusOK},
+		{"read without scope", "GET", "/api/users/me", nil, editor, scopeImageWrite, http.StatusUnauthorized},
+		{"image write", "PUT", "/api/users/me/image", nil, editor, scopeImageWrite, http.StatusOK},
+		{"image write with read scope", "PUT", "/api/users/me/image", nil, editor, scopeRead, http.StatusUnauthorized},
+		{"status write", "PUT", "/api/users/me/status", nil, editor, scopeStatusWrite, http.StatusOK},
+		{"status write with image scope", "PUT", "/api/users/me/status", nil, editor, scopeImageWrite, http.StatusUnauthorized},
+		// スコープに対応付けていない更新系のリクエストは、どのスコープでも拒否する
+		{"unmapped write", "PUT", "/api/users", nil, editor, scopeRead + " " + scopeImageWrite + " " + scopeStatusWrite, http.StatusUnauthorized},
+		{"admin route", "GET", "/api/users", []string{admin}, admin, scopeRead, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origDB := db
+			defer func() { db = origDB }()
+			db = openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindUserByAPIToken:     fakeRow(int64(1), tt.scopes, nil, int64(1), "user01", "User 01", "", tt.role, "user01@example.com", time.Now()),
+				sqlUpdateAPITokenLastUsed: fakeAffected(1),
+			})
+			defer db.Close()
+
+			router := mux.NewRouter()
+			router.HandleFunc(tt.path, makeCtxHandler(makeAuthedAction(ok, tt.roles...), nil)).Methods(tt.method)
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer token")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// isolatedQueries はユーザ 1 がユーザ 2 とだけチームを共有しているときの SQL の結果を返す関数。
+func isolatedQueries() map[string]func([]driver.Value) fakeQuery {
+	return map[string]func([]driver.Value) fakeQuery{
+		// 引数は対象のユーザ、閲覧するユーザ、閲覧するユーザ
+		sqlFindVisible: func(args []driver.Value) fakeQuery {
+			if args[1] == int64(1) && (args[0] == int64(1) || args[0] == int64(2)) {
+				return fakeQuery{rows: [][]driver.Value{{args[0]}}}
+			}
+			return fakeQuery{}
+		},
+		sqlFindDisplay: func(args []driver.Value) fakeQuery {
+			if args[0] != int64(1) {
+				return fakeQuery{}
+			}
+			return fakeQuery{rows: [][]driver.Value{{int64(2), "User 02", "", "skype", int64(0), false, int64(-1)}}}
+		},
+		sqlFindVoiceChatProviders: fakeNoRows,
+	}
+}
+
+func TestTeamIsolation(t *testing.T) {
+	gob.Register(&User{})
+	tests := []struct {
+		name    string
+		route   string
+		path    string
+		handler actionFunc
+	}{
+		{"image", "/api/users/{id:[0-9]+}/image", "/api/users/3/image", getUserImage},
+		{"status", "/api/users/{id:[0-9]+}/status", "/api/users/3/status", getUserStatus},
+		{"stream", "/api/users/{id:[0-9]+}/stream.mjpeg", "/api/users/3/stream.mjpeg", getUserStream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			origDB := db
+			defer func() { db = origDB }()
+			db = openFakeDB(t, isolatedQueries())
+			defer db.Close()
+
+			router := mux.NewRouter()
+			router.HandleFunc(tt.route, makeCtxHandler(makeAuthedAction(tt.handler), nil)).Methods("GET")
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.AddCookie(sessionCookie(t, &User{Id: 1, Name: "User 01", Role: editor}))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if args, ok := fakeDriver.executed(sqlFindVisible); !ok || args[0] != int64(3) || args[1] != int64(1) {
+				t.Errorf("visibility checked with %v, want target 3 and viewer 1", args)
+			}
+		})
+	}
+}
+
+func TestTeamIsolationEvents(t *testing.T) {
+	gob.Register(&User{})
+	origDB := db
+	defer func() { db = origDB }()
+	db = openFakeDB(t, isolatedQueries())
+	defer db.Close()
+
+	// 記録済みのイベントとして送信させるため、先に配信して最後の Id を得る
+	sub := events.Subscribe()
+	events.Publish(hub.Event{Type: hub.Frame, UserId: 9})
+	marker := <-sub.C
+	sub.Close()
+	events.Publish(hub.Event{Type: hub.Frame, UserId: 2})
+	events.Publish(hub.Event{Type: hub.Frame, UserId: 3})
+
+	r := httptest.NewRequest("GET", fmt.Sprintf("/api/events?lastEventId=%d", marker.Id), nil)
+	ctx, cancel := context.WithCancel(r.Context())
+	cancel()
+	r = r.WithContext(ctx)
+	r.AddCookie(sessionCookie(t, &User{Id: 1, Name: "User 01", Role: editor}))
+	w := httptest.NewRecorder()
+	makeCtxHandler(makeAuthedAction(getEvents), nil)(w, r)
+
+	body := w.Body.String()
+	if !strings.Contains(body, `"userId":2`) {
+		t.Errorf("event of a teammate not sent: %s", body)
+	}
+	if strings.Contains(body, `"userId":3`) || strings.Contains(body, `"userId":9`) {
+		t.Errorf("event of a user outside the teams sent: %s", body)
+	}
+}
@@ -0,0 +1,382 @@
+package mizumanju
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/marcie001/mizumanju/hub"
+	"github.com/marcie001/mizumanju/imgmap"
+)
+
+const (
+	// WebSocket の書き込みの待ち時間
+	wsWriteWait = 10 * time.Second
+	// WebSocket で pong を待つ時間
+	wsPongWait = 60 * time.Second
+	// WebSocket で ping を送る間隔。wsPongWait より短くする
+	wsPingPeriod = wsPongWait * 9 / 10
+	// Server-Sent Events で接続を維持するためにコメントを送る間隔
+	sseKeepAlive = 30 * time.Second
+)
+
+// WebSocket のアップグレーダ。
+// セッションクッキーで認証するため、他のオリジンからの接続は受け付けない (既定の CheckOrigin)。
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// getStream は /api/stream へのリクエストを処理する関数。
+// WebSocket に切り替え、セッションの認証情報のユーザの表示設定にあるユーザのイベントを JSON で送信する。
+// ユーザの削除のイベントは全員に、ユーザの追加とチームの変更のイベントは閲覧できるユーザが変わる人に送信する。
+// 認証情報の有効期限が過ぎたとき、または API トークンを削除したときに切断する。
+// 接続を切り替えた後はレスポンスボディを返さない。
+func getStream(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+
+	targets, err := newStreamTargets(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade がエラーレスポンスを送信済み
+		log.Println(err)
+		return nil, nil
+	}
+	defer conn.Close()
+
+	sub := events.Subscribe()
+	defer sub.Close()
+	expires := time.NewTimer(time.Until(authExpires(r)))
+	defer expires.Stop()
+	check := time.NewTicker(tokenCheckInterval)
+	defer check.Stop()
+
+	// クライアントからのメッセージは読み捨て、切断を検知する
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return nil, nil
+			}
+			if !targets.accept(e) {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(e); err != nil {
+				log.Println(err)
+				return nil, nil
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return nil, nil
+			}
+		case <-expires.C:
+			return nil, nil
+		case <-check.C:
+			if err := checkAuth(r); err != nil {
+				log.Println(err)
+				return nil, nil
+			}
+		case <-done:
+			return nil, nil
+		}
+	}
+}
+
+// getUserStream は /api/users/{id:[0-9]+}/stream.mjpeg へのリクエストを処理する関数。
+// multipart/x-mixed-replace でユーザ画像を JPEG として送信し、新しい画像が保存されるたびに送信する。
+// 画像はプライバシー設定を適用して保存されている。表示設定で非表示にしているユーザの画像は送信しない。
+// 認証情報の有効期限が過ぎたとき、API トークンを削除したとき、または対象のユーザが削除されたときに終了する。
+// レスポンスはこの関数内で書き出すため、レスポンスボディを返さない。
+func getUserStream(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("Streaming unsupported.")
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrBadRequest
+	}
+	userId := int32(id)
+
+	if err = CheckVisible(r, user.Id, userId); err != nil {
+		return nil, err
+	}
+	if userId != user.Id {
+		targets, err := newStreamTargets(r, user.Id)
+		if err != nil {
+			return nil, err
+		}
+		if !targets.users[userId] {
+			log.Printf("Hidden. ID: %d, Target ID: %d", user.Id, userId)
+			return nil, ErrNotFound
+		}
+	}
+
+	img, err := GetImage(r, userId, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := events.Subscribe()
+	defer sub.Close()
+	expires := time.NewTimer(time.Until(authExpires(r)))
+	defer expires.Stop()
+	check := time.NewTicker(tokenCheckInterval)
+	defer check.Stop()
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for {
+		if err = writeFrame(mw, img); err != nil {
+			log.Println(err)
+			return nil, nil
+		}
+		flusher.Flush()
+
+		img = nil
+		for img == nil {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					return nil, nil
+				}
+				if e.UserId != userId {
+					continue
+				}
+				switch e.Type {
+				case hub.UserDeleted:
+					return nil, nil
+				case hub.Frame:
+					if img, err = images.Latest(userId); err != nil {
+						log.Println(err)
+						return nil, nil
+					}
+				}
+			case <-expires.C:
+				return nil, nil
+			case <-check.C:
+				if err := checkAuth(r); err != nil {
+					log.Println(err)
+					return nil, nil
+				}
+			case <-r.Context().Done():
+				return nil, nil
+			}
+		}
+	}
+}
+
+// writeFrame は i を JPEG に変換し、マルチパートの 1 パートとして mw に書き出す関数。
+func writeFrame(mw *multipart.Writer, i *imgmap.Img) error {
+	j, err := imgmap.JPEG(i)
+	if err != nil {
+		return err
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", j.ContentType)
+	h.Set("Content-Length", strconv.Itoa(len(j.Data)))
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = pw.Write(j.Data)
+	return err
+}
+
+// streamTargets はイベントを送信する対象を表す構造体。
+// viewer はイベントを受信するユーザ、users はイベントを送信する対象のユーザ ID の集合。
+// db はチームのメンバーが変わったときに対象を読み込み直すために使う。
+type streamTargets struct {
+	db     *sql.DB
+	viewer int32
+	users  map[int32]bool
+}
+
+// newStreamTargets は userId のユーザの表示設定にある、非表示でないユーザを対象とする streamTargets を返す関数。
+func newStreamTargets(r *http.Request, userId int32) (*streamTargets, error) {
+	db, ok := context.Get(r, dbkey).(*sql.DB)
+	if !ok {
+		return nil, errors.New("DB instance not found.")
+	}
+	targets := &streamTargets{db: db, viewer: userId}
+	if err := targets.load(); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+// load は表示設定から対象のユーザを読み込む関数。
+func (targets *streamTargets) load() error {
+	users, err := findDisplaySettings(targets.db, targets.viewer)
+	if err != nil {
+		return err
+	}
+	targets.users = make(map[int32]bool, len(users))
+	for _, u := range users {
+		if !u.Hide {
+			targets.users[u.Id] = true
+		}
+	}
+	return nil
+}
+
+// accept は e を送信するか判定する関数。
+// 宛先のあるイベントは宛先のユーザにのみ送信する。
+// ユーザの追加とチームのメンバーの変更は対象を読み込み直し、閲覧できるユーザが変わったときに送信する。
+// ユーザの削除は全員に送信し、以降の対象に反映する。それ以外は対象のユーザのイベントのみ送信する。
+func (targets *streamTargets) accept(e hub.Event) bool {
+	if e.To != 0 {
+		return e.To == targets.viewer
+	}
+	switch e.Type {
+	case hub.UserAdded, hub.TeamChanged:
+		before := targets.users
+		if err := targets.load(); err != nil {
+			log.Println(err)
+			targets.users = before
+			return false
+		}
+		return e.UserId == 0 || e.UserId == targets.viewer || before[e.UserId] != targets.users[e.UserId]
+	case hub.UserDeleted:
+		delete(targets.users, e.UserId)
+		return true
+	}
+	return targets.users[e.UserId]
+}
+
+// getEvents は /api/events へのリクエストを処理する関数。
+// Server-Sent Events でセッションの認証情報のユーザの表示設定にあるユーザのイベントを送信する。
+// Last-Event-ID ヘッダ (またはクエリパラメタ lastEventId) があるときは、それ以降の記録済みのイベントから送信する。
+// レスポンスはこの関数内で書き出すため、レスポンスボディを返さない。
+func getEvents(w http.ResponseWriter, r *http.Request, p params) ([]byte, error) {
+	user, ok := context.Get(r, userkey).(*User)
+	if !ok {
+		return nil, errors.New("Server Error")
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("Streaming unsupported.")
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("lastEventId")
+	}
+	var id int64
+	if lastId != "" {
+		var err error
+		id, err = strconv.ParseInt(lastId, 10, 64)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrBadRequest
+		}
+	}
+
+	targets, err := newStreamTargets(r, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, missed := events.SubscribeSince(id)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// リバースプロキシにバッファリングさせない
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range missed {
+		if targets.accept(e) {
+			if err := writeEvent(w, e); err != nil {
+				return nil, nil
+			}
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return nil, nil
+			}
+			if !targets.accept(e) {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return nil, nil
+			}
+		case <-ticker.C:
+			if err := checkAuth(r); err != nil {
+				log.Println(err)
+				return nil, nil
+			}
+			// 接続を維持するためのコメント
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil, nil
+			}
+		case <-r.Context().Done():
+			return nil, nil
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent は e を Server-Sent Events の形式で w に書き出す関数。
+func writeEvent(w io.Writer, e hub.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, b)
+	return err
+}
@@ -0,0 +1,107 @@
+// パッケージ totp は RFC 6238 の時間ベースのワンタイムパスワードを扱うパッケージ。
+// 秘密鍵を生成し、認証アプリに登録する URI を作成し、コードを検証するサンプル。
+//     secret, err := totp.GenerateSecret()
+//     uri := totp.URI("mizumanju", "user01", secret)
+//     step, ok := totp.Validate(secret, "123456", time.Now())
+// コードは HMAC-SHA1、6 桁、30 秒ごとのもの (多くの認証アプリの既定) のみ扱う。
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// コードの桁数
+	Digits = 6
+	// コードが変わる間隔
+	Period = 30 * time.Second
+	// 秘密鍵のバイト数
+	secretLength = 20
+	// 時計のずれを許容するステップ数。前後 1 ステップ (30 秒) のコードも受け付ける
+	skew = 1
+)
+
+// encoding は秘密鍵の BASE32 エンコーディング。認証アプリに合わせてパディングしない
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret は BASE32 でエンコードした新しい秘密鍵を生成する関数。
+func GenerateSecret() (string, error) {
+	b := make([]byte, secretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// URI は認証アプリに秘密鍵を登録する otpauth URI を返す関数。
+// issuer はサービス名、account はユーザを識別する名前。
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// Step は t の時点のステップ (UNIX 時間を Period で割ったもの) を返す関数。
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code はステップ step のコードを返す関数。
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	// RFC 4226 の dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, n%mod), nil
+}
+
+// Validate は code が t の時点のコードであるか検証する関数。
+// 正しいときは、そのコードのステップと true を返す。
+// 同じコードを 2 度使わせないよう、呼び出し側で最後に使ったステップ以前のコードを拒否すること。
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		c, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(c), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
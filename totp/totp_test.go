@@ -0,0 +1,84 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret は RFC 6238 Appendix B の SHA1 の秘密鍵 "12345678901234567890" を BASE32 でエンコードしたもの
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 Appendix B のテストベクタ。8 桁のコードの下 6 桁が Digits 桁のコードになる
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.code {
+			t.Errorf("Code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+	// 認証アプリは小文字の秘密鍵も受け付ける
+	if got, _ := Code(strings.ToLower(rfcSecret), 1); got != "287082" {
+		t.Errorf("Code with a lower case secret = %s", got)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current", "050471", step, true},
+		{"previous step", "081804", step - 1, true},
+		{"with spaces", " 050471 ", step, true},
+		{"too old", "287082", 0, false},
+		{"wrong", "000000", 0, false},
+		{"too short", "50471", 0, false},
+		{"8 digits", "14050471", 0, false},
+	}
+	for _, tt := range tests {
+		s, ok := Validate(rfcSecret, tt.code, now)
+		if ok != tt.wantOK || s != tt.wantStep {
+			t.Errorf("%s: Validate = (%d, %v), want (%d, %v)", tt.name, s, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	s1, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, _ := GenerateSecret()
+	if s1 == s2 {
+		t.Error("secrets are not random")
+	}
+	if b, err := encoding.DecodeString(s1); err != nil || len(b) != secretLength {
+		t.Errorf("secret %s is not %d bytes of BASE32: %v", s1, secretLength, err)
+	}
+	if _, err := Code(s1, 1); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,17 +1,47 @@
 package mizumanju
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"log"
 	"net/http"
 	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
 )
 
 // ErrValidation は入力チェックエラーであることを表す
 var ErrValidation error = errors.New("Bad Request")
 
+// presetKeyPattern はステータスプリセットのキーの形式
+var presetKeyPattern = regexp.MustCompile(`^[a-z0-9_\-]{1,32}$`)
+
+const (
+	// ステータスのメッセージの最大文字数
+	maxStatusLength = 191
+	// 絵文字の最大文字数
+	maxEmojiLength = 32
+	// ボイスチャットの URL テンプレートの最大バイト数
+	maxURLTemplateLength = 512
+	// チーム名の最大文字数。teams.name の長さ
+	maxTeamNameLength = 191
+	// ユーザ名とログイン ID の最大文字数。users.name と users.auth_id の長さ
+	maxUserNameLength = 191
+)
+
 // validateLogin は logionParams の入力チェックをする関数
 func validateLogin(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
 	lp, ok := p.(*loginParams)
@@ -76,6 +106,16 @@ func validateUser(w http.ResponseWriter, r *http.Request, p params) (b []byte, e
 		return
 	}
 
+	// 更新するときは、省略した項目に登録済みの値を使う
+	var cur *User
+	if u.Id > 0 {
+		c, err := FindUserById(r, u.Id)
+		if err != nil {
+			return nil, err
+		}
+		cur = &c
+	}
+
 	m := make(map[string][]string)
 
 	if u.Id == 0 && u.AuthId == "" {
@@ -89,6 +129,61 @@ func validateUser(w http.ResponseWriter, r *http.Request, p params) (b []byte, e
 	} else if u.Role != admin && u.Role != editor {
 		m["role"] = []string{"Role is invalid."}
 	}
+	if cur != nil && !u.imageTTLSet {
+		u.ImageTTL = cur.ImageTTL
+	}
+	if u.ImageTTL < 0 || u.ImageTTL > maxImageTTL {
+		m["imageTtl"] = []string{fmt.Sprintf("Image TTL must be between 0 and %d seconds.", maxImageTTL)}
+	}
+	if u.VoiceChatProvider == "" {
+		u.VoiceChatProvider = defaultVoiceChatProvider
+		if cur != nil {
+			u.VoiceChatProvider = cur.VoiceChatProvider
+		}
+	}
+	// 形式を確認する前に登録したボイスチャット ID や、削除したプロバイダのユーザが他の項目を編集できるよう、変更したときのみ確認する
+	if cur == nil || u.VoiceChatProvider != cur.VoiceChatProvider || u.VoiceChatID != cur.VoiceChatID {
+		if provider, err := FindVoiceChatProvider(r, u.VoiceChatProvider); err == ErrNotFound {
+			m["voiceChatProvider"] = []string{"Voice chat provider is invalid."}
+		} else if err != nil {
+			log.Println(err)
+			return nil, err
+		} else if u.VoiceChatID != "" {
+			if utf8.RuneCountInString(u.VoiceChatID) > maxVoiceChatIDLength {
+				m["voiceChatId"] = []string{fmt.Sprintf("Voice chat ID must be at most %d characters.", maxVoiceChatIDLength)}
+			} else if err := provider.validate(u.VoiceChatID); err != nil {
+				m["voiceChatId"] = []string{err.Error()}
+			}
+		}
+	}
+	switch u.Privacy {
+	case "":
+		u.Privacy = privacyNone
+		if cur != nil {
+			u.Privacy = cur.Privacy
+		}
+	case privacyNone, privacyBlur, privacyPixelate, privacySilhouette:
+	default:
+		m["privacy"] = []string{"Privacy is invalid."}
+	}
+	if cur == nil {
+		// 同じチームのユーザしか閲覧できないため、チームを指定しないときは既定のチームに所属させる
+		scnf, ok := context.Get(r, systemkey).(*SystemConf)
+		if !ok {
+			return nil, errors.New("SystemConf instance not found.")
+		}
+		if len(u.TeamIds) == 0 && scnf.DefaultTeam != 0 {
+			u.TeamIds = []int32{scnf.DefaultTeam}
+		}
+		for _, id := range u.TeamIds {
+			if _, err := FindTeam(r, id); err == ErrNotFound {
+				m["teamIds"] = []string{fmt.Sprintf("Team %d does not exist.", id)}
+			} else if err != nil {
+				log.Println(err)
+				return nil, err
+			}
+		}
+	}
 	if u.Email == "" {
 		m["email"] = []string{"Email is required."}
 	} else {
@@ -171,3 +266,518 @@ func validatePassword(w http.ResponseWriter, r *http.Request, p params) (b []byt
 	}
 	return
 }
+
+// validateImage は imageParams の入力チェックをする関数。
+// 画像をデコードし、バイト数と幅、高さが設定の範囲内か確認する。
+func validateImage(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	ip, ok := p.(*imageParams)
+	if !ok {
+		err = fmt.Errorf("Expected *imageParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+	cnf, ok := context.Get(r, imgkey).(*ImageConf)
+	if !ok {
+		err = errors.New("ImageConf instance not found.")
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	if ip.Image == "" {
+		m["image"] = []string{"Image is required."}
+	} else if data, derr := base64.StdEncoding.DecodeString(ip.Image); derr != nil {
+		m["image"] = []string{"Image must be base64 encoded."}
+	} else if len(data) > cnf.MaxBytes {
+		m["image"] = []string{fmt.Sprintf("Image is too large. Max size is %d bytes.", cnf.MaxBytes)}
+	} else if c, _, derr := image.DecodeConfig(bytes.NewReader(data)); derr != nil {
+		// 全体をデコードする前に大きさを確認する
+		m["image"] = []string{"Image format is not supported."}
+	} else if c.Width > cnf.MaxWidth || c.Height > cnf.MaxHeight {
+		m["image"] = []string{fmt.Sprintf("Image is too large. Max dimensions are %dx%d.", cnf.MaxWidth, cnf.MaxHeight)}
+	} else if ip.decoded, _, derr = image.Decode(bytes.NewReader(data)); derr != nil {
+		m["image"] = []string{"Image is broken."}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateStatus は statusParams の入力チェックをする関数。
+// プリセットを指定したときは、省略した値にプリセットの値を設定する。
+func validateStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	sp, ok := p.(*statusParams)
+	if !ok {
+		err = fmt.Errorf("Expected *statusParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	preset, err := findPreset(r, sp.Preset, m)
+	if err != nil {
+		return
+	}
+	if preset != nil {
+		if sp.Status == "" {
+			sp.Status = preset.Message
+		}
+		if sp.Emoji == "" {
+			sp.Emoji = preset.Emoji
+		}
+		if sp.ExpiresAt == nil && preset.Duration > 0 {
+			t := time.Now().Add(time.Duration(preset.Duration) * time.Second)
+			sp.ExpiresAt = &t
+		}
+	}
+	if utf8.RuneCountInString(sp.Status) > maxStatusLength {
+		m["status"] = []string{fmt.Sprintf("Status must be at most %d characters.", maxStatusLength)}
+	}
+	if utf8.RuneCountInString(sp.Emoji) > maxEmojiLength {
+		m["emoji"] = []string{fmt.Sprintf("Emoji must be at most %d characters.", maxEmojiLength)}
+	}
+	if sp.ExpiresAt != nil && !sp.ExpiresAt.After(time.Now()) {
+		m["expiresAt"] = []string{"ExpiresAt must be in the future."}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateStatusPreset は StatusPreset の入力チェックをする関数。
+// パスにキーがあるときは、そのキーを使う。
+func validateStatusPreset(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	sp, ok := p.(*StatusPreset)
+	if !ok {
+		err = fmt.Errorf("Expected *StatusPreset, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+	if key, ok := mux.Vars(r)["key"]; ok {
+		sp.Key = key
+	}
+
+	m := make(map[string][]string)
+
+	if sp.Key == "" {
+		m["key"] = []string{"Key is required."}
+	} else if !presetKeyPattern.MatchString(sp.Key) {
+		m["key"] = []string{"Key must be lowercase letters, digits, '_' or '-' and at most 32 characters."}
+	}
+	if sp.Label == "" {
+		m["label"] = []string{"Label is required."}
+	} else if utf8.RuneCountInString(sp.Label) > maxStatusLength {
+		m["label"] = []string{fmt.Sprintf("Label must be at most %d characters.", maxStatusLength)}
+	}
+	if utf8.RuneCountInString(sp.Message) > maxStatusLength {
+		m["message"] = []string{fmt.Sprintf("Message must be at most %d characters.", maxStatusLength)}
+	}
+	if utf8.RuneCountInString(sp.Emoji) > maxEmojiLength {
+		m["emoji"] = []string{fmt.Sprintf("Emoji must be at most %d characters.", maxEmojiLength)}
+	}
+	if sp.Duration < 0 {
+		m["duration"] = []string{"Duration must not be negative."}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateToken は tokenParams の入力チェックをする関数
+func validateToken(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	tp, ok := p.(*tokenParams)
+	if !ok {
+		err = fmt.Errorf("Expected *tokenParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	if tp.Name == "" {
+		m["name"] = []string{"Name is required."}
+	} else if utf8.RuneCountInString(tp.Name) > maxStatusLength {
+		m["name"] = []string{fmt.Sprintf("Name must be at most %d characters.", maxStatusLength)}
+	}
+	if len(tp.Scopes) == 0 {
+		m["scopes"] = []string{"Scopes are required."}
+	}
+	seen := make(map[string]bool)
+	for _, s := range tp.Scopes {
+		switch {
+		case s != scopeRead && s != scopeImageWrite && s != scopeStatusWrite:
+			m["scopes"] = []string{fmt.Sprintf("Scope %q is invalid.", s)}
+		case seen[s]:
+			m["scopes"] = []string{fmt.Sprintf("Scope %q is duplicated.", s)}
+		}
+		seen[s] = true
+	}
+	if tp.ExpiresAt != nil && !tp.ExpiresAt.After(time.Now()) {
+		m["expiresAt"] = []string{"Expiry must be in the future."}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateTotp は totpParams の入力チェックをする関数
+func validateTotp(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	tp, ok := p.(*totpParams)
+	if !ok {
+		err = fmt.Errorf("Expected *totpParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	if strings.TrimSpace(tp.Code) == "" {
+		m["code"] = []string{"Code is required."}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateTeam は Team の入力チェックをする関数
+func validateTeam(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	t, ok := p.(*Team)
+	if !ok {
+		err = fmt.Errorf("Expected *Team, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+	if v, ok := mux.Vars(r)["id"]; ok {
+		id, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			log.Println(err)
+			return nil, ErrBadRequest
+		}
+		t.Id = int32(id)
+	}
+
+	m := make(map[string][]string)
+
+	if t.Name == "" {
+		m["name"] = []string{"Name is required."}
+	} else if utf8.RuneCountInString(t.Name) > maxTeamNameLength {
+		m["name"] = []string{fmt.Sprintf("Name must be at most %d characters.", maxTeamNameLength)}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateVoiceChatProvider は VoiceChatProvider の入力チェックをする関数
+func validateVoiceChatProvider(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	vp, ok := p.(*VoiceChatProvider)
+	if !ok {
+		err = fmt.Errorf("Expected *VoiceChatProvider, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+	if key, ok := mux.Vars(r)["key"]; ok {
+		vp.Key = key
+	}
+	vp.Builtin = false
+
+	m := make(map[string][]string)
+
+	if vp.Key == "" {
+		m["key"] = []string{"Key is required."}
+	} else if !presetKeyPattern.MatchString(vp.Key) {
+		m["key"] = []string{"Key must be lowercase letters, digits, '_' or '-' and at most 32 characters."}
+	} else if isBuiltinVoiceChatProvider(vp.Key) {
+		m["key"] = []string{"Built-in providers cannot be changed."}
+	}
+	if vp.Name == "" {
+		m["name"] = []string{"Name is required."}
+	} else if utf8.RuneCountInString(vp.Name) > maxStatusLength {
+		m["name"] = []string{fmt.Sprintf("Name must be at most %d characters.", maxStatusLength)}
+	}
+	if vp.URLTemplate == "" {
+		m["urlTemplate"] = []string{"URL template is required."}
+	} else if len(vp.URLTemplate) > maxURLTemplateLength {
+		m["urlTemplate"] = []string{fmt.Sprintf("URL template must be at most %d characters.", maxURLTemplateLength)}
+	} else if err := checkVoiceChatTemplate(vp.URLTemplate); err != nil {
+		m["urlTemplate"] = []string{err.Error()}
+	}
+	if len(vp.Pattern) > maxStatusLength {
+		m["pattern"] = []string{fmt.Sprintf("Pattern must be at most %d characters.", maxStatusLength)}
+	} else if _, err := regexp.Compile(vp.Pattern); err != nil {
+		m["pattern"] = []string{err.Error()}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// findPreset はキーが key のステータスプリセットを返す関数。
+// key が空のときは nil を返す。プリセットが無いときは m にエラーメッセージを追加して nil を返す。
+func findPreset(r *http.Request, key string, m map[string][]string) (*StatusPreset, error) {
+	if key == "" {
+		return nil, nil
+	}
+	preset, err := FindStatusPreset(r, key)
+	switch {
+	case err == ErrNotFound:
+		m["preset"] = []string{"Preset is invalid."}
+		return nil, nil
+	case err != nil:
+		log.Println(err)
+		return nil, err
+	}
+	return &preset, nil
+}
+
+// validateScheduledStatus は scheduledStatusParams の入力チェックをする関数。
+// プリセットを指定したときは、省略した値にプリセットの値を設定する。
+func validateScheduledStatus(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	sp, ok := p.(*scheduledStatusParams)
+	if !ok {
+		err = fmt.Errorf("Expected *scheduledStatusParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	preset, err := findPreset(r, sp.Preset, m)
+	if err != nil {
+		return
+	}
+	if preset != nil {
+		if sp.Status == "" {
+			sp.Status = preset.Message
+		}
+		if sp.Emoji == "" {
+			sp.Emoji = preset.Emoji
+		}
+		if sp.EndsAt == nil && preset.Duration > 0 && !sp.StartsAt.IsZero() {
+			t := sp.StartsAt.Add(time.Duration(preset.Duration) * time.Second)
+			sp.EndsAt = &t
+		}
+	}
+	if utf8.RuneCountInString(sp.Status) > maxStatusLength {
+		m["status"] = []string{fmt.Sprintf("Status must be at most %d characters.", maxStatusLength)}
+	}
+	if utf8.RuneCountInString(sp.Emoji) > maxEmojiLength {
+		m["emoji"] = []string{fmt.Sprintf("Emoji must be at most %d characters.", maxEmojiLength)}
+	}
+	if sp.StartsAt.IsZero() {
+		m["startsAt"] = []string{"StartsAt is required."}
+	} else if sp.EndsAt != nil && !sp.EndsAt.After(sp.StartsAt) {
+		m["endsAt"] = []string{"EndsAt must be after StartsAt."}
+	} else if sp.EndsAt != nil && !sp.EndsAt.After(time.Now()) {
+		m["endsAt"] = []string{"EndsAt must be in the future."}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateWorkingHours は WorkingHours の入力チェックをする関数
+func validateWorkingHours(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	wh, ok := p.(*WorkingHours)
+	if !ok {
+		err = fmt.Errorf("Expected *WorkingHours, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	if wh.TimeZone != "" {
+		if _, lerr := time.LoadLocation(wh.TimeZone); lerr != nil {
+			m["timeZone"] = []string{"Time zone is invalid."}
+		}
+	}
+	// 曜日ごとの時間帯 (開始と終了の分)。同じ開始の時間帯は登録できず、重なる時間帯は意味をなさないため拒否する
+	var ranges [7][][2]int
+	for _, h := range wh.Hours {
+		start, serr := parseClock(h.Start)
+		end, eerr := parseClock(h.End)
+		switch {
+		case h.Weekday < 0 || h.Weekday > 6:
+			m["hours"] = []string{"Weekday must be between 0 (Sunday) and 6 (Saturday)."}
+		case serr != nil || eerr != nil:
+			m["hours"] = []string{"Start and end must be in HH:MM format."}
+		case start >= end:
+			m["hours"] = []string{"End must be after start."}
+		default:
+			for _, rg := range ranges[h.Weekday] {
+				if start < rg[1] && rg[0] < end {
+					m["hours"] = []string{"Working hours must not overlap."}
+				}
+			}
+			ranges[h.Weekday] = append(ranges[h.Weekday], [2]int{start, end})
+		}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateCalendar は calendarParams の入力チェックをする関数。
+// カレンダーを読み込み、iCalendar として読み込めるか確認する。
+func validateCalendar(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	cp, ok := p.(*calendarParams)
+	if !ok {
+		err = fmt.Errorf("Expected *calendarParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+	cnf, ok := context.Get(r, calkey).(*CalendarConf)
+	if !ok {
+		err = errors.New("CalendarConf instance not found.")
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	switch {
+	case cp.URL == "" && cp.Ics == "":
+		m["url"] = []string{"URL or ics is required."}
+	case cp.URL != "" && cp.Ics != "":
+		m["url"] = []string{"Specify either URL or ics."}
+	case cp.URL != "":
+		if cerr := checkCalendarURL(cnf, cp.URL); cerr != nil {
+			m["url"] = []string{cerr.Error()}
+		} else if cp.data, cerr = readCalendar(cnf, cp.URL, ""); cerr != nil {
+			m["url"] = []string{cerr.Error()}
+		}
+	default:
+		var cerr error
+		if cp.data, cerr = readCalendar(cnf, "", cp.Ics); cerr != nil {
+			m["ics"] = []string{cerr.Error()}
+		}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateKnock は knockParams の入力チェックをする関数
+func validateKnock(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	kp, ok := p.(*knockParams)
+	if !ok {
+		err = fmt.Errorf("Expected *knockParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	if utf8.RuneCountInString(kp.Message) > maxStatusLength {
+		m["message"] = []string{fmt.Sprintf("Message must be at most %d characters.", maxStatusLength)}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
+
+// validateKnockAnswer は knockAnswerParams の入力チェックをする関数
+func validateKnockAnswer(w http.ResponseWriter, r *http.Request, p params) (b []byte, err error) {
+	kp, ok := p.(*knockAnswerParams)
+	if !ok {
+		err = fmt.Errorf("Expected *knockAnswerParams, but actual is %T", p)
+		log.Println(err)
+		return
+	}
+
+	m := make(map[string][]string)
+
+	if kp.State != knockAccepted && kp.State != knockDeferred {
+		m["state"] = []string{"State must be accepted or deferred."}
+	}
+
+	if len(m) > 0 {
+		b, err = json.Marshal(NewResponse(m, nil))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		return b, ErrValidation
+	}
+	return
+}
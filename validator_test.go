@@ -0,0 +1,125 @@
+package mizumanju
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidateUserKeepsOmitted(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantTTL int32
+	}{
+		{"omitted", `{"id":2,"name":"User 01","role":"editor","email":"user01@example.com","voiceChatProvider":"jitsi","voiceChatId":"r1"}`, 120},
+		{"null", `{"id":2,"name":"User 01","role":"editor","email":"user01@example.com","voiceChatProvider":"jitsi","voiceChatId":"r1","imageTtl":null}`, 120},
+		{"changed", `{"id":2,"name":"User 01","role":"editor","email":"user01@example.com","voiceChatProvider":"jitsi","voiceChatId":"r1","imageTtl":60}`, 60},
+		{"cleared", `{"id":2,"name":"User 01","role":"editor","email":"user01@example.com","voiceChatProvider":"jitsi","voiceChatId":"r1","imageTtl":0}`, 0},
+		// Skype の ID の形式ではない ID のままプロバイダを省略しても、登録済みのプロバイダのままとする
+		{"provider omitted", `{"id":2,"name":"User 01","role":"editor","email":"user01@example.com","voiceChatId":"r1"}`, 120},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openFakeDB(t, map[string]func([]driver.Value) fakeQuery{
+				sqlFindById:               fakeRow(int64(2), "User 01", "r1", "jitsi", editor, "user01", "user01@example.com", time.Now(), privacyBlur, int64(120)),
+				sqlFindVoiceChatProviders: fakeNoRows,
+			})
+			defer db.Close()
+			r := httptest.NewRequest("PUT", "/api/users", nil)
+			SetDB(r, db)
+
+			var u User
+			if err := json.Unmarshal([]byte(tt.body), &u); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := validateUser(httptest.NewRecorder(), r, &u); err != nil {
+				t.Fatal(err)
+			}
+			if u.ImageTTL != tt.wantTTL {
+				t.Errorf("ImageTTL = %d, want %d", u.ImageTTL, tt.wantTTL)
+			}
+			if u.VoiceChatProvider != "jitsi" {
+				t.Errorf("VoiceChatProvider = %s, want jitsi", u.VoiceChatProvider)
+			}
+			if u.Privacy != privacyBlur {
+				t.Errorf("Privacy = %s, want %s", u.Privacy, privacyBlur)
+			}
+		})
+	}
+}
+
+// encodeTestImage は幅 w、高さ h の画像を format の形式でエンコードする関数。
+func encodeTestImage(t *testing.T, format string, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.RGBA{uint8(x), 0x80, 0xff, 0xff})
+	}
+	buf := new(bytes.Buffer)
+	var err error
+	switch format {
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	case "jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	default:
+		err = png.Encode(buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateImage(t *testing.T) {
+	cnf := &ImageConf{MaxBytes: 4096, MaxWidth: 64, MaxHeight: 48}
+	b64 := base64.StdEncoding.EncodeToString
+	valid := encodeTestImage(t, "png", 64, 48)
+
+	tests := []struct {
+		name  string
+		image string
+		ok    bool
+	}{
+		{"png", b64(valid), true},
+		{"gif", b64(encodeTestImage(t, "gif", 32, 32)), true},
+		{"jpeg", b64(encodeTestImage(t, "jpeg", 32, 32)), true},
+		{"empty", "", false},
+		{"not base64", "not base64!", false},
+		{"not an image", b64([]byte("<html><body>hello</body></html>")), false},
+		{"too wide", b64(encodeTestImage(t, "png", 65, 48)), false},
+		{"too high", b64(encodeTestImage(t, "png", 64, 49)), false},
+		{"too many bytes", b64(append(valid, make([]byte, cnf.MaxBytes)...)), false},
+		// 大きさは読めるが画素が読めない
+		{"broken", b64(valid[:len(valid)-20]), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/api/users/me/image", nil)
+			SetImageConf(r, cnf)
+			p := &imageParams{Image: tt.image}
+			b, err := validateImage(httptest.NewRecorder(), r, p)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("err = %v, %s", err, b)
+				}
+				if p.decoded == nil {
+					t.Error("image not decoded")
+				}
+				return
+			}
+			if err != ErrValidation {
+				t.Errorf("err = %v, want %v", err, ErrValidation)
+			}
+		})
+	}
+}
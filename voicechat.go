@@ -0,0 +1,122 @@
+package mizumanju
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ボイスチャットのプロバイダが指定されていないときのプロバイダ
+	defaultVoiceChatProvider = "skype"
+	// URL テンプレートでボイスチャット ID に置き換える文字列
+	voiceChatIDPlaceholder = "{id}"
+	// ボイスチャット ID の最大文字数
+	maxVoiceChatIDLength = 191
+)
+
+// voiceChatIDPattern は ID の形式が指定されていないプロバイダのボイスチャット ID の形式
+var voiceChatIDPattern = regexp.MustCompile(`^\S+$`)
+
+// voiceChatSchemes は URL テンプレートに使えるスキーム。javascript: などで任意のスクリプトを実行させないため
+var voiceChatSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"sip":   true,
+	"sips":  true,
+	"tel":   true,
+	"skype": true,
+	"xmpp":  true,
+}
+
+// builtinVoiceChatProviders は組み込みのボイスチャットのプロバイダ
+var builtinVoiceChatProviders = []VoiceChatProvider{
+	{Key: "skype", Name: "Skype", URLTemplate: "skype:{id}?call", Pattern: `^(live:[A-Za-z0-9._\-]+|[A-Za-z][A-Za-z0-9.,_\-]{5,31})$`, Builtin: true},
+	{Key: "sip", Name: "SIP", URLTemplate: "sip:{id}", Pattern: `^[A-Za-z0-9._~+\-]+@[A-Za-z0-9.\-]+(:[0-9]+)?$`, Builtin: true},
+	{Key: "jitsi", Name: "Jitsi Meet", URLTemplate: "https://meet.jit.si/{id}", Pattern: `^[A-Za-z0-9_\-]{1,64}$`, Builtin: true},
+	{Key: "matrix", Name: "Matrix", URLTemplate: "https://matrix.to/#/{id}", Pattern: `^[@!#][A-Za-z0-9._=/\-]+:[A-Za-z0-9.\-]+(:[0-9]+)?$`, Builtin: true},
+	{Key: "zoom", Name: "Zoom", URLTemplate: "https://zoom.us/j/{id}", Pattern: `^[0-9]{9,11}$`, Builtin: true},
+}
+
+// voiceChatProviders はキーからボイスチャットのプロバイダを引くための型
+type voiceChatProviders map[string]VoiceChatProvider
+
+// findVoiceChatProviders は組み込みのプロバイダと管理者が登録したプロバイダを返す関数。
+func findVoiceChatProviders(db *sql.DB) (voiceChatProviders, error) {
+	custom, err := findCustomVoiceChatProviders(db)
+	if err != nil {
+		return nil, err
+	}
+	providers := make(voiceChatProviders, len(builtinVoiceChatProviders)+len(custom))
+	for _, p := range builtinVoiceChatProviders {
+		providers[p.Key] = p
+	}
+	for _, p := range custom {
+		providers[p.Key] = p
+	}
+	return providers, nil
+}
+
+// url は provider のボイスチャット ID が id のユーザに発信する URL を返す関数。
+// id が空のとき、またはプロバイダが削除されたときは空文字列を返す。
+func (providers voiceChatProviders) url(provider, id string) string {
+	if id == "" {
+		return ""
+	}
+	if provider == "" {
+		provider = defaultVoiceChatProvider
+	}
+	p, ok := providers[provider]
+	if !ok {
+		return ""
+	}
+	return voiceChatURL(p.URLTemplate, id)
+}
+
+// voiceChatURL は URL テンプレート tmpl の {id} を id に置き換える関数。
+// id は URL のパスに使えるようエスケープする。
+func voiceChatURL(tmpl, id string) string {
+	return strings.Replace(tmpl, voiceChatIDPlaceholder, url.PathEscape(id), -1)
+}
+
+// validate は id がプロバイダのボイスチャット ID の形式であるか確認する関数。
+func (p VoiceChatProvider) validate(id string) error {
+	pattern := voiceChatIDPattern
+	if p.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(p.Pattern); err != nil {
+			return err
+		}
+	}
+	if !pattern.MatchString(id) {
+		return fmt.Errorf("Voice chat ID is not a valid %s ID.", p.Name)
+	}
+	return nil
+}
+
+// checkVoiceChatTemplate は URL テンプレートの形式を確認する関数。
+func checkVoiceChatTemplate(tmpl string) error {
+	if !strings.Contains(tmpl, voiceChatIDPlaceholder) {
+		return fmt.Errorf("URL template must contain %s.", voiceChatIDPlaceholder)
+	}
+	u, err := url.Parse(voiceChatURL(tmpl, "id"))
+	if err != nil {
+		return err
+	}
+	if !voiceChatSchemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("URL scheme %q is not allowed.", u.Scheme)
+	}
+	return nil
+}
+
+// isBuiltinVoiceChatProvider は key が組み込みのプロバイダのキーのとき true を返す関数。
+func isBuiltinVoiceChatProvider(key string) bool {
+	for _, p := range builtinVoiceChatProviders {
+		if p.Key == key {
+			return true
+		}
+	}
+	return false
+}